@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"mirrorer/internal/config"
 	"mirrorer/internal/crawler"
 	"mirrorer/internal/logger"
 	"mirrorer/internal/metrics"
 	"mirrorer/internal/mime"
+	"mirrorer/internal/snapshot"
+	"mirrorer/internal/status_server"
 	"mirrorer/internal/upload"
+	"net"
+	"net/http"
+	"os"
 	"sync"
 	"time"
 
@@ -15,13 +22,25 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2/google"
 )
 
+const gcsReadWriteScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
 func main() {
 	err := logger.InitialiseLogger()
 	checkError(err, "Error parsing log level")
 
-	initMime()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			validate()
+			return
+		case "preflight":
+			preflightCommand()
+			return
+		}
+	}
 
 	// Create waitGroup
 	var wg sync.WaitGroup
@@ -37,22 +56,27 @@ func main() {
 
 	cfg := initConfig()
 
-	// Validate that the SITE URL and allowed domains are accessible before crawling
-	// Skip validation if SKIP_VALIDATION=true for offline testing
+	initMime(cfg)
+
+	s3Buckets := initS3Buckets(cfg)
+
+	// Check that the site, buckets, Pushgateway and disk are ready before crawling
+	// Skip the checks if SKIP_VALIDATION=true for offline testing
 	if !cfg.SkipValidation {
-		err := crawler.ValidateCrawlerConfig(cfg, 10*time.Second)
-		checkError(err, "Configuration validation failed")
+		report := runPreflight(cfg, s3Buckets)
+		if !report.OK() {
+			log.Fatal().Int("failed_checks", len(report.Failed())).Msg("Pre-flight checks failed")
+		}
 	}
 
-	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to load AWS config")
-	}
-	s3Client := s3.NewFromConfig(awsCfg)
+	snapshotPublishers := initSnapshotPublishers(cfg, s3Buckets)
 
-	cr, err := crawler.NewCrawler(cfg, prometheusMetrics, upload.NewUploader(s3Client, cfg.MirrorS3BucketName))
+	cr, err := crawler.NewCrawler(cfg, prometheusMetrics, initUploader(cfg, prometheusMetrics, s3Buckets))
 	checkError(err, "Error creating new crawler")
 
+	// Serve the metrics and progress while crawling, if STATUS_ADDRESS is set
+	statusServer := startStatusServer(cfg, reg, cr.Progress())
+
 	// Go routine to send metrics to Prometheus Pushgateway
 	wg.Go(func() {
 		metrics.PushMetrics(reg, ctx, cfg)
@@ -61,6 +85,11 @@ func main() {
 	// Run crawler
 	cr.Run(prometheusMetrics, reg, cfg)
 
+	var publishErr error
+	if len(snapshotPublishers) > 0 {
+		publishErr = publishSnapshots(context.Background(), cfg, snapshotPublishers, cr.Manifest())
+	}
+
 	// Signal PushMetrics goroutine to gracefully shutdown
 	cancel()
 
@@ -68,16 +97,238 @@ func main() {
 	log.Info().Msg("Waiting for PushMetrics goroutine to gracefully shutdown")
 	wg.Wait()
 	log.Info().Msg("PushMetrics goroutine has shutdown. Main thread is shutting down")
+
+	stopStatusServer(statusServer)
+
+	checkError(publishErr, "Error publishing snapshot")
 }
 
-func initMime() {
-	err := mime.LoadAdditionalMimeTypes()
+// startStatusServer starts serving the metrics, health and progress of the crawl at
+// STATUS_ADDRESS, returning nil if it isn't set
+func startStatusServer(cfg *config.Config, reg *prometheus.Registry, progress *crawler.Progress) *http.Server {
+	if cfg.StatusAddress == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", cfg.StatusAddress)
+	checkError(err, "Error starting the status server")
+
+	server := &http.Server{Handler: status_server.NewHandler(reg, progress), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().Err(err).Msg("Status server error")
+		}
+	}()
+
+	log.Info().Str("address", listener.Addr().String()).Msg("Serving metrics and progress")
+	return server
+}
+
+// stopStatusServer lets the status server finish responding to any requests before stopping it
+func stopStatusServer(server *http.Server) {
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Error stopping the status server")
+	}
+}
+
+func initMime(cfg *config.Config) {
+	err := mime.LoadAdditionalMimeTypes(cfg.MimeTypesFile)
 	checkError(err, "Error loading additional mime types")
 }
 
+// s3Bucket is an S3 bucket the mirror is uploaded to, named after its MIRROR_BACKENDS override
+type s3Bucket struct {
+	backendName string
+	bucketName  string
+	client      *s3.Client
+}
+
+// initS3Buckets returns a client for each configured S3 bucket
+func initS3Buckets(cfg *config.Config) []s3Bucket {
+	buckets := []s3Bucket{}
+
+	if cfg.MirrorS3BucketName == "" && cfg.MirrorS3ReplicaBucketName == "" {
+		return buckets
+	}
+
+	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
+	checkError(err, "Failed to load AWS config")
+
+	if cfg.MirrorS3BucketName != "" {
+		buckets = append(buckets, s3Bucket{
+			backendName: "mirrorS3",
+			bucketName:  cfg.MirrorS3BucketName,
+			client:      s3.NewFromConfig(awsCfg),
+		})
+	}
+
+	if cfg.MirrorS3ReplicaBucketName != "" {
+		buckets = append(buckets, s3Bucket{
+			backendName: "mirrorS3Replica",
+			bucketName:  cfg.MirrorS3ReplicaBucketName,
+			client: s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+				if cfg.MirrorS3ReplicaRegion != "" {
+					o.Region = cfg.MirrorS3ReplicaRegion
+				}
+			}),
+		})
+	}
+
+	return buckets
+}
+
+// initUploader returns an uploader that writes to every configured mirror backend
+func initUploader(cfg *config.Config, m *metrics.Metrics, buckets []s3Bucket) upload.Uploader {
+	policy, err := upload.ParsePartialFailurePolicy(cfg.UploadFailurePolicy)
+	checkError(err, "Error parsing upload failure policy")
+
+	objectPolicy := initObjectPolicy(cfg)
+
+	compression, err := upload.ParseCompression(cfg.UploadCompression)
+	checkError(err, "Error parsing upload compression")
+
+	backends := []upload.Backend{}
+
+	for _, bucket := range buckets {
+		backends = append(backends, upload.Backend{
+			Name:     bucket.backendName,
+			Uploader: upload.NewUploader(bucket.client, bucket.bucketName, initS3UploaderOptions(cfg, bucket.client, bucket.bucketName, objectPolicy, compression)...),
+		})
+	}
+
+	if cfg.MirrorGCSBucketName != "" {
+		backends = append(backends, upload.Backend{
+			Name:     "mirrorGCS",
+			Uploader: upload.NewGCSUploader(initGCSHttpClient(cfg), cfg.GCSEndpoint, cfg.MirrorGCSBucketName),
+		})
+	}
+
+	for _, backend := range backends {
+		log.Info().Str("backend", backend.Name).Msg("Uploading to mirror backend")
+	}
+
+	return upload.NewMultiUploader(backends, policy, m)
+}
+
+// initSnapshotPublishers returns a publisher for each S3 bucket if SNAPSHOT_PUBLISHING is enabled
+func initSnapshotPublishers(cfg *config.Config, buckets []s3Bucket) []*snapshot.Publisher {
+	if !cfg.SnapshotPublishing {
+		return nil
+	}
+
+	if cfg.MirrorGCSBucketName != "" {
+		log.Fatal().Msg("Snapshot publishing is only supported for S3 buckets, unset GCS_BUCKET_NAME or SNAPSHOT_PUBLISHING")
+	}
+
+	publishers := []*snapshot.Publisher{}
+	for _, bucket := range buckets {
+		publishers = append(publishers, snapshot.NewPublisher(bucket.client, bucket.bucketName, cfg.SnapshotPrefix, cfg.SnapshotPointerKey))
+	}
+	return publishers
+}
+
+// publishSnapshots verifies the snapshot uploaded by the crawl in every bucket and only then
+// switches them all to it, before deleting snapshots that are no longer retained
+func publishSnapshots(ctx context.Context, cfg *config.Config, publishers []*snapshot.Publisher, manifest *upload.Manifest) error {
+	// a file that is missing from some buckets makes the snapshot incomplete in those buckets
+	failed := append(manifest.Failed(), manifest.PartiallyFailed()...)
+	for _, publisher := range publishers {
+		if err := publisher.Verify(ctx, cfg.RunID, manifest.Uploaded(), failed); err != nil {
+			return fmt.Errorf("snapshot verification failed, not publishing: %w", err)
+		}
+	}
+
+	for _, publisher := range publishers {
+		if err := publisher.Publish(ctx, cfg.RunID); err != nil {
+			return err
+		}
+	}
+
+	for _, publisher := range publishers {
+		deleted, err := publisher.CollectGarbage(ctx, cfg.SnapshotRetain)
+		if err != nil {
+			log.Error().Err(err).Msg("Error deleting old snapshots")
+		}
+		if len(deleted) > 0 {
+			log.Info().Strs("run_ids", deleted).Msg("Deleted old snapshots")
+		}
+	}
+
+	return nil
+}
+
+func initS3UploaderOptions(cfg *config.Config, s3Client *s3.Client, bucketName string, objectPolicy *upload.ObjectPolicy, compression upload.Compression) []upload.Option {
+	opts := []upload.Option{
+		upload.WithObjectPolicy(objectPolicy, cfg.RunID),
+		upload.WithCompression(compression),
+		upload.WithMultipart(upload.MultipartOptions{
+			Threshold:   cfg.MultipartThreshold,
+			PartSize:    cfg.MultipartPartSize,
+			Concurrency: cfg.MultipartConcurrency,
+		}),
+	}
+
+	aborted, err := upload.AbortAbandonedMultipartUploads(context.Background(), s3Client, bucketName, cfg.MultipartAbandonedAfter)
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", bucketName).Msg("Failed to abort abandoned multipart uploads")
+	} else if aborted > 0 {
+		log.Info().Str("bucket", bucketName).Int("uploads", aborted).Msg("Aborted abandoned multipart uploads")
+	}
+
+	if cfg.S3InventoryPrefetch {
+		startTime := time.Now()
+		inventory, err := upload.LoadInventory(context.Background(), s3Client, bucketName)
+		checkError(err, "Error loading bucket inventory")
+
+		log.Info().Str("bucket", bucketName).Int("objects", inventory.Len()).Dur("duration", time.Since(startTime)).Msg("Loaded bucket inventory")
+		opts = append(opts, upload.WithInventory(inventory))
+	}
+
+	return opts
+}
+
+// initObjectPolicy loads the object policy from OBJECT_POLICY_FILE, falling back to the default policy
+func initObjectPolicy(cfg *config.Config) *upload.ObjectPolicy {
+	if cfg.ObjectPolicyFile == "" {
+		return upload.DefaultObjectPolicy()
+	}
+
+	policy, err := upload.LoadObjectPolicy(cfg.ObjectPolicyFile)
+	checkError(err, "Error loading object policy")
+	return policy
+}
+
+// initGCSHttpClient returns a client authenticated with the application default credentials,
+// unless GCS_ENDPOINT points somewhere else (such as a local fake GCS server)
+func initGCSHttpClient(cfg *config.Config) *http.Client {
+	if cfg.GCSEndpoint != upload.DefaultGCSEndpoint {
+		return &http.Client{Timeout: 60 * time.Second}
+	}
+
+	client, err := google.DefaultClient(context.Background(), gcsReadWriteScope)
+	checkError(err, "Failed to load GCP credentials")
+	return client
+}
+
 func initConfig() *config.Config {
 	cfg, err := config.NewConfig()
 	checkError(err, "Error parsing configuration")
+	checkError(cfg.Validate(), "Invalid configuration")
+	for _, warning := range cfg.Warnings() {
+		log.Warn().Msg(warning)
+	}
+
+	if cfg.RunID == "" {
+		cfg.RunID = time.Now().UTC().Format("20060102T150405Z")
+	}
+	log.Info().Str("run_id", cfg.RunID).Msg("Starting crawl run")
+
 	return cfg
 }
 
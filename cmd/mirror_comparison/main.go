@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"mirrorer/internal/drift_checker"
 	"mirrorer/internal/page_comparer"
@@ -12,11 +13,13 @@ import (
 	"mirrorer/internal/config"
 	"mirrorer/internal/logger"
 	"mirrorer/internal/top_urls"
+	"mirrorer/internal/transport"
 
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/athena"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
@@ -30,9 +33,22 @@ func main() {
 		log.Fatal().Err(err).Msg("Error parsing config")
 	}
 
+	// the validate command prints the effective config and checks it, without comparing
+	validateOnly := len(os.Args) > 1 && os.Args[1] == "validate"
+	if validateOnly {
+		effective, err := yaml.Marshal(config.Redacted(cfg))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error encoding config")
+		}
+		fmt.Print(string(effective))
+	}
+
 	if err := cfg.Validate(); err != nil {
 		log.Fatal().Err(err).Msg("Invalid config")
 	}
+	if validateOnly {
+		return
+	}
 
 	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
 	if err != nil {
@@ -48,7 +64,12 @@ func main() {
 		log.Fatal().Err(err).Msg("Error generating top urls")
 	}
 
-	fetcher, err := page_fetcher.NewPageFetcher(cfg.Site)
+	httpClient, err := transport.NewClient(cfg.HTTPConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error creating HTTP client")
+	}
+
+	fetcher, err := page_fetcher.NewPageFetcher(cfg.Site, page_fetcher.WithHTTPClient(httpClient))
 	if err != nil {
 		log.Error().Err(err).Msg("error creating page fetcher")
 	}
@@ -4,6 +4,7 @@ import (
 	"mirrorer/internal/config"
 	"mirrorer/internal/logger"
 	"mirrorer/internal/metrics"
+	"mirrorer/internal/transport"
 	"net/http"
 	"time"
 
@@ -22,9 +23,14 @@ func main() {
 		log.Fatal().Err(err).Msg("Error parsing config")
 	}
 
+	client, err := transport.NewClient(cfg.HTTPConfig)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error creating HTTP client")
+	}
+
 	reg := prometheus.NewRegistry()
 	prometheusMetrics := metrics.NewResponseMetrics(reg)
-	go updateResponseMetrics(prometheusMetrics, cfg)
+	go updateResponseMetrics(client, prometheusMetrics, cfg)
 
 	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
 	if err := http.ListenAndServe(":9090", nil); err != nil {
@@ -32,9 +38,9 @@ func main() {
 	}
 }
 
-func updateResponseMetrics(m *metrics.ResponseMetrics, cfg *config.Config) {
+func updateResponseMetrics(client *http.Client, m *metrics.ResponseMetrics, cfg *config.Config) {
 	for {
-		metrics.UpdateMirrorResponseStatusCode(m, cfg)
+		metrics.UpdateMirrorResponseStatusCode(client, m, cfg)
 
 		time.Sleep(cfg.StatusCheckRefreshInterval)
 	}
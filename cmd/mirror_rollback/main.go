@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"mirrorer/internal/config"
+	"mirrorer/internal/logger"
+	"mirrorer/internal/snapshot"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+// Re-points every configured S3 bucket to an earlier snapshot of the mirror.
+// Without -to, each bucket is rolled back to the snapshot before the live one.
+func main() {
+	list := flag.Bool("list", false, "list the retained snapshots and the live one, without rolling back")
+	to := flag.String("to", "", "the run ID of the snapshot to roll back to")
+	flag.Parse()
+
+	err := logger.InitialiseLogger()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing log level")
+	}
+
+	cfg, err := config.NewConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing config")
+	}
+
+	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load AWS config")
+	}
+
+	// the primary bucket is always handled before the replica
+	buckets := []bucketPublisher{}
+	if cfg.MirrorS3BucketName != "" {
+		buckets = append(buckets, bucketPublisher{
+			bucketName: cfg.MirrorS3BucketName,
+			publisher:  snapshot.NewPublisher(s3.NewFromConfig(awsCfg), cfg.MirrorS3BucketName, cfg.SnapshotPrefix, cfg.SnapshotPointerKey),
+		})
+	}
+	if cfg.MirrorS3ReplicaBucketName != "" {
+		replicaClient := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			if cfg.MirrorS3ReplicaRegion != "" {
+				o.Region = cfg.MirrorS3ReplicaRegion
+			}
+		})
+		buckets = append(buckets, bucketPublisher{
+			bucketName: cfg.MirrorS3ReplicaBucketName,
+			publisher:  snapshot.NewPublisher(replicaClient, cfg.MirrorS3ReplicaBucketName, cfg.SnapshotPrefix, cfg.SnapshotPointerKey),
+		})
+	}
+
+	if len(buckets) == 0 {
+		log.Fatal().Msg("No S3 bucket name is configured")
+	}
+
+	ctx := context.Background()
+	if *list {
+		for _, bucket := range buckets {
+			listSnapshots(ctx, bucket.bucketName, bucket.publisher)
+		}
+		return
+	}
+
+	// the snapshot to roll back to is found and checked in every bucket before any pointer
+	// is written, so that a bucket without it doesn't leave the others rolled back alone
+	runIDs := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		runID := *to
+		if runID == "" {
+			runID, err = bucket.publisher.Previous(ctx)
+			if err != nil {
+				log.Fatal().Err(err).Str("bucket", bucket.bucketName).Msg("Error finding the previous snapshot, no bucket was rolled back")
+			}
+		}
+
+		if err := bucket.publisher.CheckRetained(ctx, runID); err != nil {
+			log.Fatal().Err(err).Str("bucket", bucket.bucketName).Msg("Error checking the snapshot to roll back to, no bucket was rolled back")
+		}
+		runIDs[i] = runID
+	}
+
+	rolledBack := []string{}
+	for i, bucket := range buckets {
+		if err := bucket.publisher.Publish(ctx, runIDs[i]); err != nil {
+			log.Fatal().Err(err).Str("bucket", bucket.bucketName).Strs("rolled_back_buckets", rolledBack).Msg("Error rolling back")
+		}
+		rolledBack = append(rolledBack, bucket.bucketName)
+	}
+}
+
+type bucketPublisher struct {
+	bucketName string
+	publisher  *snapshot.Publisher
+}
+
+func listSnapshots(ctx context.Context, bucketName string, publisher *snapshot.Publisher) {
+	runIDs, err := publisher.List(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Str("bucket", bucketName).Msg("Error listing snapshots")
+	}
+
+	current, err := publisher.Current(ctx)
+	if err != nil {
+		log.Warn().Err(err).Str("bucket", bucketName).Msg("Error reading the live snapshot")
+	}
+
+	fmt.Printf("%s:\n", bucketName)
+	for _, runID := range runIDs {
+		marker := " "
+		if current != nil && current.RunID == runID {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\n", marker, runID)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"mirrorer/internal/logger"
+	"mirrorer/internal/upload"
+	"mirrorer/internal/verify"
+	"os"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+// Checks that every object in a crawl manifest is present and intact in an S3 bucket, writing
+// a JSON report and exiting with a non-zero status if it is not.
+func main() {
+	manifestPath := flag.String("manifest", "", "the manifest saved by the crawler at MANIFEST_FILE")
+	bucketName := flag.String("bucket", "", "the S3 bucket to verify")
+	region := flag.String("region", "", "the AWS region of the bucket, if it differs from the default region")
+	prefix := flag.String("prefix", "", "the key prefix to look for unexpected objects under, defaulting to the prefix recorded in the manifest")
+	reportPath := flag.String("report", "", "the file to write the report to, defaulting to stdout")
+	concurrency := flag.Int("concurrency", 32, "the number of objects looked up at the same time")
+	strict := flag.Bool("strict", false, "also fail if there are objects under the prefix that are not in the manifest")
+	flag.Parse()
+
+	err := logger.InitialiseLogger()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error parsing log level")
+	}
+
+	if *manifestPath == "" || *bucketName == "" {
+		log.Fatal().Msg("-manifest and -bucket are required")
+	}
+
+	manifest, err := upload.ReadManifestFile(*manifestPath)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error reading the manifest")
+	}
+
+	prefixSet := false
+	flag.Visit(func(f *flag.Flag) {
+		prefixSet = prefixSet || f.Name == "prefix"
+	})
+	if !prefixSet {
+		*prefix = manifest.KeyPrefix
+	}
+
+	awsCfg, err := awsConfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load AWS config")
+	}
+
+	s3Client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if *region != "" {
+			o.Region = *region
+		}
+	})
+
+	verifier := verify.NewVerifier(s3Client, *bucketName, *concurrency)
+	report, err := verifier.Verify(context.Background(), manifest, *prefix)
+	if err != nil {
+		log.Fatal().Err(err).Str("bucket", *bucketName).Msg("Error verifying the bucket")
+	}
+
+	output := os.Stdout
+	if *reportPath != "" {
+		output, err = os.Create(*reportPath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error creating the report")
+		}
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal().Err(err).Msg("Error writing the report")
+	}
+	if err := output.Close(); err != nil {
+		log.Fatal().Err(err).Msg("Error writing the report")
+	}
+
+	log.Info().
+		Str("bucket", *bucketName).
+		Int("checked", report.Checked).
+		Int("missing", len(report.Missing)).
+		Int("mismatched", len(report.Mismatched)).
+		Int("failed_uploads", len(report.FailedUploads)).
+		Int("partially_failed", len(report.PartiallyFailed)).
+		Int("unexpected", len(report.Unexpected)).
+		Msg("Verified the bucket")
+
+	if !report.OK(*strict) {
+		os.Exit(1)
+	}
+}
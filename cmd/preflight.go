@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mirrorer/internal/config"
+	"mirrorer/internal/crawler"
+	"mirrorer/internal/credentials"
+	"mirrorer/internal/metrics"
+	"mirrorer/internal/preflight"
+	"mirrorer/internal/transport"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// preflightChecks returns the checks that the crawl can succeed, run before it starts
+func preflightChecks(cfg *config.Config, buckets []s3Bucket) []preflight.Check {
+	requestCredentials, err := credentials.Load(cfg.RequestCredentialsFile)
+	checkError(err, "Error loading request credentials")
+
+	crawlTransport, err := transport.New(cfg.HTTPConfig)
+	checkError(err, "Error creating the HTTP transport")
+
+	// the same transport as the crawler, so that the site is reached the same way
+	client := &http.Client{
+		Transport: crawlTransport,
+		Timeout:   cfg.PreflightTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			requestCredentials.Apply(req.URL, req.Header)
+			return nil
+		},
+	}
+
+	checks := []preflight.Check{
+		{
+			Name: "domains",
+			Run: func(ctx context.Context) error {
+				return crawler.ValidateCrawlerConfig(ctx, cfg, cfg.PreflightTimeout)
+			},
+		},
+		preflight.SitemapParses(client, cfg, requestCredentials),
+		preflight.RateLimitAccepted(client, cfg, requestCredentials),
+		preflight.PushgatewayReachable(metrics.NewPushgatewayClient(cfg, cfg.PreflightTimeout), cfg.PushGatewayUrl),
+		preflight.DiskSpace(".", cfg.PreflightMinFreeDisk),
+	}
+
+	for _, bucket := range buckets {
+		checks = append(checks, preflight.BucketWritable("bucket_"+bucket.backendName, bucket.client, bucket.bucketName, cfg.RunID))
+	}
+
+	if cfg.MirrorGCSBucketName != "" {
+		checks = append(checks, preflight.GCSBucketWritable("bucket_mirrorGCS", initGCSHttpClient(cfg), cfg.GCSEndpoint, cfg.MirrorGCSBucketName, cfg.RunID))
+	}
+
+	return checks
+}
+
+// runPreflight runs the pre-flight checks in parallel, logging the outcome of each
+func runPreflight(cfg *config.Config, buckets []s3Bucket) preflight.Report {
+	report := preflight.Run(context.Background(), cfg.PreflightTimeout, preflightChecks(cfg, buckets)...)
+
+	for _, result := range report.Checks {
+		event := log.Info()
+		if result.Status == preflight.StatusFail {
+			event = log.Error()
+		}
+		event.
+			Str("check", result.Name).
+			Str("status", string(result.Status)).
+			Float64("latency_ms", result.LatencyMS).
+			Str("detail", result.Detail).
+			Msg("Pre-flight check")
+	}
+
+	return report
+}
+
+// preflightCommand runs the pre-flight checks without crawling, printing the report as JSON and
+// exiting with a non-zero status if any check failed
+func preflightCommand() {
+	cfg := initConfig()
+	report := runPreflight(cfg, initS3Buckets(cfg))
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	checkError(encoder.Encode(report), "Error writing the report")
+
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mirrorer/internal/client"
+	"mirrorer/internal/config"
+	"mirrorer/internal/credentials"
+	"mirrorer/internal/mime"
+	"mirrorer/internal/transport"
+	"mirrorer/internal/upload"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validate checks the configuration without crawling, printing the effective configuration with
+// its secrets redacted and exiting with a non-zero status if there are any problems
+func validate() {
+	cfg, err := config.NewConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	effective, err := yaml.Marshal(config.Redacted(cfg))
+	checkError(err, "Error encoding the configuration")
+	fmt.Print(string(effective))
+
+	for _, warning := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// validateConfig returns every problem with the configuration, including the settings parsed and
+// the files loaded by other packages
+func validateConfig(cfg *config.Config) error {
+	errs := []error{cfg.Validate()}
+
+	if _, err := upload.ParsePartialFailurePolicy(cfg.UploadFailurePolicy); err != nil {
+		errs = append(errs, fmt.Errorf("UPLOAD_FAILURE_POLICY: %w", err))
+	}
+	if _, err := upload.ParseCompression(cfg.UploadCompression); err != nil {
+		errs = append(errs, fmt.Errorf("UPLOAD_COMPRESSION: %w", err))
+	}
+	if cookiePolicy, err := client.ParseCookiePolicy(cfg.CookiePolicy); err != nil {
+		errs = append(errs, fmt.Errorf("COOKIE_POLICY: %w", err))
+	} else if _, err := client.NewCookieJar(cookiePolicy, cfg.Cookies); err != nil {
+		errs = append(errs, fmt.Errorf("COOKIES: %w", err))
+	}
+	if cfg.ObjectPolicyFile != "" {
+		if _, err := upload.LoadObjectPolicy(cfg.ObjectPolicyFile); err != nil {
+			errs = append(errs, fmt.Errorf("OBJECT_POLICY_FILE: %w", err))
+		}
+	}
+	if _, err := credentials.Load(cfg.RequestCredentialsFile); err != nil {
+		errs = append(errs, fmt.Errorf("REQUEST_CREDENTIALS_FILE: %w", err))
+	}
+	if _, err := transport.New(cfg.HTTPConfig); err != nil {
+		errs = append(errs, err)
+	}
+	if err := mime.LoadAdditionalMimeTypes(cfg.MimeTypesFile); err != nil {
+		errs = append(errs, fmt.Errorf("MIME_TYPES_FILE: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"mirrorer/internal/credentials"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
@@ -15,12 +16,62 @@ func (e DisallowedURLError) Error() string {
 	return "Not following redirect because it's not allowed"
 }
 
-func NewClient(c *colly.Collector, redirectHandler func(*http.Request, []*http.Request) error) *http.Client {
-	jar, _ := cookiejar.New(nil)
+// options are the optional settings of the client returned by NewClient
+type options struct {
+	credentials *credentials.Rules
+	transport   http.RoundTripper
+	timeout     time.Duration
+	jar         http.CookieJar
+}
+
+// Option configures optional behaviour of the client returned by NewClient
+type Option func(*options)
+
+// WithCredentials makes the client send the headers and credentials scoped to the domain a
+// request is redirected to, and no others
+func WithCredentials(rules *credentials.Rules) Option {
+	return func(o *options) {
+		o.credentials = rules
+	}
+}
+
+// WithTransport makes the client send requests with the transport instead of the default one
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *options) {
+		o.transport = transport
+	}
+}
+
+// WithTimeout sets the time limit of each request, including reading the response body, instead of
+// 60 seconds. Zero means no time limit, such as when the transport enforces its own timeouts.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithCookieJar makes the client keep and send cookies with the jar, such as one returned by
+// NewCookieJar, instead of a jar shared by every site
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(o *options) {
+		o.jar = jar
+	}
+}
+
+func NewClient(c *colly.Collector, redirectHandler func(*http.Request, []*http.Request) error, opts ...Option) *http.Client {
+	o := options{timeout: 60 * time.Second}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.jar == nil {
+		o.jar, _ = cookiejar.New(nil)
+	}
 
 	client := &http.Client{
-		Jar:     jar,
-		Timeout: 60 * time.Second,
+		Jar:       o.jar,
+		Timeout:   o.timeout,
+		Transport: o.transport,
 	}
 
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -33,6 +84,11 @@ func NewClient(c *colly.Collector, redirectHandler func(*http.Request, []*http.R
 			return DisallowedURLError{}
 		}
 
+		// the headers of the original request are copied to the redirect, which may be to another domain
+		if o.credentials != nil {
+			o.credentials.Apply(req.URL, req.Header)
+		}
+
 		return nil
 	}
 
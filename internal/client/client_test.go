@@ -1,8 +1,11 @@
 package client
 
 import (
+	"mirrorer/internal/credentials"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 	"time"
@@ -41,6 +44,32 @@ func TestNewClient(t *testing.T) {
 	assert.True(t, called, "redirectHandler was not called")
 }
 
+func TestNewClientWithCredentials(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.yaml")
+	err := os.WriteFile(credentialsFile, []byte("rules:\n  - domain: www.gov.uk\n    headers: {Rate-Limit-Token: token}\n"), 0600)
+	assert.NoError(t, err)
+	rules, err := credentials.Load(credentialsFile)
+	assert.NoError(t, err)
+
+	c := colly.NewCollector()
+	client := NewClient(c, func(req *http.Request, via []*http.Request) error { return nil }, WithCredentials(rules))
+
+	req, _ := http.NewRequest("GET", "https://www.gov.uk/guidance", nil)
+	req.Header.Set("Rate-Limit-Token", "token")
+
+	// the token is copied to a redirect to another domain, so must be removed
+	redirectReq, _ := http.NewRequest("GET", "https://assets.publishing.service.gov.uk/guidance.pdf", nil)
+	redirectReq.Header.Set("Rate-Limit-Token", "token")
+	assert.NoError(t, client.CheckRedirect(redirectReq, []*http.Request{req}))
+	assert.Empty(t, redirectReq.Header.Get("Rate-Limit-Token"))
+
+	// and kept on a redirect within the domain
+	redirectReq, _ = http.NewRequest("GET", "https://www.gov.uk/guidance/", nil)
+	redirectReq.Header.Set("Rate-Limit-Token", "token")
+	assert.NoError(t, client.CheckRedirect(redirectReq, []*http.Request{req}))
+	assert.Equal(t, "token", redirectReq.Header.Get("Rate-Limit-Token"))
+}
+
 func TestIsRequestAllowedTableDriven(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -92,3 +121,18 @@ func TestIsRequestAllowedTableDriven(t *testing.T) {
 		})
 	}
 }
+
+func TestNewClientWithTimeout(t *testing.T) {
+	c := colly.NewCollector()
+	client := NewClient(c, func(req *http.Request, via []*http.Request) error { return nil }, WithTimeout(0))
+
+	assert.Zero(t, client.Timeout)
+}
+
+func TestNewClientWithCookieJar(t *testing.T) {
+	jar, err := NewCookieJar(NoCookies, "")
+	assert.NoError(t, err)
+
+	client := NewClient(colly.NewCollector(), func(req *http.Request, via []*http.Request) error { return nil }, WithCookieJar(jar))
+	assert.Equal(t, jar, client.Jar)
+}
@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// CookiePolicy is what the client does with the cookies set by the sites it crawls
+type CookiePolicy string
+
+const (
+	// SharedCookies keeps the cookies set by every site in one jar and sends them back as a
+	// browser would
+	SharedCookies CookiePolicy = "shared"
+	// PerDomainCookies keeps the cookies set by each host in a jar of its own, so that they are
+	// never sent to another host, even one covered by the cookie's Domain
+	PerDomainCookies CookiePolicy = "per_domain"
+	// NoCookies ignores the cookies set by sites and sends none
+	NoCookies CookiePolicy = "none"
+	// PresetCookies ignores the cookies set by sites and sends the same preset cookies, such as
+	// a rejected cookie consent, with every request
+	PresetCookies CookiePolicy = "preset"
+)
+
+// ParseCookiePolicy parses a COOKIE_POLICY, which defaults to SharedCookies when empty
+func ParseCookiePolicy(policy string) (CookiePolicy, error) {
+	switch CookiePolicy(policy) {
+	case "":
+		return SharedCookies, nil
+	case SharedCookies, PerDomainCookies, NoCookies, PresetCookies:
+		return CookiePolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown cookie policy %q, expected %q, %q, %q or %q", policy, SharedCookies, PerDomainCookies, NoCookies, PresetCookies)
+	}
+}
+
+// IgnoresCookies reports whether the cookies set by responses are ignored under the policy
+func (p CookiePolicy) IgnoresCookies() bool {
+	return p == NoCookies || p == PresetCookies
+}
+
+// NewCookieJar returns the cookie jar for the policy. The preset cookies are given in the format
+// of a Cookie header, such as "cookies_policy=rejected; seen_cookie_message=yes", and are only
+// sent under PresetCookies.
+func NewCookieJar(policy CookiePolicy, preset string) (http.CookieJar, error) {
+	if policy != PresetCookies && preset != "" {
+		return nil, fmt.Errorf("preset cookies are only sent with the %q cookie policy", PresetCookies)
+	}
+
+	switch policy {
+	case SharedCookies:
+		jar, _ := cookiejar.New(nil)
+		return jar, nil
+	case PerDomainCookies:
+		return &perDomainJar{jars: map[string]*cookiejar.Jar{}}, nil
+	case NoCookies:
+		return presetJar{}, nil
+	case PresetCookies:
+		cookies, err := http.ParseCookie(preset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset cookies: %w", err)
+		}
+		return presetJar{cookies: cookies}, nil
+	default:
+		_, err := ParseCookiePolicy(string(policy))
+		return nil, err
+	}
+}
+
+// presetJar sends the same cookies with every request, ignoring the cookies set by responses
+type presetJar struct {
+	cookies []*http.Cookie
+}
+
+func (j presetJar) SetCookies(*url.URL, []*http.Cookie) {}
+
+func (j presetJar) Cookies(*url.URL) []*http.Cookie {
+	return j.cookies
+}
+
+// perDomainJar keeps a cookie jar for each host
+type perDomainJar struct {
+	mu   sync.Mutex
+	jars map[string]*cookiejar.Jar
+}
+
+func (j *perDomainJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar(u).SetCookies(u, cookies)
+}
+
+func (j *perDomainJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar(u).Cookies(u)
+}
+
+func (j *perDomainJar) jar(u *url.URL) *cookiejar.Jar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	host := strings.ToLower(u.Hostname())
+	jar, ok := j.jars[host]
+	if !ok {
+		jar, _ = cookiejar.New(nil)
+		j.jars[host] = jar
+	}
+	return jar
+}
+
+// IgnoredCookies returns the names of the cookies set by the response, which are ignored under
+// policies where IgnoresCookies is true
+func IgnoredCookies(header http.Header) []string {
+	names := []string{}
+	for _, line := range header.Values("Set-Cookie") {
+		if cookie, err := http.ParseSetCookie(line); err == nil {
+			names = append(names, cookie.Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCookiePolicy(t *testing.T) {
+	policy, err := ParseCookiePolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, SharedCookies, policy)
+
+	policy, err = ParseCookiePolicy("per_domain")
+	assert.NoError(t, err)
+	assert.Equal(t, PerDomainCookies, policy)
+
+	_, err = ParseCookiePolicy("all")
+	assert.ErrorContains(t, err, `unknown cookie policy "all"`)
+}
+
+func TestNewCookieJar(t *testing.T) {
+	www, _ := url.Parse("https://www.gov.uk/browse")
+	assets, _ := url.Parse("https://assets.gov.uk/image.png")
+	// a cookie for the whole of gov.uk, which a shared jar sends to every subdomain
+	bucket := &http.Cookie{Name: "ab_test_bucket", Value: "B", Domain: "gov.uk", Path: "/"}
+
+	cookieNames := func(cookies []*http.Cookie) []string {
+		names := []string{}
+		for _, cookie := range cookies {
+			names = append(names, cookie.Name+"="+cookie.Value)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name          string
+		policy        CookiePolicy
+		preset        string
+		ignores       bool
+		wwwCookies    []string
+		assetsCookies []string
+	}{
+		{
+			name:          "shared jars send cookies to every host the cookie covers",
+			policy:        SharedCookies,
+			wwwCookies:    []string{"ab_test_bucket=B"},
+			assetsCookies: []string{"ab_test_bucket=B"},
+		},
+		{
+			name:          "per-domain jars only send cookies to the host that set them",
+			policy:        PerDomainCookies,
+			wwwCookies:    []string{"ab_test_bucket=B"},
+			assetsCookies: []string{},
+		},
+		{
+			name:          "no cookies are kept or sent",
+			policy:        NoCookies,
+			ignores:       true,
+			wwwCookies:    []string{},
+			assetsCookies: []string{},
+		},
+		{
+			name:          "only the preset cookies are sent",
+			policy:        PresetCookies,
+			preset:        "cookies_policy=rejected; seen_cookie_message=yes",
+			ignores:       true,
+			wwwCookies:    []string{"cookies_policy=rejected", "seen_cookie_message=yes"},
+			assetsCookies: []string{"cookies_policy=rejected", "seen_cookie_message=yes"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			jar, err := NewCookieJar(test.policy, test.preset)
+			assert.NoError(t, err)
+			assert.Equal(t, test.ignores, test.policy.IgnoresCookies())
+
+			jar.SetCookies(www, []*http.Cookie{bucket})
+
+			assert.Equal(t, test.wwwCookies, cookieNames(jar.Cookies(www)))
+			assert.Equal(t, test.assetsCookies, cookieNames(jar.Cookies(assets)))
+		})
+	}
+
+	t.Run("preset cookies need the preset policy", func(t *testing.T) {
+		_, err := NewCookieJar(NoCookies, "cookies_policy=rejected")
+		assert.ErrorContains(t, err, `preset cookies are only sent with the "preset" cookie policy`)
+	})
+
+	t.Run("invalid preset cookies", func(t *testing.T) {
+		_, err := NewCookieJar(PresetCookies, "")
+		assert.ErrorContains(t, err, "invalid preset cookies")
+	})
+}
+
+func TestIgnoredCookies(t *testing.T) {
+	header := http.Header{}
+	assert.Empty(t, IgnoredCookies(header))
+
+	header.Add("Set-Cookie", "ab_test_bucket=B; Domain=gov.uk; Path=/")
+	header.Add("Set-Cookie", "cookies_policy=accepted; Secure")
+	assert.Equal(t, []string{"ab_test_bucket", "cookies_policy"}, IgnoredCookies(header))
+}
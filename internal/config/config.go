@@ -1,8 +1,15 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
 	"reflect"
 	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v9"
@@ -12,20 +19,66 @@ type Config struct {
 	Site                       string            `env:"SITE"`
 	AllowedDomains             []string          `env:"ALLOWED_DOMAINS" envSeparator:","`
 	UserAgent                  string            `env:"USER_AGENT" envDefault:"govuk-mirror-bot"`
-	Headers                    map[string]string `env:"HEADERS"`
+	Headers                    map[string]string `env:"HEADERS" secret:"true"`
+	RequestCredentialsFile     string            `env:"REQUEST_CREDENTIALS_FILE"`
+	CookiePolicy               string            `env:"COOKIE_POLICY" envDefault:"shared"`
+	Cookies                    string            `env:"COOKIES" secret:"true"`
 	Concurrency                int               `env:"CONCURRENCY" envDefault:"10"`
 	URLFilters                 []*regexp.Regexp  `env:"URL_RULES" envSeparator:","`
 	DisallowedURLFilters       []*regexp.Regexp  `env:"DISALLOWED_URL_RULES" envSeparator:","`
 	SkipValidation             bool              `env:"SKIP_VALIDATION" envDefault:"false"`
+	PreflightTimeout           time.Duration     `env:"PREFLIGHT_TIMEOUT" envDefault:"10s"`
+	PreflightMinFreeDisk       uint64            `env:"PREFLIGHT_MIN_FREE_DISK" envDefault:"1073741824"`
 	MetricRefreshInterval      time.Duration     `env:"METRIC_REFRESH_INTERVAL" envDefault:"10s"`
+	StatusAddress              string            `env:"STATUS_ADDRESS"`
 	Async                      bool              `env:"ASYNC" envDefault:"true"`
 	MirrorS3BucketName         string            `env:"S3_BUCKET_NAME"`
+	MirrorS3ReplicaBucketName  string            `env:"S3_REPLICA_BUCKET_NAME"`
+	MirrorS3ReplicaRegion      string            `env:"S3_REPLICA_REGION"`
+	MirrorGCSBucketName        string            `env:"GCS_BUCKET_NAME"`
+	GCSEndpoint                string            `env:"GCS_ENDPOINT" envDefault:"https://storage.googleapis.com"`
+	UploadFailurePolicy        string            `env:"UPLOAD_FAILURE_POLICY" envDefault:"fail"`
+	S3InventoryPrefetch        bool              `env:"S3_INVENTORY_PREFETCH" envDefault:"false"`
+	UploadWorkers              int               `env:"UPLOAD_WORKERS" envDefault:"10"`
+	UploadQueueSize            int               `env:"UPLOAD_QUEUE_SIZE" envDefault:"100"`
+	UploadMaxRetries           int               `env:"UPLOAD_MAX_RETRIES" envDefault:"5"`
+	UploadRetryBackoff         time.Duration     `env:"UPLOAD_RETRY_BACKOFF" envDefault:"1s"`
+	DeleteAfterUpload          bool              `env:"DELETE_AFTER_UPLOAD" envDefault:"false"`
+	MultipartThreshold         int64             `env:"MULTIPART_THRESHOLD" envDefault:"104857600"`
+	MultipartPartSize          int64             `env:"MULTIPART_PART_SIZE" envDefault:"16777216"`
+	MultipartConcurrency       int               `env:"MULTIPART_CONCURRENCY" envDefault:"4"`
+	MultipartAbandonedAfter    time.Duration     `env:"MULTIPART_ABANDONED_AFTER" envDefault:"24h"`
+	ObjectPolicyFile           string            `env:"OBJECT_POLICY_FILE"`
+	MimeTypesFile              string            `env:"MIME_TYPES_FILE"`
+	RunID                      string            `env:"RUN_ID"`
+	UploadCompression          string            `env:"UPLOAD_COMPRESSION" envDefault:"none"`
+	SnapshotPublishing         bool              `env:"SNAPSHOT_PUBLISHING" envDefault:"false"`
+	SnapshotPrefix             string            `env:"SNAPSHOT_PREFIX" envDefault:"snapshots/"`
+	SnapshotPointerKey         string            `env:"SNAPSHOT_POINTER_KEY" envDefault:"current.json"`
+	SnapshotRetain             int               `env:"SNAPSHOT_RETAIN" envDefault:"5"`
+	ManifestFile               string            `env:"MANIFEST_FILE"`
 	PushGatewayUrl             string            `env:"PROMETHEUS_PUSHGATEWAY_URL"`
+	PushGatewayJob             string            `env:"PROMETHEUS_PUSHGATEWAY_JOB" envDefault:"mirror_metrics"`
+	PushGatewayGrouping        map[string]string `env:"PROMETHEUS_PUSHGATEWAY_GROUPING"`
+	PushGatewayGroupByRunID    bool              `env:"PROMETHEUS_PUSHGATEWAY_GROUP_BY_RUN_ID" envDefault:"false"`
+	PushGatewayUsername        string            `env:"PROMETHEUS_PUSHGATEWAY_USERNAME"`
+	PushGatewayPassword        string            `env:"PROMETHEUS_PUSHGATEWAY_PASSWORD" secret:"true"`
+	PushGatewayBearerToken     string            `env:"PROMETHEUS_PUSHGATEWAY_BEARER_TOKEN" secret:"true"`
+	PushGatewayMaxRetries      int               `env:"PROMETHEUS_PUSHGATEWAY_MAX_RETRIES" envDefault:"3"`
+	PushGatewayRetryBackoff    time.Duration     `env:"PROMETHEUS_PUSHGATEWAY_RETRY_BACKOFF" envDefault:"1s"`
+	PushGatewayDeleteOnStart   bool              `env:"PROMETHEUS_PUSHGATEWAY_DELETE_ON_START" envDefault:"false"`
 	MirrorAvailabilityUrl      string            `env:"MIRROR_AVAILABILITY_URL"`
 	MirrorBackends             []string          `env:"MIRROR_BACKENDS"`
 	StatusCheckRefreshInterval time.Duration     `env:"STATUS_CHECK_REFRESH_INTERVAL" envDefault:"4h"`
+	HTTPConfig
 }
 
+// minMultipartPartSize is the smallest part S3 accepts in a multipart upload
+const minMultipartPartSize = 5 * 1024 * 1024
+
+// validLabelName matches the Prometheus label names that can be used in a Pushgateway grouping key
+var validLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 func NewConfig() (*Config, error) {
 	options := env.Options{FuncMap: map[reflect.Type]env.ParserFunc{
 		reflect.TypeOf(regexp.Regexp{}): func(v string) (interface{}, error) {
@@ -35,7 +88,7 @@ func NewConfig() (*Config, error) {
 
 	cfg := Config{}
 
-	err := env.ParseWithOptions(&cfg, options)
+	err := parse(&cfg, options)
 
 	if err != nil {
 		return nil, err
@@ -43,3 +96,116 @@ func NewConfig() (*Config, error) {
 
 	return &cfg, nil
 }
+
+// credentialHeaders are the headers that carry credentials, and credentialHeaderWords the words
+// that suggest a custom header does
+var (
+	credentialHeaders     = []string{"authorization", "proxy-authorization", "cookie"}
+	credentialHeaderWords = []string{"token", "secret", "password", "api-key", "apikey"}
+)
+
+// Warnings describes the settings that are valid but probably not what was meant
+func (cfg *Config) Warnings() []string {
+	warnings := []string{}
+
+	if cfg.RequestCredentialsFile != "" {
+		for _, header := range slices.Sorted(maps.Keys(cfg.Headers)) {
+			if isCredentialHeader(header) {
+				warnings = append(warnings, fmt.Sprintf("HEADERS sets %s, which is sent to every domain, move it to REQUEST_CREDENTIALS_FILE to scope it", header))
+			}
+		}
+	}
+
+	return warnings
+}
+
+func isCredentialHeader(header string) bool {
+	header = strings.ToLower(header)
+	if slices.Contains(credentialHeaders, header) {
+		return true
+	}
+	return slices.ContainsFunc(credentialHeaderWords, func(word string) bool {
+		return strings.Contains(header, word)
+	})
+}
+
+// Validate checks the settings that can be checked without reference to other packages, returning
+// every problem found
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.Site != "" {
+		if u, err := url.Parse(cfg.Site); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("SITE must be an absolute URL, got %q", cfg.Site))
+		}
+	}
+	if cfg.PushGatewayUrl != "" {
+		if _, err := url.Parse(cfg.PushGatewayUrl); err != nil {
+			errs = append(errs, fmt.Errorf("PROMETHEUS_PUSHGATEWAY_URL must be a valid URL: %w", err))
+		}
+	}
+	for label := range cfg.PushGatewayGrouping {
+		if !validLabelName.MatchString(label) || label == "job" {
+			errs = append(errs, fmt.Errorf("PROMETHEUS_PUSHGATEWAY_GROUPING label %q is not a valid label name other than job", label))
+		}
+	}
+	if cfg.PushGatewayGroupByRunID && cfg.PushGatewayGrouping["run_id"] != "" {
+		errs = append(errs, errors.New("PROMETHEUS_PUSHGATEWAY_GROUPING must not set run_id with PROMETHEUS_PUSHGATEWAY_GROUP_BY_RUN_ID"))
+	}
+	// each run's grouping key is new, so there would be nothing of the previous run's to delete
+	if cfg.PushGatewayGroupByRunID && cfg.PushGatewayDeleteOnStart {
+		errs = append(errs, errors.New("PROMETHEUS_PUSHGATEWAY_DELETE_ON_START can't be set with PROMETHEUS_PUSHGATEWAY_GROUP_BY_RUN_ID"))
+	}
+	if cfg.PushGatewayPassword != "" && cfg.PushGatewayUsername == "" {
+		errs = append(errs, errors.New("PROMETHEUS_PUSHGATEWAY_PASSWORD must be set with PROMETHEUS_PUSHGATEWAY_USERNAME"))
+	}
+	if cfg.PushGatewayUsername != "" && cfg.PushGatewayBearerToken != "" {
+		errs = append(errs, errors.New("only one of PROMETHEUS_PUSHGATEWAY_USERNAME and PROMETHEUS_PUSHGATEWAY_BEARER_TOKEN can be set"))
+	}
+	if cfg.PushGatewayMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("PROMETHEUS_PUSHGATEWAY_MAX_RETRIES must not be negative, got %d", cfg.PushGatewayMaxRetries))
+	}
+	if cfg.PushGatewayRetryBackoff < 0 {
+		errs = append(errs, fmt.Errorf("PROMETHEUS_PUSHGATEWAY_RETRY_BACKOFF must not be negative, got %s", cfg.PushGatewayRetryBackoff))
+	}
+	if cfg.StatusAddress != "" {
+		if _, _, err := net.SplitHostPort(cfg.StatusAddress); err != nil {
+			errs = append(errs, fmt.Errorf("STATUS_ADDRESS must be a host and port, such as :8080: %w", err))
+		}
+	}
+	if err := cfg.HTTPConfig.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.PreflightTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("PREFLIGHT_TIMEOUT must be positive, got %s", cfg.PreflightTimeout))
+	}
+	if cfg.Concurrency < 1 {
+		errs = append(errs, fmt.Errorf("CONCURRENCY must be at least 1, got %d", cfg.Concurrency))
+	}
+	if cfg.UploadWorkers < 1 {
+		errs = append(errs, fmt.Errorf("UPLOAD_WORKERS must be at least 1, got %d", cfg.UploadWorkers))
+	}
+	if cfg.UploadQueueSize < 0 {
+		errs = append(errs, fmt.Errorf("UPLOAD_QUEUE_SIZE must not be negative, got %d", cfg.UploadQueueSize))
+	}
+	if cfg.UploadMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("UPLOAD_MAX_RETRIES must not be negative, got %d", cfg.UploadMaxRetries))
+	}
+	if cfg.UploadCompression != "" && cfg.UploadCompression != "none" && cfg.MirrorGCSBucketName != "" {
+		errs = append(errs, errors.New("UPLOAD_COMPRESSION is only supported for S3 buckets, unset GCS_BUCKET_NAME or UPLOAD_COMPRESSION"))
+	}
+	if cfg.MultipartPartSize < minMultipartPartSize {
+		errs = append(errs, fmt.Errorf("MULTIPART_PART_SIZE must be at least %d (5 MiB), got %d", minMultipartPartSize, cfg.MultipartPartSize))
+	}
+	if cfg.MultipartThreshold < cfg.MultipartPartSize {
+		errs = append(errs, fmt.Errorf("MULTIPART_THRESHOLD must be at least MULTIPART_PART_SIZE, got %d and %d", cfg.MultipartThreshold, cfg.MultipartPartSize))
+	}
+	if cfg.MultipartConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("MULTIPART_CONCURRENCY must be at least 1, got %d", cfg.MultipartConcurrency))
+	}
+	if cfg.SnapshotRetain < 0 {
+		errs = append(errs, fmt.Errorf("SNAPSHOT_RETAIN must not be negative, got %d", cfg.SnapshotRetain))
+	}
+
+	return errors.Join(errs...)
+}
@@ -20,35 +20,117 @@ func TestNewConfig(t *testing.T) {
 			name: "defaults",
 			expected: &Config{
 				UserAgent:                  "govuk-mirror-bot",
+				CookiePolicy:               "shared",
 				Concurrency:                10,
 				SkipValidation:             false,
+				PreflightTimeout:           10 * time.Second,
+				PreflightMinFreeDisk:       1073741824,
 				MetricRefreshInterval:      10 * time.Second,
 				Async:                      true,
 				MirrorS3BucketName:         "",
+				GCSEndpoint:                "https://storage.googleapis.com",
+				UploadFailurePolicy:        "fail",
+				UploadWorkers:              10,
+				UploadQueueSize:            100,
+				UploadMaxRetries:           5,
+				UploadRetryBackoff:         time.Second,
+				DeleteAfterUpload:          false,
+				MultipartThreshold:         104857600,
+				MultipartPartSize:          16777216,
+				MultipartConcurrency:       4,
+				MultipartAbandonedAfter:    24 * time.Hour,
+				UploadCompression:          "none",
+				SnapshotPublishing:         false,
+				SnapshotPrefix:             "snapshots/",
+				SnapshotPointerKey:         "current.json",
+				SnapshotRetain:             5,
 				PushGatewayUrl:             "",
+				PushGatewayJob:             "mirror_metrics",
+				PushGatewayMaxRetries:      3,
+				PushGatewayRetryBackoff:    time.Second,
 				MirrorAvailabilityUrl:      "",
 				MirrorBackends:             nil,
 				StatusCheckRefreshInterval: 4 * time.Hour,
+				HTTPConfig: HTTPConfig{
+					HTTPTimeout:             60 * time.Second,
+					HTTPMaxIdleConns:        100,
+					HTTPMaxIdleConnsPerHost: 10,
+					HTTPIdleConnTimeout:     90 * time.Second,
+					HTTPTLSHandshakeTimeout: 10 * time.Second,
+					HTTP2:                   true,
+				},
 			},
 		},
 		{
 			name: "env vars",
 			envVars: map[string]string{
-				"SITE":                          "example.com",
-				"ALLOWED_DOMAINS":               "example.com,foo.bar",
-				"USER_AGENT":                    "custom-agent",
-				"HEADERS":                       "Test-Header:Test-Value",
-				"CONCURRENCY":                   "20",
-				"URL_RULES":                     "rule1,rule2",
-				"DISALLOWED_URL_RULES":          "rule3,rule4",
-				"SKIP_VALIDATION":               "true",
-				"METRIC_REFRESH_INTERVAL":       "10s",
-				"ASYNC":                         "true",
-				"S3_BUCKET_NAME":                "s3-bucket-name",
-				"PROMETHEUS_PUSHGATEWAY_URL":    "http://pushgateway.test",
-				"MIRROR_AVAILABILITY_URL":       "http://example.com/availability",
-				"MIRROR_BACKENDS":               "backend1,backend2",
-				"STATUS_CHECK_REFRESH_INTERVAL": "30m",
+				"SITE":                                   "example.com",
+				"ALLOWED_DOMAINS":                        "example.com,foo.bar",
+				"USER_AGENT":                             "custom-agent",
+				"HEADERS":                                "Test-Header:Test-Value",
+				"REQUEST_CREDENTIALS_FILE":               "/etc/mirror/credentials.yaml",
+				"RESOLVE":                                "www.gov.uk:443:203.0.113.10",
+				"CONNECT_TO":                             "www.gov.uk:443:origin.example.com:8443,assets.example.com::origin.example.com:443",
+				"PROXY_URL":                              "http://proxy.example.com:3128",
+				"CA_BUNDLE":                              "/etc/mirror/ca.pem",
+				"CLIENT_CERT":                            "/etc/mirror/client.pem",
+				"CLIENT_KEY":                             "/etc/mirror/client-key.pem",
+				"COOKIE_POLICY":                          "preset",
+				"COOKIES":                                "cookies_policy=rejected",
+				"CONCURRENCY":                            "20",
+				"URL_RULES":                              "rule1,rule2",
+				"DISALLOWED_URL_RULES":                   "rule3,rule4",
+				"SKIP_VALIDATION":                        "true",
+				"PREFLIGHT_TIMEOUT":                      "30s",
+				"PREFLIGHT_MIN_FREE_DISK":                "536870912",
+				"METRIC_REFRESH_INTERVAL":                "10s",
+				"STATUS_ADDRESS":                         ":8080",
+				"ASYNC":                                  "true",
+				"S3_BUCKET_NAME":                         "s3-bucket-name",
+				"S3_REPLICA_BUCKET_NAME":                 "s3-replica-bucket-name",
+				"S3_REPLICA_REGION":                      "eu-west-1",
+				"GCS_BUCKET_NAME":                        "gcs-bucket-name",
+				"GCS_ENDPOINT":                           "http://localhost:4443",
+				"UPLOAD_FAILURE_POLICY":                  "continue",
+				"S3_INVENTORY_PREFETCH":                  "true",
+				"UPLOAD_WORKERS":                         "4",
+				"UPLOAD_QUEUE_SIZE":                      "50",
+				"UPLOAD_MAX_RETRIES":                     "2",
+				"UPLOAD_RETRY_BACKOFF":                   "500ms",
+				"DELETE_AFTER_UPLOAD":                    "true",
+				"MULTIPART_THRESHOLD":                    "52428800",
+				"MULTIPART_PART_SIZE":                    "8388608",
+				"MULTIPART_CONCURRENCY":                  "8",
+				"MULTIPART_ABANDONED_AFTER":              "12h",
+				"OBJECT_POLICY_FILE":                     "/etc/mirror/object-policy.json",
+				"MIME_TYPES_FILE":                        "/etc/mirror/mime-types.json",
+				"RUN_ID":                                 "run-1",
+				"UPLOAD_COMPRESSION":                     "br",
+				"SNAPSHOT_PUBLISHING":                    "true",
+				"SNAPSHOT_PREFIX":                        "runs/",
+				"SNAPSHOT_POINTER_KEY":                   "live.json",
+				"SNAPSHOT_RETAIN":                        "3",
+				"MANIFEST_FILE":                          "/var/lib/mirror/manifest.json",
+				"PROMETHEUS_PUSHGATEWAY_URL":             "http://pushgateway.test",
+				"PROMETHEUS_PUSHGATEWAY_JOB":             "mirror",
+				"PROMETHEUS_PUSHGATEWAY_GROUPING":        "environment:staging,shard:2",
+				"PROMETHEUS_PUSHGATEWAY_GROUP_BY_RUN_ID": "true",
+				"PROMETHEUS_PUSHGATEWAY_BEARER_TOKEN":    "token",
+				"PROMETHEUS_PUSHGATEWAY_MAX_RETRIES":     "5",
+				"PROMETHEUS_PUSHGATEWAY_RETRY_BACKOFF":   "2s",
+				"PROMETHEUS_PUSHGATEWAY_DELETE_ON_START": "true",
+				"MIRROR_AVAILABILITY_URL":                "http://example.com/availability",
+				"MIRROR_BACKENDS":                        "backend1,backend2",
+				"STATUS_CHECK_REFRESH_INTERVAL":          "30m",
+				"HTTP_TIMEOUT":                           "2m",
+				"HTTP_CONTENT_TYPE_TIMEOUTS":             "application/pdf:10m,video/*:30m",
+				"HTTP_MAX_IDLE_CONNS":                    "200",
+				"HTTP_MAX_IDLE_CONNS_PER_HOST":           "20",
+				"HTTP_MAX_CONNS_PER_HOST":                "40",
+				"HTTP_IDLE_CONN_TIMEOUT":                 "1m",
+				"HTTP_TLS_HANDSHAKE_TIMEOUT":             "5s",
+				"HTTP_RESPONSE_HEADER_TIMEOUT":           "30s",
+				"HTTP2":                                  "false",
 			},
 			expected: &Config{
 				Site:           "example.com",
@@ -57,7 +139,10 @@ func TestNewConfig(t *testing.T) {
 				Headers: map[string]string{
 					"Test-Header": "Test-Value",
 				},
-				Concurrency: 20,
+				RequestCredentialsFile: "/etc/mirror/credentials.yaml",
+				CookiePolicy:           "preset",
+				Cookies:                "cookies_policy=rejected",
+				Concurrency:            20,
 				URLFilters: []*regexp.Regexp{
 					regexp.MustCompile("rule1"),
 					regexp.MustCompile("rule2"),
@@ -67,13 +152,64 @@ func TestNewConfig(t *testing.T) {
 					regexp.MustCompile("rule4"),
 				},
 				SkipValidation:             true,
+				PreflightTimeout:           30 * time.Second,
+				PreflightMinFreeDisk:       536870912,
 				MetricRefreshInterval:      10 * time.Second,
+				StatusAddress:              ":8080",
 				Async:                      true,
 				MirrorS3BucketName:         "s3-bucket-name",
+				MirrorGCSBucketName:        "gcs-bucket-name",
+				GCSEndpoint:                "http://localhost:4443",
+				MirrorS3ReplicaBucketName:  "s3-replica-bucket-name",
+				MirrorS3ReplicaRegion:      "eu-west-1",
+				UploadFailurePolicy:        "continue",
+				S3InventoryPrefetch:        true,
+				UploadWorkers:              4,
+				UploadQueueSize:            50,
+				UploadMaxRetries:           2,
+				UploadRetryBackoff:         500 * time.Millisecond,
+				DeleteAfterUpload:          true,
+				MultipartThreshold:         52428800,
+				MultipartPartSize:          8388608,
+				MultipartConcurrency:       8,
+				MultipartAbandonedAfter:    12 * time.Hour,
+				ObjectPolicyFile:           "/etc/mirror/object-policy.json",
+				MimeTypesFile:              "/etc/mirror/mime-types.json",
+				RunID:                      "run-1",
+				UploadCompression:          "br",
+				SnapshotPublishing:         true,
+				SnapshotPrefix:             "runs/",
+				SnapshotPointerKey:         "live.json",
+				SnapshotRetain:             3,
+				ManifestFile:               "/var/lib/mirror/manifest.json",
 				PushGatewayUrl:             "http://pushgateway.test",
+				PushGatewayJob:             "mirror",
+				PushGatewayGrouping:        map[string]string{"environment": "staging", "shard": "2"},
+				PushGatewayGroupByRunID:    true,
+				PushGatewayBearerToken:     "token",
+				PushGatewayMaxRetries:      5,
+				PushGatewayRetryBackoff:    2 * time.Second,
+				PushGatewayDeleteOnStart:   true,
 				MirrorAvailabilityUrl:      "http://example.com/availability",
 				MirrorBackends:             []string{"backend1", "backend2"},
 				StatusCheckRefreshInterval: 30 * time.Minute,
+				HTTPConfig: HTTPConfig{
+					Resolve:                   []string{"www.gov.uk:443:203.0.113.10"},
+					ConnectTo:                 []string{"www.gov.uk:443:origin.example.com:8443", "assets.example.com::origin.example.com:443"},
+					ProxyURL:                  "http://proxy.example.com:3128",
+					CABundle:                  "/etc/mirror/ca.pem",
+					ClientCert:                "/etc/mirror/client.pem",
+					ClientKey:                 "/etc/mirror/client-key.pem",
+					HTTPTimeout:               2 * time.Minute,
+					HTTPContentTypeTimeouts:   map[string]time.Duration{"application/pdf": 10 * time.Minute, "video/*": 30 * time.Minute},
+					HTTPMaxIdleConns:          200,
+					HTTPMaxIdleConnsPerHost:   20,
+					HTTPMaxConnsPerHost:       40,
+					HTTPIdleConnTimeout:       time.Minute,
+					HTTPTLSHandshakeTimeout:   5 * time.Second,
+					HTTPResponseHeaderTimeout: 30 * time.Second,
+					HTTP2:                     false,
+				},
 			},
 		},
 	}
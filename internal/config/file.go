@@ -0,0 +1,194 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnvVar is the environment variable holding the path of an optional YAML or JSON config file
+const FileEnvVar = "CONFIG_FILE"
+
+// redactedValue replaces the values of secret settings in Redacted
+const redactedValue = "REDACTED"
+
+var regexpsType = reflect.TypeOf([]*regexp.Regexp{})
+
+// parse fills cfg, a pointer to a struct with env tags, from the config file at CONFIG_FILE if
+// it is set, with environment variables overriding the settings in the file. Settings in neither
+// take their envDefault. Every invalid setting is reported, not just the first.
+func parse(cfg any, options env.Options) error {
+	var errs []error
+
+	err := env.ParseWithOptions(cfg, options)
+	var aggregateErr env.AggregateError
+	if errors.As(err, &aggregateErr) {
+		errs = append(errs, aggregateErr.Errors...)
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+
+	if path := os.Getenv(FileEnvVar); path != "" {
+		errs = append(errs, parseFile(cfg, path)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// parseFile sets the fields of cfg from the config file, keyed by the names of their environment
+// variables, except for those whose environment variables are set
+func parseFile(cfg any, path string) []error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read config file %s: %w", path, err)}
+	}
+
+	settings := map[string]yaml.Node{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return []error{fmt.Errorf("failed to parse config file %s: %w", path, err)}
+	}
+
+	fields := fieldsByEnvVar(reflect.ValueOf(cfg).Elem())
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(settings)) {
+		field, ok := fields[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown setting %s in config file %s", name, path))
+			continue
+		}
+
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+
+		node := settings[name]
+		if err := decodeField(field, &node); err != nil {
+			errs = append(errs, fmt.Errorf("invalid setting %s in config file %s: %w", name, path, err))
+		}
+	}
+
+	return errs
+}
+
+// decodeField sets the field from a YAML value. Lists of regular expressions are given as lists
+// of strings, so that the expressions can contain commas.
+func decodeField(field reflect.Value, node *yaml.Node) error {
+	if field.Type() != regexpsType {
+		return node.Decode(field.Addr().Interface())
+	}
+
+	var patterns []string
+	if err := node.Decode(&patterns); err != nil {
+		return err
+	}
+
+	var errs []error
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		regexps = append(regexps, re)
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	field.Set(reflect.ValueOf(regexps))
+	return nil
+}
+
+// fieldsByEnvVar returns the fields of a struct keyed by the names in their env tags, including
+// those of embedded structs such as HTTPConfig
+func fieldsByEnvVar(v reflect.Value) map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+	for i := range v.NumField() {
+		sf := v.Type().Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			maps.Copy(fields, fieldsByEnvVar(v.Field(i)))
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("env"), ",")
+		if name != "" {
+			fields[name] = v.Field(i)
+		}
+	}
+	return fields
+}
+
+// Redacted returns the settings of cfg, a pointer to a struct with env tags, keyed by the names
+// of their environment variables as in a config file. The values of fields tagged secret:"true"
+// are replaced, as are the passwords in URLs.
+func Redacted(cfg any) map[string]any {
+	return redactedSettings(reflect.ValueOf(cfg).Elem())
+}
+
+func redactedSettings(v reflect.Value) map[string]any {
+	settings := map[string]any{}
+
+	for i := range v.NumField() {
+		sf := v.Type().Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			maps.Copy(settings, redactedSettings(v.Field(i)))
+			continue
+		}
+		name, _, _ := strings.Cut(sf.Tag.Get("env"), ",")
+		if name == "" {
+			continue
+		}
+		settings[name] = redactedSetting(v.Field(i).Interface(), sf.Tag.Get("secret") == "true")
+	}
+
+	return settings
+}
+
+func redactedSetting(value any, secret bool) any {
+	switch value := value.(type) {
+	case string:
+		if secret && value != "" {
+			return redactedValue
+		}
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			return u.Redacted()
+		}
+		return value
+	case map[string]string:
+		if !secret {
+			return value
+		}
+		redacted := map[string]string{}
+		for k := range value {
+			redacted[k] = redactedValue
+		}
+		return redacted
+	case []*regexp.Regexp:
+		patterns := []string{}
+		for _, re := range value {
+			patterns = append(patterns, re.String())
+		}
+		return patterns
+	case time.Duration:
+		return value.String()
+	case map[string]time.Duration:
+		durations := map[string]string{}
+		for k, d := range value {
+			durations[k] = d.String()
+		}
+		return durations
+	default:
+		return value
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HTTPConfig configures the HTTP clients that make requests to the site, which are shared by the
+// crawler, the mirror comparison and the status checker
+type HTTPConfig struct {
+	Resolve                   []string                 `env:"RESOLVE" envSeparator:","`
+	ConnectTo                 []string                 `env:"CONNECT_TO" envSeparator:","`
+	ProxyURL                  string                   `env:"PROXY_URL"`
+	CABundle                  string                   `env:"CA_BUNDLE"`
+	ClientCert                string                   `env:"CLIENT_CERT"`
+	ClientKey                 string                   `env:"CLIENT_KEY"`
+	HTTPTimeout               time.Duration            `env:"HTTP_TIMEOUT" envDefault:"60s"`
+	HTTPContentTypeTimeouts   map[string]time.Duration `env:"HTTP_CONTENT_TYPE_TIMEOUTS"`
+	HTTPMaxIdleConns          int                      `env:"HTTP_MAX_IDLE_CONNS" envDefault:"100"`
+	HTTPMaxIdleConnsPerHost   int                      `env:"HTTP_MAX_IDLE_CONNS_PER_HOST" envDefault:"10"`
+	HTTPMaxConnsPerHost       int                      `env:"HTTP_MAX_CONNS_PER_HOST" envDefault:"0"`
+	HTTPIdleConnTimeout       time.Duration            `env:"HTTP_IDLE_CONN_TIMEOUT" envDefault:"90s"`
+	HTTPTLSHandshakeTimeout   time.Duration            `env:"HTTP_TLS_HANDSHAKE_TIMEOUT" envDefault:"10s"`
+	HTTPResponseHeaderTimeout time.Duration            `env:"HTTP_RESPONSE_HEADER_TIMEOUT" envDefault:"0s"`
+	HTTP2                     bool                     `env:"HTTP2" envDefault:"true"`
+}
+
+// Validate returns every problem with the HTTP settings
+func (hc *HTTPConfig) Validate() error {
+	var errs []error
+
+	// the overrides apply to the address connections are made to, which is the proxy's when there is one
+	if hc.ProxyURL != "" && (len(hc.Resolve) > 0 || len(hc.ConnectTo) > 0) {
+		errs = append(errs, errors.New("PROXY_URL can't be set with RESOLVE or CONNECT_TO, as they would apply to the proxy instead of the site"))
+	}
+	if (hc.ClientCert == "") != (hc.ClientKey == "") {
+		errs = append(errs, errors.New("CLIENT_CERT and CLIENT_KEY must be set together"))
+	}
+	if hc.HTTPTimeout < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_TIMEOUT must not be negative, got %s", hc.HTTPTimeout))
+	}
+	for _, contentType := range slices.Sorted(maps.Keys(hc.HTTPContentTypeTimeouts)) {
+		if !validContentTypePattern(contentType) {
+			errs = append(errs, fmt.Errorf("HTTP_CONTENT_TYPE_TIMEOUTS has invalid content type %q, expected type/subtype or type/*", contentType))
+		}
+		if timeout := hc.HTTPContentTypeTimeouts[contentType]; timeout <= 0 {
+			errs = append(errs, fmt.Errorf("HTTP_CONTENT_TYPE_TIMEOUTS timeout for %s must be positive, got %s", contentType, timeout))
+		}
+	}
+	if hc.HTTPMaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_MAX_IDLE_CONNS must not be negative, got %d", hc.HTTPMaxIdleConns))
+	}
+	if hc.HTTPMaxIdleConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_MAX_IDLE_CONNS_PER_HOST must not be negative, got %d", hc.HTTPMaxIdleConnsPerHost))
+	}
+	if hc.HTTPMaxConnsPerHost < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_MAX_CONNS_PER_HOST must not be negative, got %d", hc.HTTPMaxConnsPerHost))
+	}
+	if hc.HTTPIdleConnTimeout < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_IDLE_CONN_TIMEOUT must not be negative, got %s", hc.HTTPIdleConnTimeout))
+	}
+	if hc.HTTPTLSHandshakeTimeout < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_TLS_HANDSHAKE_TIMEOUT must not be negative, got %s", hc.HTTPTLSHandshakeTimeout))
+	}
+	if hc.HTTPResponseHeaderTimeout < 0 {
+		errs = append(errs, fmt.Errorf("HTTP_RESPONSE_HEADER_TIMEOUT must not be negative, got %s", hc.HTTPResponseHeaderTimeout))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validContentTypePattern reports whether the content type is a media type without parameters,
+// or a type with a wildcard subtype such as video/*
+func validContentTypePattern(contentType string) bool {
+	if mainType, ok := strings.CutSuffix(contentType, "/*"); ok {
+		return mainType != "" && !strings.ContainsAny(mainType, "/*;")
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && len(params) == 0 && mediaType == strings.ToLower(contentType) && strings.Contains(mediaType, "/")
+}
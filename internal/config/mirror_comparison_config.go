@@ -12,12 +12,13 @@ type MirrorComparisonConfig struct {
 	Site                         string `env:"SITE"`
 	CompareTopUnsampledCount     int    `env:"COMPARE_TOP_UNSAMPLED_COUNT" envDefault:"100"`
 	CompareRemainingSampledCount int    `env:"COMPARE_REMAINING_SAMPLED_COUNT" envDefault:"100"`
-	SlackWebhook                 string `env:"SLACK_WEBHOOK" envDefault:""`
+	SlackWebhook                 string `env:"SLACK_WEBHOOK" envDefault:"" secret:"true"`
+	HTTPConfig
 }
 
 func NewMirrorComparisonConfig() (*MirrorComparisonConfig, error) {
 	cfg := MirrorComparisonConfig{}
-	err := env.Parse(&cfg)
+	err := parse(&cfg, env.Options{})
 	if err != nil {
 		return nil, err
 	}
@@ -25,26 +26,27 @@ func NewMirrorComparisonConfig() (*MirrorComparisonConfig, error) {
 	return &cfg, nil
 }
 
+// Validate returns every problem with the config
 func (mcc *MirrorComparisonConfig) Validate() error {
-	if strings.TrimSpace(mcc.Site) == "" {
-		return errors.New("site is required")
-	}
+	var errs []error
 
-	_, err := url.Parse(mcc.Site)
-	if err != nil {
-		return err
+	if strings.TrimSpace(mcc.Site) == "" {
+		errs = append(errs, errors.New("site is required"))
+	} else if _, err := url.Parse(mcc.Site); err != nil {
+		errs = append(errs, err)
 	}
 
 	if strings.TrimSpace(mcc.SlackWebhook) == "" {
-		return errors.New("slack webhook is required")
+		errs = append(errs, errors.New("slack webhook is required"))
+	} else if _, err := url.Parse(mcc.SlackWebhook); err != nil {
+		errs = append(errs, errors.New("slack webhook must be a valid URL"))
 	}
 
-	_, err = url.Parse(mcc.SlackWebhook)
-	if err != nil {
-		return errors.New("slack webhook must be a valid URL")
+	if err := mcc.HTTPConfig.Validate(); err != nil {
+		errs = append(errs, err)
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 func (mcc *MirrorComparisonConfig) HasSlackSettings() bool {
@@ -2,15 +2,22 @@ package crawler
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/xml"
 	"errors"
 	"fmt"
-	"mime"
 	"mirrorer/internal/client"
 	"mirrorer/internal/config"
+	"mirrorer/internal/credentials"
 	"mirrorer/internal/file"
 	"mirrorer/internal/metrics"
+	"mirrorer/internal/mime"
+	"mirrorer/internal/snapshot"
+	"mirrorer/internal/transport"
 	"mirrorer/internal/upload"
+	"net"
 	"net/http"
+	"net/url"
 	"slices"
 	"strings"
 	"time"
@@ -32,23 +39,62 @@ type CrawlState struct {
 	numSitemaps     int
 	counterSitemaps int
 	isScraping      bool
+	progress        *Progress
 }
 
+// maxUnknownTypes bounds the number of distinct unknown content types counted, and so the
+// cardinality of govuk_mirror_crawler_unknown_content_types_total
+const maxUnknownTypes = 50
+
 type Crawler struct {
-	cfg       *config.Config
-	collector *colly.Collector
+	cfg          *config.Config
+	collector    *colly.Collector
+	uploadQueue  *upload.Queue
+	manifest     *upload.Manifest
+	unknownTypes *mime.UnknownTypes
+	progress     *Progress
+	keyPrefix    string
 }
 
 func NewCrawler(cfg *config.Config, m *metrics.Metrics, uploader upload.Uploader) (*Crawler, error) {
-	collector, err := newCollector(cfg, m, uploader)
+	keyPrefix := ""
+	if cfg.SnapshotPublishing {
+		keyPrefix = snapshot.Prefix(cfg.SnapshotPrefix, cfg.RunID)
+	}
+
+	manifest := upload.NewManifest()
+	uploadQueue := upload.NewQueue(uploader, m, upload.QueueOptions{
+		Workers:           cfg.UploadWorkers,
+		Size:              cfg.UploadQueueSize,
+		MaxRetries:        cfg.UploadMaxRetries,
+		RetryBackoff:      cfg.UploadRetryBackoff,
+		KeyPrefix:         keyPrefix,
+		Manifest:          manifest,
+		ManifestDigests:   cfg.ManifestFile != "",
+		DeleteAfterUpload: cfg.DeleteAfterUpload,
+	})
+
+	unknownTypes := mime.NewUnknownTypes(maxUnknownTypes)
+	progress := NewProgress()
+	collector, err := newCollector(cfg, m, uploadQueue, file.NewPathRegistry(), unknownTypes, progress)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Crawler{cfg: cfg, collector: collector}, nil
+	return &Crawler{cfg: cfg, collector: collector, uploadQueue: uploadQueue, manifest: manifest, unknownTypes: unknownTypes, progress: progress, keyPrefix: keyPrefix}, nil
+}
+
+// Manifest returns the record of the files uploaded by the crawl, which is complete once Run returns
+func (cr *Crawler) Manifest() *upload.Manifest {
+	return cr.manifest
+}
+
+// Progress returns the crawl's progress through the entries of the site's sitemaps
+func (cr *Crawler) Progress() *Progress {
+	return cr.progress
 }
 
-func newCollector(cfg *config.Config, m *metrics.Metrics, uploader upload.Uploader) (*colly.Collector, error) {
+func newCollector(cfg *config.Config, m *metrics.Metrics, uploadQueue *upload.Queue, paths *file.PathRegistry, unknownTypes *mime.UnknownTypes, progress *Progress) (*colly.Collector, error) {
 	c := colly.NewCollector(
 		colly.UserAgent(cfg.UserAgent),
 		colly.AllowedDomains(cfg.AllowedDomains...),
@@ -62,12 +108,38 @@ func newCollector(cfg *config.Config, m *metrics.Metrics, uploader upload.Upload
 		numSitemaps:     0,
 		counterSitemaps: 0,
 		isScraping:      false,
+		progress:        progress,
+	}
+
+	requestCredentials, err := credentials.Load(cfg.RequestCredentialsFile)
+	if err != nil {
+		return nil, err
 	}
 
-	client := client.NewClient(c, redirectHandler(c.Context, m, uploader))
+	crawlTransport, err := transport.New(cfg.HTTPConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cookiePolicy, err := client.ParseCookiePolicy(cfg.CookiePolicy)
+	if err != nil {
+		return nil, err
+	}
+	jar, err := client.NewCookieJar(cookiePolicy, cfg.Cookies)
+	if err != nil {
+		return nil, err
+	}
+
+	// the transport times out requests by the content type of their responses, instead of the client
+	client := client.NewClient(c, redirectHandler(m, uploadQueue, paths),
+		client.WithCredentials(requestCredentials),
+		client.WithTransport(transport.WithMetrics(transport.WithTimeouts(crawlTransport, cfg.HTTPConfig), m)),
+		client.WithTimeout(0),
+		client.WithCookieJar(jar),
+	)
 	c.SetClient(client)
 
-	err := c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: cfg.Concurrency})
+	err = c.Limit(&colly.LimitRule{DomainGlob: "*", Parallelism: cfg.Concurrency})
 	if err != nil {
 		return nil, err
 	}
@@ -76,13 +148,19 @@ func newCollector(cfg *config.Config, m *metrics.Metrics, uploader upload.Upload
 		for header, value := range cfg.Headers {
 			r.Headers.Set(header, value)
 		}
+		requestCredentials.Apply(r.URL, *r.Headers)
 	})
 
+	// Follow the progress through the sitemap entries
+	c.OnRequest(progress.requestHandler())
+	c.OnResponse(progress.responseHandler())
+	c.OnError(progress.errorHandler())
+
 	// Handle errors
 	c.OnError(errorHandler(m))
 
 	// Save successful responses to disk
-	c.OnResponse(responseHandler(c.Context, m, uploader))
+	c.OnResponse(responseHandler(m, uploadQueue, paths, unknownTypes, cookiePolicy.IgnoresCookies()))
 
 	// Set up a crawling logic
 	c.OnHTML("a[href], link[href], img[src], script[src]", htmlHandler())
@@ -104,6 +182,8 @@ func (cr *Crawler) Run(m *metrics.Metrics, reg *prometheus.Registry, cfg *config
 	defer metrics.UpdateEndJobMetrics(m, startTime, cfg)
 	defer reg.MustRegister(m.MirrorLastUpdatedGauge())
 
+	cr.uploadQueue.Start(cr.collector.Context)
+
 	// Start the crawler
 	err := cr.collector.Visit(cr.cfg.Site)
 	if err != nil {
@@ -111,13 +191,32 @@ func (cr *Crawler) Run(m *metrics.Metrics, reg *prometheus.Registry, cfg *config
 	}
 
 	cr.collector.Wait()
+
+	log.Info().Msg("Crawl finished, waiting for queued uploads")
+	cr.uploadQueue.Close()
+
+	if counts := cr.unknownTypes.Counts(); len(counts) > 0 {
+		log.Warn().Interface("unknown_content_types", counts).Msg("Crawled content types with no known file extension, which can be added to MIME_TYPES_FILE")
+	}
+
+	cr.publishRunInfo(m, startTime)
+
+	if cr.cfg.ManifestFile != "" {
+		err := cr.manifest.WriteFile(cr.cfg.ManifestFile, cr.cfg.RunID, cr.keyPrefix)
+		if err != nil {
+			log.Error().Err(err).Msg("Error saving the manifest")
+		} else {
+			log.Info().Str("path", cr.cfg.ManifestFile).Msg("Saved the manifest")
+		}
+	}
 }
 
-func redirectHandler(ctx context.Context, m *metrics.Metrics, uploader upload.Uploader) func(req *http.Request, via []*http.Request) error {
+func redirectHandler(m *metrics.Metrics, uploadQueue *upload.Queue, paths *file.PathRegistry) func(req *http.Request, via []*http.Request) error {
 	return func(req *http.Request, via []*http.Request) error {
 		for _, redirectReq := range via {
 			body := file.RedirectHTMLBody(req.URL.String())
 			metrics.CrawledPagesCounter(m)
+			registerPath(m, paths, redirectReq.URL, "text/html")
 			err := file.Save(redirectReq.URL, "text/html", body)
 			if err != nil {
 				metrics.DownloadCrawlerError(m)
@@ -133,13 +232,7 @@ func redirectHandler(ctx context.Context, m *metrics.Metrics, uploader upload.Up
 				log.Error().Err(err).Msg(fmt.Sprintf("Error generating file path for %s", redirectReq.URL.String()))
 			}
 
-			err = uploader.UploadFile(ctx, path, path, "text/html")
-			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("Error uploading %s", path))
-				metrics.FileUploadFailed(m)
-			} else {
-				metrics.FileUploaded(m)
-			}
+			uploadQueue.Enqueue(upload.File{Path: path, Key: path, ContentType: "text/html", SourceURL: redirectReq.URL.String()})
 		}
 		return nil
 	}
@@ -176,6 +269,7 @@ func sitemapXmlHandler(crawlState *CrawlState) func(e *colly.XMLElement) {
 
 func urlsetXmlHandler(crawlState *CrawlState) func(e *colly.XMLElement) {
 	return func(e *colly.XMLElement) {
+		found := 0
 		xmlquery.FindEach(e.DOM.(*xmlquery.Node), "//url", func(i int, child *xmlquery.Node) {
 			var lastmod string
 			if child.SelectElement("lastmod") == nil {
@@ -187,7 +281,9 @@ func urlsetXmlHandler(crawlState *CrawlState) func(e *colly.XMLElement) {
 			crawlState.entries = append(crawlState.entries, entry{
 				val: lastmod,
 				key: child.SelectElement("loc").InnerText()})
+			found++
 		})
+		crawlState.progress.discover(found)
 		crawlState.counterSitemaps += 1
 	}
 }
@@ -204,21 +300,40 @@ func scrapeHandler(crawlState *CrawlState) func(*colly.Response) {
 		})
 		slices.Reverse(crawlState.entries)
 		for _, ei := range crawlState.entries {
-			_ = r.Request.Visit(ei.key)
+			crawlState.progress.visitSitemapEntry(r.Request, ei.key)
 		}
 	}
 }
 
-func responseHandler(ctx context.Context, m *metrics.Metrics, uploader upload.Uploader) func(*colly.Response) {
+func responseHandler(m *metrics.Metrics, uploadQueue *upload.Queue, paths *file.PathRegistry, unknownTypes *mime.UnknownTypes, ignoresCookies bool) func(*colly.Response) {
 	return func(r *colly.Response) {
+		// the page may depend on the cookies, so differ from what browsers are served
+		if ignoresCookies {
+			if names := client.IgnoredCookies(*r.Headers); len(names) > 0 {
+				metrics.IgnoredCookies(m)
+				log.Warn().Str("crawled_url", r.Request.URL.String()).Strs("cookies", names).Msg("Response set cookies that were ignored because of COOKIE_POLICY")
+			}
+		}
 
-		contentType := r.Headers.Get("Content-Type")
+		detection := mime.DetectContentType(*r.Headers, r.Request.URL.Path, r.Body)
+		contentType, mediaType := detection.ContentType, detection.MediaType
 
-		mediaType, _, err := mime.ParseMediaType(contentType)
-		if err != nil {
-			metrics.HttpCrawlerError(m)
-			log.Error().Err(err).Str("crawled_url", r.Request.URL.String()).Msg("Error parsing Content-Type header")
+		if detection.Source != mime.SourceHeader {
+			metrics.ContentTypeFallback(m, string(detection.Source))
+			log.Warn().Str("crawled_url", r.Request.URL.String()).Str("content_type_header", r.Headers.Get("Content-Type")).Str("source", string(detection.Source)).Str("type", contentType).Msg("Missing or invalid Content-Type header, using a fallback")
+
+			// so that the response is parsed according to the fallback content type
+			r.Headers.Set("Content-Type", contentType)
 		}
+		if detection.Mismatch {
+			metrics.ContentTypeMismatch(m, detection.Sniffed)
+			log.Warn().Str("crawled_url", r.Request.URL.String()).Str("type", mediaType).Str("sniffed_type", detection.Sniffed).Msg("Content-Type header doesn't match the content")
+		}
+		if !mime.IsKnownType(mediaType) {
+			metrics.UnknownContentType(m, unknownTypes.Record(mediaType))
+			log.Warn().Str("crawled_url", r.Request.URL.String()).Str("type", mediaType).Msg("Content type has no known file extension")
+		}
+
 		if mediaType == "text/css" {
 			urls := file.FindCssUrls(r.Body)
 
@@ -241,12 +356,15 @@ func responseHandler(ctx context.Context, m *metrics.Metrics, uploader upload.Up
 
 		metrics.CrawledPagesCounter(m)
 
-		err = file.Save(r.Request.URL, contentType, r.Body)
+		registerPath(m, paths, r.Request.URL, contentType)
+		err := file.Save(r.Request.URL, contentType, r.Body)
 		if err != nil {
 			metrics.DownloadCrawlerError(m)
+			metrics.CrawlError(m, r.Request.URL.Hostname(), errorKindSave)
 			log.Error().Err(err).Str("crawled_url", r.Request.URL.String()).Msg("Error saving response to disk")
 		} else {
 			metrics.DownloadCounter(m)
+			metrics.DomainDownload(m, r.Request.URL.Hostname(), contentType)
 			log.Info().Str("crawled_url", r.Request.URL.String()).Str("type", mediaType).Msg("Downloaded file")
 
 			path, err := file.GenerateFilePath(r.Request.URL, contentType)
@@ -254,29 +372,84 @@ func responseHandler(ctx context.Context, m *metrics.Metrics, uploader upload.Up
 				log.Error().Err(err).Msg(fmt.Sprintf("Error generating file path for %s", r.Request.URL.String()))
 			}
 
-			err = uploader.UploadFile(ctx, path, path, contentType)
-			if err != nil {
-				log.Error().Err(err).Msg(fmt.Sprintf("Error uploading %s", path))
-				metrics.FileUploadFailed(m)
-			} else {
-				metrics.FileUploaded(m)
-			}
+			uploadQueue.Enqueue(upload.File{Path: path, Key: path, ContentType: contentType, SourceURL: r.Request.URL.String()})
 		}
 	}
 }
 
+// registerPath records the path the URL is saved at, reporting any collision with the path of another URL.
+// The URL is still saved, replacing the file of the other URL if they have the same path.
+func registerPath(m *metrics.Metrics, paths *file.PathRegistry, u *url.URL, contentType string) {
+	path, err := file.GenerateFilePath(u, contentType)
+	if err != nil {
+		// saving the file reports the error
+		return
+	}
+
+	var collision *file.CollisionError
+	if err := paths.Register(u, path); errors.As(err, &collision) {
+		metrics.PathCollision(m, string(collision.Kind))
+		log.Warn().Err(err).Str("crawled_url", u.String()).Str("kind", string(collision.Kind)).Msg("Path collision")
+	}
+}
+
 func isForbiddenURLError(err error) bool {
 	return errors.Is(err, colly.ErrForbiddenDomain) || errors.Is(err, colly.ErrForbiddenURL) || errors.As(err, new(*colly.AlreadyVisitedError))
 }
 
+// The kinds of error counted by govuk_mirror_crawler_errors_by_kind_total
+const (
+	errorKindClientError = "client_error"
+	errorKindServerError = "server_error"
+	errorKindTimeout     = "timeout"
+	errorKindConnection  = "connection"
+	errorKindTLS         = "tls"
+	errorKindParse       = "parse"
+	errorKindSave        = "save"
+	errorKindOther       = "other"
+)
+
+// errorKind classifies an error returned from a request, so that errors can be counted without
+// labelling them with their messages, which can contain URLs
+func errorKind(r *colly.Response, err error) string {
+	var netErr net.Error
+	var tlsErr *tls.CertificateVerificationError
+	var tlsAlert tls.AlertError
+	var syntaxErr *xml.SyntaxError
+	var opErr *net.OpError
+
+	switch {
+	case r.StatusCode >= 500:
+		return errorKindServerError
+	case r.StatusCode >= 400:
+		return errorKindClientError
+	case errors.Is(err, transport.ErrTimeout), errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errorKindTimeout
+	case errors.As(err, &tlsErr), errors.As(err, &tlsAlert):
+		return errorKindTLS
+	case errors.As(err, &opErr):
+		return errorKindConnection
+	case errors.As(err, &syntaxErr):
+		return errorKindParse
+	default:
+		return errorKindOther
+	}
+}
+
+// isIgnoredError reports whether the error is from a URL that is normal not to follow
+func isIgnoredError(err error) bool {
+	return errors.Is(err, client.DisallowedURLError{}) || isForbiddenURLError(err)
+}
+
 func errorHandler(m *metrics.Metrics) func(*colly.Response, error) {
 	return func(r *colly.Response, err error) {
-		if errors.Is(err, client.DisallowedURLError{}) || isForbiddenURLError(err) {
+		if isIgnoredError(err) {
 			// Normal behaviour to not follow the URL, so we can just ignore this error
 			return
 		}
 
 		metrics.HttpCrawlerError(m)
+		metrics.CrawlError(m, r.Request.URL.Hostname(), errorKind(r, err))
 		log.Error().Err(err).Int("status", r.StatusCode).Str("crawled_url", r.Request.URL.String()).Msg("Error returned from request")
 	}
 }
@@ -2,12 +2,21 @@ package crawler
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"mirrorer/internal/config"
 	"mirrorer/internal/file"
 	"mirrorer/internal/metrics"
 	"mirrorer/internal/mime"
+	"mirrorer/internal/transport"
+	"mirrorer/internal/upload"
 	"mirrorer/internal/upload/uploadfakes"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -15,7 +24,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/gocolly/colly/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -370,7 +382,7 @@ func TestRun(t *testing.T) {
 	hostname := serverUrl.Hostname()
 
 	// Make mime types across consistent different systems
-	err := mime.LoadAdditionalMimeTypes()
+	err := mime.LoadAdditionalMimeTypes("")
 	if err != nil {
 		t.Fatalf("could not load mimetypes: %v", err)
 	}
@@ -396,11 +408,13 @@ func TestRun(t *testing.T) {
 
 	// Initialize uploader
 	uploader := &uploadfakes.FakeUploader{}
-	uploader.UploadFileStub = func(ctx context.Context, file string, key string, contentType string) error {
-		if file == hostname+"/3.html" {
-			return fmt.Errorf("error uploading")
+	uploader.UploadFileStub = func(ctx context.Context, f upload.File) (upload.Outcome, error) {
+		if f.Path == hostname+"/3.html" {
+			return "", fmt.Errorf("error uploading")
+		} else if f.Path == hostname+"/1.html" {
+			return upload.OutcomeSkippedIdentical, nil
 		} else {
-			return nil
+			return upload.OutcomeUploadedNew, nil
 		}
 	}
 
@@ -480,8 +494,8 @@ func TestRun(t *testing.T) {
 
 		var uploadedPaths []string
 		for i := 0; i < uploader.UploadFileCallCount(); i++ {
-			_, path, _, _ := uploader.UploadFileArgsForCall(i)
-			uploadedPaths = append(uploadedPaths, path)
+			_, f := uploader.UploadFileArgsForCall(i)
+			uploadedPaths = append(uploadedPaths, f.Path)
 		}
 
 		for _, testPath := range files {
@@ -489,6 +503,14 @@ func TestRun(t *testing.T) {
 		}
 	})
 
+	t.Run("freshness marker is not published when uploads failed", func(t *testing.T) {
+		for i := 0; i < uploader.UploadFileCallCount(); i++ {
+			_, f := uploader.UploadFileArgsForCall(i)
+			assert.NotEqual(t, hostname+"/last-updated.txt", f.Path)
+		}
+		assert.NoFileExists(t, hostname+"/last-updated.txt")
+	})
+
 	t.Run("correct file uploaded counter metric", func(t *testing.T) {
 		assert.Equal(t, float64(len(tests)-1), testutil.ToFloat64(m.FileUploadCounter()))
 	})
@@ -496,4 +518,337 @@ func TestRun(t *testing.T) {
 	t.Run("correct file upload failures counter metric", func(t *testing.T) {
 		assert.Equal(t, float64(1), testutil.ToFloat64(m.FileUploadFailuresCounter()))
 	})
+
+	t.Run("no path collisions", func(t *testing.T) {
+		assert.Equal(t, 0, testutil.CollectAndCount(m.PathCollisionCounter()))
+	})
+
+	t.Run("upload queue is drained when Run returns", func(t *testing.T) {
+		assert.Equal(t, float64(0), testutil.ToFloat64(m.UploadQueueDepth()))
+	})
+
+	t.Run("progress through the sitemap entries", func(t *testing.T) {
+		report := cr.Progress().Report()
+
+		assert.Equal(t, 5, report.Discovered)
+		// /500 failed
+		assert.Equal(t, 4, report.Visited)
+		assert.Equal(t, 1, report.Failed)
+		assert.Equal(t, 0, report.Skipped)
+		assert.Equal(t, 0, report.Queued)
+		assert.Nil(t, report.ETA)
+	})
+
+	t.Run("correct upload decisions counter metric", func(t *testing.T) {
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.UploadDecisionCounter().WithLabelValues("skipped_identical")))
+		assert.Equal(t, float64(len(tests)-2), testutil.ToFloat64(m.UploadDecisionCounter().WithLabelValues("uploaded_new")))
+	})
+}
+
+func TestRunPublishesRunInfo(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.Close()
+
+	serverUrl, _ := url.Parse(ts.URL)
+	hostname := serverUrl.Hostname()
+
+	err := mime.LoadAdditionalMimeTypes("")
+	if err != nil {
+		t.Fatalf("could not load mimetypes: %v", err)
+	}
+
+	cfg := &config.Config{
+		Site:           ts.URL + "/sitemap.xml",
+		AllowedDomains: []string{hostname},
+		URLFilters: []*regexp.Regexp{
+			regexp.MustCompile(".*"),
+		},
+		MirrorS3BucketName: "s3-bucket-name",
+		RunID:              "20260101T020000Z",
+		ManifestFile:       filepath.Join(t.TempDir(), "manifest.json"),
+	}
+
+	reg := prometheus.NewRegistry()
+	m := metrics.NewMetrics(reg)
+
+	uploader := &uploadfakes.FakeUploader{}
+	uploader.UploadFileReturns(upload.OutcomeUploadedNew, nil)
+
+	cr, err := NewCrawler(cfg, m, uploader)
+	assert.NoError(t, err)
+
+	defer func() {
+		if err := os.RemoveAll(hostname); err != nil {
+			fmt.Println("Error when removing:", err)
+		}
+	}()
+
+	cr.Run(m, reg, cfg)
+
+	callCount := uploader.UploadFileCallCount()
+	assert.Greater(t, callCount, 2)
+
+	t.Run("run info is uploaded after every other file", func(t *testing.T) {
+		_, f := uploader.UploadFileArgsForCall(callCount - 2)
+		assert.Equal(t, upload.File{Path: hostname + "/run-info.json", Key: hostname + "/run-info.json", ContentType: "application/json"}, f)
+
+		content, err := os.ReadFile(f.Path)
+		assert.NoError(t, err)
+
+		runInfo := RunInfo{}
+		assert.NoError(t, json.Unmarshal(content, &runInfo))
+		assert.Equal(t, "20260101T020000Z", runInfo.RunID)
+		assert.Equal(t, cfg.Site, runInfo.Site)
+		assert.NotEmpty(t, runInfo.Version)
+		assert.False(t, runInfo.EndTime.Before(runInfo.StartTime))
+		assert.Equal(t, int64(testutil.ToFloat64(m.CrawledPagesCounter())), runInfo.PagesCrawled)
+		assert.Equal(t, int64(3), runInfo.HTTPErrors)
+		assert.Equal(t, int64(callCount-2), runInfo.FilesUploaded)
+		assert.Equal(t, int64(0), runInfo.UploadFailures)
+	})
+
+	t.Run("freshness marker is uploaded last", func(t *testing.T) {
+		_, f := uploader.UploadFileArgsForCall(callCount - 1)
+		assert.Equal(t, upload.File{Path: hostname + "/last-updated.txt", Key: hostname + "/last-updated.txt", ContentType: "text/plain; charset=utf-8"}, f)
+
+		content, err := os.ReadFile(f.Path)
+		assert.NoError(t, err)
+
+		lastUpdated, err := time.Parse(time.RFC3339, strings.TrimSpace(string(content)))
+		assert.NoError(t, err)
+		assert.WithinDuration(t, time.Now(), lastUpdated, time.Minute)
+	})
+
+	t.Run("every file is recorded in the manifest", func(t *testing.T) {
+		assert.Len(t, cr.Manifest().Uploaded(), callCount)
+		assert.Empty(t, cr.Manifest().Failed())
+	})
+
+	t.Run("the manifest is saved", func(t *testing.T) {
+		manifestFile, err := upload.ReadManifestFile(cfg.ManifestFile)
+		assert.NoError(t, err)
+		assert.Equal(t, "20260101T020000Z", manifestFile.RunID)
+		assert.Len(t, manifestFile.Files, callCount)
+
+		content, err := os.ReadFile(hostname + "/index.html")
+		assert.NoError(t, err)
+		assert.Contains(t, manifestFile.Files, upload.ManifestEntry{
+			Key:         hostname + "/index.html",
+			Size:        int64(len(content)),
+			ContentType: routes["/"].contentType,
+			SHA256:      fmt.Sprintf("%x", sha256.Sum256(content)),
+		})
+	})
+}
+
+func TestRegisterPath(t *testing.T) {
+	m := metrics.NewMetrics(prometheus.NewRegistry())
+	paths := file.NewPathRegistry()
+
+	for _, rawURL := range []string{"https://example.com/foo", "https://example.com/foo.html", "https://example.com/foo?page=2"} {
+		u, _ := url.Parse(rawURL)
+		registerPath(m, paths, u, "text/html")
+	}
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.PathCollisionCounter().WithLabelValues("same_key")))
+}
+
+func TestResponseHandlerContentType(t *testing.T) {
+	err := mime.LoadAdditionalMimeTypes("")
+	if err != nil {
+		t.Fatalf("could not load mimetypes: %v", err)
+	}
+
+	pdfBody := []byte("%PDF-1.7\n%some content")
+
+	tests := []struct {
+		name                string
+		url                 string
+		headers             http.Header
+		expectedFile        upload.File
+		expectedFallback    string
+		expectedMismatch    string
+		expectedContentType string
+	}{
+		{
+			name:                "uses the Content-Type header",
+			url:                 "https://example.com/guidance",
+			headers:             http.Header{"Content-Type": {"application/pdf"}},
+			expectedFile:        upload.File{Path: "example.com/guidance.pdf", Key: "example.com/guidance.pdf", ContentType: "application/pdf", SourceURL: "https://example.com/guidance"},
+			expectedContentType: "application/pdf",
+		},
+		{
+			name:                "sniffs the content when there is no Content-Type header",
+			url:                 "https://example.com/guidance",
+			headers:             http.Header{},
+			expectedFile:        upload.File{Path: "example.com/guidance.pdf", Key: "example.com/guidance.pdf", ContentType: "application/pdf", SourceURL: "https://example.com/guidance"},
+			expectedFallback:    "sniffed",
+			expectedContentType: "application/pdf",
+		},
+		{
+			name:                "uses the Content-Disposition filename when the Content-Type header is invalid",
+			url:                 "https://example.com/download",
+			headers:             http.Header{"Content-Type": {"pdf"}, "Content-Disposition": {`attachment; filename="guidance.csv"`}},
+			expectedFile:        upload.File{Path: "example.com/download.csv", Key: "example.com/download.csv", ContentType: "text/csv; charset=utf-8", SourceURL: "https://example.com/download"},
+			expectedFallback:    "content_disposition",
+			expectedContentType: "text/csv; charset=utf-8",
+		},
+		{
+			name:                "reports a Content-Type header that doesn't match the content",
+			url:                 "https://example.com/guidance",
+			headers:             http.Header{"Content-Type": {"text/html"}},
+			expectedFile:        upload.File{Path: "example.com/guidance.html", Key: "example.com/guidance.html", ContentType: "text/html", SourceURL: "https://example.com/guidance"},
+			expectedMismatch:    "application/pdf",
+			expectedContentType: "text/html",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if err := os.RemoveAll("example.com"); err != nil {
+					fmt.Println("Error when removing:", err)
+				}
+			}()
+
+			m := metrics.NewMetrics(prometheus.NewRegistry())
+			uploader := &uploadfakes.FakeUploader{}
+			uploadQueue := upload.NewQueue(uploader, m, upload.QueueOptions{})
+			uploadQueue.Start(t.Context())
+
+			u, _ := url.Parse(tt.url)
+			response := &colly.Response{
+				StatusCode: http.StatusOK,
+				Body:       pdfBody,
+				Headers:    &tt.headers,
+				Request:    &colly.Request{URL: u},
+			}
+
+			responseHandler(m, uploadQueue, file.NewPathRegistry(), mime.NewUnknownTypes(maxUnknownTypes), false)(response)
+			uploadQueue.Close()
+
+			assert.Equal(t, 1, uploader.UploadFileCallCount())
+			_, f := uploader.UploadFileArgsForCall(0)
+			assert.Equal(t, tt.expectedFile, f)
+			assert.Equal(t, tt.expectedContentType, response.Headers.Get("Content-Type"))
+
+			if tt.expectedFallback == "" {
+				assert.Equal(t, 0, testutil.CollectAndCount(m.ContentTypeFallbacks()))
+			} else {
+				assert.Equal(t, float64(1), testutil.ToFloat64(m.ContentTypeFallbacks().WithLabelValues(tt.expectedFallback)))
+			}
+
+			if tt.expectedMismatch == "" {
+				assert.Equal(t, 0, testutil.CollectAndCount(m.ContentTypeMismatches()))
+			} else {
+				assert.Equal(t, float64(1), testutil.ToFloat64(m.ContentTypeMismatches().WithLabelValues(tt.expectedMismatch)))
+			}
+		})
+	}
+}
+
+func TestResponseHandlerUnknownContentType(t *testing.T) {
+	err := mime.LoadAdditionalMimeTypes("")
+	if err != nil {
+		t.Fatalf("could not load mimetypes: %v", err)
+	}
+	defer func() {
+		if err := os.RemoveAll("example.com"); err != nil {
+			fmt.Println("Error when removing:", err)
+		}
+	}()
+
+	m := metrics.NewMetrics(prometheus.NewRegistry())
+	uploader := &uploadfakes.FakeUploader{}
+	uploadQueue := upload.NewQueue(uploader, m, upload.QueueOptions{})
+	uploadQueue.Start(t.Context())
+	unknownTypes := mime.NewUnknownTypes(maxUnknownTypes)
+
+	u, _ := url.Parse("https://example.com/data.geo")
+	response := &colly.Response{
+		StatusCode: http.StatusOK,
+		Body:       []byte("geo"),
+		Headers:    &http.Header{"Content-Type": {"application/x-mirror-unknown"}},
+		Request:    &colly.Request{URL: u},
+	}
+
+	responseHandler(m, uploadQueue, file.NewPathRegistry(), unknownTypes, false)(response)
+	uploadQueue.Close()
+
+	assert.Equal(t, map[string]int{"application/x-mirror-unknown": 1}, unknownTypes.Counts())
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.UnknownContentTypes().WithLabelValues("application/x-mirror-unknown")))
+	assert.Equal(t, 1, uploader.UploadFileCallCount())
+}
+
+func TestResponseHandlerIgnoredCookies(t *testing.T) {
+	defer func() {
+		if err := os.RemoveAll("example.com"); err != nil {
+			fmt.Println("Error when removing:", err)
+		}
+	}()
+
+	tests := []struct {
+		name           string
+		ignoresCookies bool
+		expected       float64
+	}{
+		{name: "pages are flagged when their cookies are ignored", ignoresCookies: true, expected: 1},
+		{name: "pages aren't flagged when their cookies are kept", ignoresCookies: false, expected: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := metrics.NewMetrics(prometheus.NewRegistry())
+			uploadQueue := upload.NewQueue(&uploadfakes.FakeUploader{}, m, upload.QueueOptions{})
+			uploadQueue.Start(t.Context())
+
+			u, _ := url.Parse("https://example.com/cookies")
+			response := &colly.Response{
+				StatusCode: http.StatusOK,
+				Body:       []byte("<html></html>"),
+				Headers: &http.Header{
+					"Content-Type": {"text/html"},
+					"Set-Cookie":   {"ab_test_bucket=B; Path=/"},
+				},
+				Request: &colly.Request{URL: u},
+			}
+
+			responseHandler(m, uploadQueue, file.NewPathRegistry(), mime.NewUnknownTypes(maxUnknownTypes), test.ignoresCookies)(response)
+			uploadQueue.Close()
+
+			assert.Equal(t, test.expected, testutil.ToFloat64(m.IgnoredCookiesCounter()))
+		})
+	}
+}
+
+func TestErrorHandlerKinds(t *testing.T) {
+	u, _ := url.Parse("https://www.gov.uk/page")
+
+	tests := []struct {
+		name       string
+		statusCode int
+		err        error
+		expected   string
+	}{
+		{name: "not found", statusCode: http.StatusNotFound, err: errors.New("Not Found"), expected: "client_error"},
+		{name: "service unavailable", statusCode: http.StatusServiceUnavailable, err: errors.New("Service Unavailable"), expected: "server_error"},
+		{name: "timeout", err: &url.Error{Op: "Get", URL: u.String(), Err: fmt.Errorf("request timed out after 1s: %w", transport.ErrTimeout)}, expected: "timeout"},
+		{name: "deadline exceeded", err: &url.Error{Op: "Get", URL: u.String(), Err: context.DeadlineExceeded}, expected: "timeout"},
+		{name: "untrusted certificate", err: &url.Error{Op: "Get", URL: u.String(), Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, expected: "tls"},
+		{name: "connection refused", err: &url.Error{Op: "Get", URL: u.String(), Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, expected: "connection"},
+		{name: "invalid sitemap", statusCode: http.StatusOK, err: &xml.SyntaxError{Msg: "unexpected EOF", Line: 1}, expected: "parse"},
+		{name: "anything else", statusCode: http.StatusOK, err: errors.New("unexpected"), expected: "other"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := metrics.NewMetrics(prometheus.NewRegistry())
+			response := &colly.Response{StatusCode: test.statusCode, Request: &colly.Request{URL: u}}
+
+			errorHandler(m)(response, test.err)
+
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.CrawlErrorCounter().WithLabelValues(test.expected, "www.gov.uk")))
+			assert.Equal(t, 1, testutil.CollectAndCount(m.CrawlErrorCounter()))
+		})
+	}
 }
@@ -0,0 +1,196 @@
+package crawler
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// rateWindow is the number of seconds over which the current crawl rate is measured
+const rateWindow = 60
+
+// sitemapEntryKey is the context key of a sitemap entry's request, which is
+// sitemapEntryPending until the request is sent, then the request's ID until it completes
+const sitemapEntryKey = "sitemap_entry"
+
+const sitemapEntryPending = "pending"
+
+const sitemapEntryDone = "done"
+
+// Progress follows the crawl through the entries of the site's sitemaps
+type Progress struct {
+	mu         sync.Mutex
+	startTime  time.Time
+	discovered int
+	visited    int
+	failed     int
+	skipped    int
+	// completions counts the requested entries completed in each second of the rate window, indexed by
+	// the second modulo rateWindow, and seconds the second each count is for
+	completions [rateWindow]int
+	seconds     [rateWindow]int64
+}
+
+// ProgressReport is a snapshot of the crawl's progress
+type ProgressReport struct {
+	StartTime time.Time `json:"start_time"`
+	// Discovered is the number of entries found in the sitemaps so far
+	Discovered int `json:"discovered"`
+	Visited    int `json:"visited"`
+	// Queued is the number of entries discovered but not yet visited, failed or skipped
+	Queued int `json:"queued"`
+	Failed int `json:"failed"`
+	// Skipped is the number of entries not crawled, as they had already been visited from a
+	// link or are excluded by the URL rules
+	Skipped int `json:"skipped"`
+	// Rate is the number of entries requested per second over the last minute
+	Rate float64 `json:"rate"`
+	// ETA is when the queued entries are expected to have been crawled at the current rate, and
+	// is null when nothing is queued or the rate is zero
+	ETA *time.Time `json:"eta"`
+}
+
+func NewProgress() *Progress {
+	return &Progress{startTime: time.Now()}
+}
+
+// Report returns a snapshot of the progress
+func (p *Progress) Report() ProgressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	report := ProgressReport{
+		StartTime:  p.startTime.UTC(),
+		Discovered: p.discovered,
+		Visited:    p.visited,
+		Queued:     p.discovered - p.visited - p.failed - p.skipped,
+		Failed:     p.failed,
+		Skipped:    p.skipped,
+		Rate:       p.rate(now),
+	}
+
+	if report.Queued > 0 && report.Rate > 0 {
+		eta := now.Add(time.Duration(float64(report.Queued) / report.Rate * float64(time.Second))).UTC()
+		report.ETA = &eta
+	}
+
+	return report
+}
+
+// rate returns the number of requested entries completed per second over the rate window, or since the
+// crawl started if that is shorter
+func (p *Progress) rate(now time.Time) float64 {
+	second := now.Unix()
+
+	completed := 0
+	for i, count := range p.completions {
+		if second-p.seconds[i] < rateWindow {
+			completed += count
+		}
+	}
+
+	window := min(now.Sub(p.startTime), rateWindow*time.Second)
+	return float64(completed) / max(window.Seconds(), 1)
+}
+
+func (p *Progress) discover(entries int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.discovered += entries
+}
+
+// entryOutcome is the result of crawling a sitemap entry
+type entryOutcome int
+
+const (
+	entryVisited entryOutcome = iota
+	entryFailed
+	entrySkipped
+)
+
+// complete records the outcome of an entry. Only the entries that were requested count towards
+// the rate.
+func (p *Progress) complete(outcome entryOutcome, requested bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch outcome {
+	case entryVisited:
+		p.visited++
+	case entryFailed:
+		p.failed++
+	case entrySkipped:
+		p.skipped++
+	}
+
+	if !requested {
+		return
+	}
+
+	second := time.Now().Unix()
+	i := second % rateWindow
+	if p.seconds[i] != second {
+		p.seconds[i] = second
+		p.completions[i] = 0
+	}
+	p.completions[i]++
+}
+
+// visitSitemapEntry requests a sitemap entry found while scraping the response, in a context of
+// its own so that its completion can be followed. The pages linked from the entry share its
+// context, but only the entry's request is sent while the context is pending.
+func (p *Progress) visitSitemapEntry(r *colly.Request, entryURL string) {
+	req, err := r.New("GET", r.AbsoluteURL(entryURL), nil)
+	if err != nil {
+		p.complete(entrySkipped, false)
+		return
+	}
+
+	req.Ctx = colly.NewContext()
+	req.Ctx.Put(sitemapEntryKey, sitemapEntryPending)
+	req.Depth = r.Depth + 1
+
+	// without ASYNC the request is sent before Do returns, which returns its error too, so the
+	// entry is only skipped if it wasn't sent
+	if err := req.Do(); err != nil && req.Ctx.Get(sitemapEntryKey) == sitemapEntryPending {
+		p.complete(entrySkipped, false)
+	}
+}
+
+func (p *Progress) requestHandler() func(*colly.Request) {
+	return func(r *colly.Request) {
+		if r.Ctx.Get(sitemapEntryKey) == sitemapEntryPending {
+			r.Ctx.Put(sitemapEntryKey, strconv.FormatUint(uint64(r.ID), 10))
+		}
+	}
+}
+
+func (p *Progress) responseHandler() func(*colly.Response) {
+	return func(r *colly.Response) {
+		p.completeSitemapEntry(r, entryVisited)
+	}
+}
+
+func (p *Progress) errorHandler() func(*colly.Response, error) {
+	return func(r *colly.Response, err error) {
+		if isIgnoredError(err) {
+			p.completeSitemapEntry(r, entrySkipped)
+			return
+		}
+		p.completeSitemapEntry(r, entryFailed)
+	}
+}
+
+// completeSitemapEntry records the outcome of the response if it is for a sitemap entry, once
+// only, as an error parsing the response can follow its success
+func (p *Progress) completeSitemapEntry(r *colly.Response, outcome entryOutcome) {
+	if r.Ctx.Get(sitemapEntryKey) != strconv.FormatUint(uint64(r.Request.ID), 10) {
+		return
+	}
+	r.Ctx.Put(sitemapEntryKey, sitemapEntryDone)
+	p.complete(outcome, true)
+}
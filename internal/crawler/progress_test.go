@@ -0,0 +1,51 @@
+package crawler
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressReport(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		progress := NewProgress()
+		progress.discover(100)
+
+		report := progress.Report()
+		assert.Equal(t, 100, report.Queued)
+		assert.Zero(t, report.Rate)
+		assert.Nil(t, report.ETA, "there is no estimate before anything is crawled")
+
+		// 2 entries are crawled each second for 10 seconds
+		for range 10 {
+			time.Sleep(time.Second)
+			progress.complete(entryVisited, true)
+			progress.complete(entryFailed, true)
+		}
+		// skipped entries that weren't requested don't count towards the rate
+		progress.complete(entrySkipped, false)
+
+		report = progress.Report()
+		assert.Equal(t, 100, report.Discovered)
+		assert.Equal(t, 10, report.Visited)
+		assert.Equal(t, 10, report.Failed)
+		assert.Equal(t, 1, report.Skipped)
+		assert.Equal(t, 79, report.Queued)
+		assert.Equal(t, 2.0, report.Rate)
+		if assert.NotNil(t, report.ETA) {
+			assert.Equal(t, time.Now().Add(39500*time.Millisecond).UTC(), *report.ETA)
+		}
+
+		// the rate only counts the entries crawled in the last minute, which are the last 5
+		// seconds' 10 entries
+		time.Sleep(55 * time.Second)
+		assert.InDelta(t, 10.0/60, progress.Report().Rate, 0.001)
+
+		time.Sleep(10 * time.Second)
+		report = progress.Report()
+		assert.Zero(t, report.Rate)
+		assert.Nil(t, report.ETA)
+	})
+}
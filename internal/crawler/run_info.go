@@ -0,0 +1,93 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"mirrorer/internal/file"
+	"mirrorer/internal/metrics"
+	"mirrorer/internal/upload"
+	"mirrorer/internal/version"
+	"net/url"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	lastUpdatedFileName = "last-updated.txt"
+	runInfoFileName     = "run-info.json"
+)
+
+// RunInfo describes a crawl run. It is published alongside the mirror as run-info.json.
+type RunInfo struct {
+	RunID     string    `json:"run_id"`
+	Version   string    `json:"version"`
+	Site      string    `json:"site"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+	metrics.RunTotals
+	UnknownContentTypes map[string]int `json:"unknown_content_types,omitempty"`
+}
+
+// publishRunInfo uploads the run info and the last-updated.txt freshness marker to the
+// root of the mirrored site, but only if every file of the crawl was uploaded. The marker
+// is uploaded last, so that it is only updated once everything else is in place.
+func (cr *Crawler) publishRunInfo(m *metrics.Metrics, startTime time.Time) {
+	if failed := cr.manifest.Failed(); len(failed) > 0 {
+		log.Warn().Int("failed_uploads", len(failed)).Msg("Not publishing the freshness marker as some files failed to upload")
+		return
+	}
+
+	siteURL, err := url.Parse(cr.cfg.Site)
+	if err != nil || siteURL.Hostname() == "" {
+		log.Error().Err(err).Str("site", cr.cfg.Site).Msg("Error determining the host to publish the freshness marker to")
+		return
+	}
+
+	endTime := time.Now().UTC()
+	runInfo, err := json.MarshalIndent(RunInfo{
+		RunID:     cr.cfg.RunID,
+		Version:   version.Get(),
+		Site:      cr.cfg.Site,
+		StartTime: startTime.UTC(),
+		EndTime:   endTime,
+		RunTotals: metrics.Totals(m),
+		// so that the types to add to MIME_TYPES_FILE can be found from the published run info
+		UnknownContentTypes: cr.unknownTypes.Counts(),
+	}, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding the run info")
+		return
+	}
+
+	err = cr.uploadRootFile(siteURL.Host, runInfoFileName, "application/json", runInfo)
+	if err != nil {
+		log.Error().Err(err).Msg("Error publishing the run info")
+		return
+	}
+
+	err = cr.uploadRootFile(siteURL.Host, lastUpdatedFileName, "text/plain; charset=utf-8", []byte(endTime.Format(time.RFC3339)+"\n"))
+	if err != nil {
+		log.Error().Err(err).Msg("Error publishing the freshness marker")
+		return
+	}
+
+	log.Info().Str("run_id", cr.cfg.RunID).Msg("Published the freshness marker and run info")
+}
+
+// uploadRootFile saves a file at the root of the host's directory and uploads it straight away
+func (cr *Crawler) uploadRootFile(host string, name string, contentType string, body []byte) error {
+	u := &url.URL{Scheme: "https", Host: host, Path: "/" + name}
+
+	err := file.Save(u, contentType, body)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %w", name, err)
+	}
+
+	path, err := file.GenerateFilePath(u, contentType)
+	if err != nil {
+		return fmt.Errorf("failed to generate file path for %s: %w", name, err)
+	}
+
+	return cr.uploadQueue.UploadNow(cr.collector.Context, upload.File{Path: path, Key: path, ContentType: contentType})
+}
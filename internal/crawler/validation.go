@@ -4,23 +4,36 @@ import (
 	"context"
 	"fmt"
 	"mirrorer/internal/config"
+	"mirrorer/internal/credentials"
+	"mirrorer/internal/transport"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 )
 
-// ValidateCrawlerConfig checks if the configured domains are accessible
-// Call this before starting a crawl to catch configuration issues early
-func ValidateCrawlerConfig(cfg *config.Config, timeout time.Duration) error {
+// ValidateCrawlerConfig checks if the configured domains are accessible, each within the timeout
+// and giving up when ctx is done. Call this before starting a crawl to catch configuration issues early
+func ValidateCrawlerConfig(ctx context.Context, cfg *config.Config, timeout time.Duration) error {
+	requestCredentials, err := credentials.Load(cfg.RequestCredentialsFile)
+	if err != nil {
+		return err
+	}
+
+	// the same transport as the crawler, so that the domains are reached the same way
+	crawlTransport, err := transport.New(cfg.HTTPConfig)
+	if err != nil {
+		return err
+	}
+
 	// Check main site URL
 	if cfg.Site != "" {
-		if !isDomainAccessibleWithConfig(cfg.Site, cfg, timeout) {
+		if !isDomainAccessibleWithConfig(ctx, cfg.Site, cfg, requestCredentials, crawlTransport, timeout) {
 			return &DomainNotAccessibleError{Domain: cfg.Site}
 		}
 	}
 
-	if strings.TrimSpace(cfg.MirrorS3BucketName) == "" {
+	if strings.TrimSpace(cfg.MirrorS3BucketName) == "" && strings.TrimSpace(cfg.MirrorS3ReplicaBucketName) == "" && strings.TrimSpace(cfg.MirrorGCSBucketName) == "" {
 		return &S3BucketNameMissingError{}
 	}
 
@@ -32,7 +45,7 @@ func ValidateCrawlerConfig(cfg *config.Config, timeout time.Duration) error {
 		}
 
 		testURL := "https://" + domain
-		if !isDomainAccessibleWithConfig(testURL, cfg, timeout) {
+		if !isDomainAccessibleWithConfig(ctx, testURL, cfg, requestCredentials, crawlTransport, timeout) {
 			return &DomainNotAccessibleError{Domain: domain}
 		}
 	}
@@ -51,27 +64,29 @@ func (e *DomainNotAccessibleError) Error() string {
 
 type S3BucketNameMissingError struct{}
 
-func (e *S3BucketNameMissingError) Error() string { return "S3 bucket name is missing" }
+func (e *S3BucketNameMissingError) Error() string { return "no S3 or GCS bucket name is configured" }
 
 // isDomainAccessibleWithConfig checks if a domain responds using the same config as Colly
-func isDomainAccessibleWithConfig(testURL string, cfg *config.Config, timeout time.Duration) bool {
+func isDomainAccessibleWithConfig(ctx context.Context, testURL string, cfg *config.Config, requestCredentials *credentials.Rules, rt http.RoundTripper, timeout time.Duration) bool {
 	parsedURL, err := url.Parse(testURL)
 	if err != nil {
 		return false
 	}
 
 	client := &http.Client{
-		Timeout: timeout,
+		Transport: rt,
+		Timeout:   timeout,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// Allow redirects but limit to 5
 			if len(via) >= 5 {
 				return http.ErrUseLastResponse
 			}
+			requestCredentials.Apply(req.URL, req.Header)
 			return nil
 		},
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	// Use GET instead of HEAD to match Colly behavior
@@ -87,6 +102,7 @@ func isDomainAccessibleWithConfig(testURL string, cfg *config.Config, timeout ti
 	for key, value := range cfg.Headers {
 		req.Header.Set(key, value)
 	}
+	requestCredentials.Apply(req.URL, req.Header)
 
 	resp, err := client.Do(req)
 	if err != nil {
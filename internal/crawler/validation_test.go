@@ -1,7 +1,14 @@
 package crawler
 
 import (
+	"context"
 	"mirrorer/internal/config"
+	"mirrorer/internal/credentials"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -18,6 +25,7 @@ func TestValidateCrawlerConfig(t *testing.T) {
 		expectError    bool
 		description    string
 		s3BucketName   string
+		gcsBucketName  string
 	}{
 		{
 			name:           "accessible domain",
@@ -59,19 +67,29 @@ func TestValidateCrawlerConfig(t *testing.T) {
 			description:    "Should fail because the S3 bucket name is empty",
 			s3BucketName:   "",
 		},
+		{
+			name:           "gcs bucket name only",
+			site:           "",
+			allowedDomains: []string{},
+			expectError:    false,
+			description:    "Should pass when only a GCS bucket name is configured",
+			s3BucketName:   "",
+			gcsBucketName:  "gcs-bucket-name",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			cfg := &config.Config{
-				Site:               tt.site,
-				AllowedDomains:     tt.allowedDomains,
-				UserAgent:          "test-agent",
-				Concurrency:        1,
-				MirrorS3BucketName: tt.s3BucketName,
+				Site:                tt.site,
+				AllowedDomains:      tt.allowedDomains,
+				UserAgent:           "test-agent",
+				Concurrency:         1,
+				MirrorS3BucketName:  tt.s3BucketName,
+				MirrorGCSBucketName: tt.gcsBucketName,
 			}
 
-			err := ValidateCrawlerConfig(cfg, 5*time.Second)
+			err := ValidateCrawlerConfig(t.Context(), cfg, 5*time.Second)
 
 			if tt.expectError {
 				assert.Error(t, err, tt.description)
@@ -87,3 +105,35 @@ func TestDomainNotAccessibleError(t *testing.T) {
 	expectedMsg := "domain not accessible: definitely-does-not-exist.example.com"
 	assert.Equal(t, expectedMsg, err.Error())
 }
+
+func TestIsDomainAccessibleWithCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Rate-Limit-Token") != "token" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.yaml")
+	err := os.WriteFile(credentialsFile, []byte("rules:\n  - domain: "+serverURL.Hostname()+"\n    headers: {Rate-Limit-Token: token}\n"), 0600)
+	assert.NoError(t, err)
+
+	cfg := &config.Config{UserAgent: "test-agent"}
+
+	rules, err := credentials.Load(credentialsFile)
+	assert.NoError(t, err)
+	assert.True(t, isDomainAccessibleWithConfig(t.Context(), server.URL, cfg, rules, http.DefaultTransport, 5*time.Second))
+	assert.False(t, isDomainAccessibleWithConfig(t.Context(), server.URL, cfg, &credentials.Rules{}, http.DefaultTransport, 5*time.Second))
+}
+
+func TestIsDomainAccessibleGivesUpWhenTheContextIsDone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	cfg := &config.Config{UserAgent: "test-agent"}
+	assert.False(t, isDomainAccessibleWithConfig(ctx, server.URL, cfg, &credentials.Rules{}, http.DefaultTransport, 5*time.Second))
+}
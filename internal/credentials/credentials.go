@@ -0,0 +1,194 @@
+package credentials
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Secret is a value given in the credentials file, either inline or as the name of an
+// environment variable or file holding it, so that secrets need not be written in the file
+type Secret struct {
+	Value string `yaml:"-"`
+	Env   string `yaml:"env"`
+	File  string `yaml:"file"`
+}
+
+// UnmarshalYAML reads a secret given as a string, or as a mapping with an env or file key
+func (s *Secret) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		s.Value = value.Value
+		return nil
+	}
+
+	type secretSource Secret
+	return value.Decode((*secretSource)(s))
+}
+
+// resolve reads the secret from its environment variable or file, if it has one
+func (s *Secret) resolve() error {
+	switch {
+	case s.Env != "" && s.File != "":
+		return errors.New("a secret can't be read from both an environment variable and a file")
+	case s.Env != "":
+		value, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		s.Value = value
+	case s.File != "":
+		value, err := os.ReadFile(s.File)
+		if err != nil {
+			return fmt.Errorf("failed to read secret: %w", err)
+		}
+		s.Value = strings.TrimRight(string(value), "\r\n")
+	}
+	return nil
+}
+
+// BasicAuth is a username and password sent with HTTP basic authentication
+type BasicAuth struct {
+	Username Secret `yaml:"username"`
+	Password Secret `yaml:"password"`
+}
+
+// Rule is the headers and credentials sent with requests to a domain, or to URLs matching a pattern
+type Rule struct {
+	// Domain is a host such as www.gov.uk, or *.gov.uk for any subdomain of gov.uk
+	Domain string `yaml:"domain"`
+	// URLPattern is a regular expression matched against the whole URL, instead of Domain
+	URLPattern  string            `yaml:"url_pattern"`
+	Headers     map[string]Secret `yaml:"headers"`
+	BasicAuth   *BasicAuth        `yaml:"basic_auth"`
+	BearerToken *Secret           `yaml:"bearer_token"`
+
+	urlPattern *regexp.Regexp
+}
+
+// Rules are the headers and credentials scoped to each domain. The zero value has no rules.
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Load reads the rules from a YAML or JSON file, returning every problem with them. An empty
+// path loads no rules.
+func Load(path string) (*Rules, error) {
+	rules := &Rules{}
+	if path == "" {
+		return rules, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request credentials %s: %w", path, err)
+	}
+
+	if err := yaml.Unmarshal(data, rules); err != nil {
+		return nil, fmt.Errorf("failed to parse request credentials %s: %w", path, err)
+	}
+
+	var errs []error
+	for i := range rules.Rules {
+		if err := rules.Rules[i].prepare(); err != nil {
+			errs = append(errs, fmt.Errorf("rule %d of request credentials %s: %w", i+1, path, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return rules, nil
+}
+
+// prepare checks the rule, compiles its pattern and resolves its secrets
+func (r *Rule) prepare() error {
+	var errs []error
+
+	switch {
+	case (r.Domain == "") == (r.URLPattern == ""):
+		errs = append(errs, errors.New("exactly one of domain and url_pattern must be set"))
+	case r.URLPattern != "":
+		urlPattern, err := regexp.Compile(r.URLPattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid url_pattern: %w", err))
+		}
+		r.urlPattern = urlPattern
+	}
+
+	if r.BasicAuth != nil && r.BearerToken != nil {
+		errs = append(errs, errors.New("only one of basic_auth and bearer_token can be set"))
+	}
+
+	for name, value := range r.Headers {
+		if err := value.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("header %s: %w", name, err))
+		}
+		r.Headers[name] = value
+	}
+	if r.BasicAuth != nil {
+		if err := r.BasicAuth.Username.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("basic_auth username: %w", err))
+		}
+		if err := r.BasicAuth.Password.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("basic_auth password: %w", err))
+		}
+	}
+	if r.BearerToken != nil {
+		if err := r.BearerToken.resolve(); err != nil {
+			errs = append(errs, fmt.Errorf("bearer_token: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// matches reports whether the rule applies to requests for the URL
+func (r *Rule) matches(u *url.URL) bool {
+	if r.urlPattern != nil {
+		return r.urlPattern.MatchString(u.String())
+	}
+
+	host := strings.ToLower(u.Hostname())
+	domain := strings.ToLower(r.Domain)
+	if parent, ok := strings.CutPrefix(domain, "*."); ok {
+		return strings.HasSuffix(host, "."+parent)
+	}
+	return host == domain
+}
+
+// Apply sets the headers and credentials of every rule matching the URL, in order, and removes
+// those of the other rules, such as when a request is redirected to another domain
+func (rs *Rules) Apply(u *url.URL, header http.Header) {
+	for _, r := range rs.Rules {
+		for name := range r.Headers {
+			header.Del(name)
+		}
+		if r.BasicAuth != nil || r.BearerToken != nil {
+			header.Del("Authorization")
+		}
+	}
+
+	for _, r := range rs.Rules {
+		if !r.matches(u) {
+			continue
+		}
+
+		for name, value := range r.Headers {
+			header.Set(name, value.Value)
+		}
+		if r.BasicAuth != nil {
+			credentials := r.BasicAuth.Username.Value + ":" + r.BasicAuth.Password.Value
+			header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		if r.BearerToken != nil {
+			header.Set("Authorization", "Bearer "+r.BearerToken.Value)
+		}
+	}
+}
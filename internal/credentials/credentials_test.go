@@ -0,0 +1,103 @@
+package credentials
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeRules writes a credentials file, returning its path
+func writeRules(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "credentials.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func apply(rules *Rules, rawURL string, header http.Header) http.Header {
+	u, _ := url.Parse(rawURL)
+	rules.Apply(u, header)
+	return header
+}
+
+func TestLoad(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0600))
+	t.Setenv("TEST_RATE_LIMIT_TOKEN", "env-token")
+
+	rules, err := Load(writeRules(t, `
+rules:
+  - domain: www.gov.uk
+    headers:
+      Rate-Limit-Token: {env: TEST_RATE_LIMIT_TOKEN}
+      X-Inline: inline
+  - domain: "*.integration.publishing.service.gov.uk"
+    basic_auth:
+      username: betademo
+      password: {file: `+tokenFile+`}
+  - url_pattern: ^https://www\.gov\.uk/api/
+    bearer_token: {file: `+tokenFile+`}
+`))
+	assert.NoError(t, err)
+
+	t.Run("headers are only sent to their domain", func(t *testing.T) {
+		header := apply(rules, "https://www.gov.uk/browse", http.Header{})
+		assert.Equal(t, "env-token", header.Get("Rate-Limit-Token"))
+		assert.Equal(t, "inline", header.Get("X-Inline"))
+		assert.Empty(t, header.Get("Authorization"))
+
+		header = apply(rules, "https://assets.publishing.service.gov.uk/media/file.pdf", http.Header{})
+		assert.Empty(t, header)
+	})
+
+	t.Run("basic auth is sent to subdomains", func(t *testing.T) {
+		header := apply(rules, "https://www.integration.publishing.service.gov.uk/", http.Header{})
+		assert.Equal(t, "Basic YmV0YWRlbW86ZmlsZS10b2tlbg==", header.Get("Authorization"))
+
+		header = apply(rules, "https://integration.publishing.service.gov.uk/", http.Header{})
+		assert.Empty(t, header.Get("Authorization"))
+	})
+
+	t.Run("later rules override earlier ones", func(t *testing.T) {
+		header := apply(rules, "https://www.gov.uk/api/content", http.Header{})
+		assert.Equal(t, "env-token", header.Get("Rate-Limit-Token"))
+		assert.Equal(t, "Bearer file-token", header.Get("Authorization"))
+	})
+
+	t.Run("scoped headers are removed from requests to other domains", func(t *testing.T) {
+		header := apply(rules, "https://assets.publishing.service.gov.uk/", http.Header{
+			"Rate-Limit-Token": {"env-token"},
+			"Authorization":    {"Bearer file-token"},
+			"User-Agent":       {"govuk-mirror-bot"},
+		})
+		assert.Equal(t, http.Header{"User-Agent": {"govuk-mirror-bot"}}, header)
+	})
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	_, err := Load(writeRules(t, `
+rules:
+  - headers: {X-Test: value}
+  - domain: www.gov.uk
+    url_pattern: gov
+  - url_pattern: "(unclosed"
+  - domain: www.gov.uk
+    basic_auth: {username: user, password: {env: TEST_UNSET_PASSWORD}}
+    bearer_token: token
+`))
+
+	assert.ErrorContains(t, err, "rule 1 of request credentials")
+	assert.ErrorContains(t, err, "exactly one of domain and url_pattern must be set")
+	assert.ErrorContains(t, err, "invalid url_pattern")
+	assert.ErrorContains(t, err, "only one of basic_auth and bearer_token can be set")
+	assert.ErrorContains(t, err, "basic_auth password: environment variable TEST_UNSET_PASSWORD is not set")
+}
+
+func TestLoadWithoutAFile(t *testing.T) {
+	rules, err := Load("")
+	assert.NoError(t, err)
+	assert.Equal(t, http.Header{"X-Test": {"value"}}, apply(rules, "https://www.gov.uk/", http.Header{"X-Test": {"value"}}))
+}
@@ -1,18 +1,35 @@
 package file
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"mime"
+	mirrorMime "mirrorer/internal/mime"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 )
 
 var cssUrlRegex = regexp.MustCompile(`url\(["']?(.*?)["']?\)`)
 
+const (
+	// maxNameLength is the longest file name, in bytes, that common filesystems allow
+	maxNameLength = 255
+	// maxPathLength is the longest object key, in bytes, that S3 allows
+	maxPathLength = 1024
+	// maxExtensionLength is the longest extension kept when shortening a name
+	maxExtensionLength = 16
+	// nameHashLength is the number of hex digits of the hash that replaces the end of a long name
+	nameHashLength = 16
+	// longPathDirectory holds the files whose path is too long, named after a hash of the path
+	longPathDirectory = "_long"
+)
+
 func RedirectHTMLBody(redirectURL string) []byte {
 	body := fmt.Sprintf(`<!DOCTYPE html>
 	<html lang="en">
@@ -47,14 +64,15 @@ func Save(u *url.URL, contentType string, body []byte) error {
 	return nil
 }
 
+// GenerateFilePath maps a URL to the path it is saved at, which is also the key it is uploaded to.
+// The host is lowercased, percent-encoding is normalised, dot segments are resolved without
+// escaping the host's directory, and names too long for filesystems or S3 are shortened with a hash.
 func GenerateFilePath(u *url.URL, contentType string) (string, error) {
 	// Extract host and path from URL
-	host := u.Hostname()
-	path := u.EscapedPath()
+	host := strings.ToLower(u.Hostname())
+	path := normalizePercentEncoding(u.EscapedPath())
 
-	// Split the path into segments and remove any query strings
-	segments := strings.Split(path, "?")[0]
-	segmentsSlice := strings.Split(segments, "/")
+	segmentsSlice := resolveDotSegments(strings.Split(path, "/"))
 
 	// If the last segment is empty, assign it to "index"
 	if segmentsSlice[len(segmentsSlice)-1] == "" {
@@ -88,15 +106,102 @@ func GenerateFilePath(u *url.URL, contentType string) (string, error) {
 	}
 
 	if len(extensions) > 0 && !slices.Contains(extensions, existingExtension) {
-		segmentsSlice[len(segmentsSlice)-1] += extensions[len(extensions)-1]
+		extension := extensions[len(extensions)-1]
+		if preferred, ok := mirrorMime.PreferredExtension(contentType); ok {
+			extension = preferred
+		}
+		segmentsSlice[len(segmentsSlice)-1] += extension
+	}
+
+	for i, segment := range segmentsSlice {
+		segmentsSlice[i] = shortenName(segment, maxNameLength)
 	}
 
 	// Construct the final path by joining host and the rest of the segments
 	finalPath := filepath.Join(append([]string{host}, segmentsSlice...)...)
 
+	if len(finalPath) > maxPathLength {
+		digest := sha256.Sum256([]byte(finalPath))
+		finalPath = filepath.Join(host, longPathDirectory, hex.EncodeToString(digest[:])+filepath.Ext(segmentsSlice[len(segmentsSlice)-1]))
+	}
+
 	return finalPath, nil
 }
 
+// normalizePercentEncoding decodes percent-encoded characters that don't need encoding and
+// uppercases the hex digits of the rest, so that equivalent URLs map to the same path
+func normalizePercentEncoding(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+3], 16, 8); err == nil {
+				if isUnreserved(byte(c)) {
+					b.WriteByte(byte(c))
+				} else {
+					b.WriteString("%" + strings.ToUpper(path[i+1:i+3]))
+				}
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// isUnreserved reports whether the character never needs percent-encoding, as defined by RFC 3986
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0
+}
+
+// resolveDotSegments removes "." and ".." segments, never going above the first segment, and
+// empty segments other than the last, which marks a directory
+func resolveDotSegments(segments []string) []string {
+	resolved := []string{}
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		switch segment {
+		case ".", "":
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+		default:
+			resolved = append(resolved, segment)
+			continue
+		}
+
+		if last {
+			resolved = append(resolved, "")
+		}
+	}
+	return resolved
+}
+
+// shortenName replaces the end of a name longer than maxLength bytes with a hash of the whole
+// name, keeping its extension, without splitting a percent-encoded character
+func shortenName(name string, maxLength int) string {
+	if len(name) <= maxLength {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > maxExtensionLength {
+		ext = ""
+	}
+
+	digest := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(digest[:])[:nameHashLength]
+
+	prefix := name[:maxLength-len(ext)-len(hash)-1]
+	if i := strings.LastIndexByte(prefix, '%'); i >= len(prefix)-2 {
+		prefix = prefix[:i]
+	}
+
+	return prefix + "-" + hash + ext
+}
+
 func FindCssUrls(body []byte) []string {
 	urls := cssUrlRegex.FindAllStringSubmatch(string(body), -1)
 	result := []string{}
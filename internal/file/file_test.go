@@ -3,8 +3,11 @@ package file
 import (
 	"errors"
 	"fmt"
+	mirrorMime "mirrorer/internal/mime"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -79,6 +82,17 @@ func TestGenerateFilePathTableDriven(t *testing.T) {
 		{"https://example.com/foo#hello", "text/html", "example.com/foo.html", nil},
 		{"https://example.com/foo%20bar", "text/html", "example.com/foo%20bar.html", nil},
 		{"https://example.com/foo.woff", "", "example.com/foo.woff", nil},
+		{"https://EXAMPLE.com/Foo", "text/html", "example.com/Foo.html", nil},
+		{"https://example.com/%7efoo%2dbar", "text/html", "example.com/~foo-bar.html", nil},
+		{"https://example.com/foo%2fbar%c3%a9", "text/html", "example.com/foo%2Fbar%C3%A9.html", nil},
+		{"https://example.com/foo/./bar/../baz", "text/html", "example.com/foo/baz.html", nil},
+		{"https://example.com/foo/..", "text/html", "example.com/index.html", nil},
+		{"https://example.com/../../etc/passwd", "text/plain", "example.com/etc/passwd.txt", nil},
+		{"https://example.com/%2e%2e/%2E%2E/etc/passwd", "text/plain", "example.com/etc/passwd.txt", nil},
+		{"https://example.com/" + strings.Repeat("a", 300), "text/html", "example.com/" + strings.Repeat("a", 233) + "-ba74bc90cce292f0.html", nil},
+		{"https://example.com/" + strings.Repeat("a", 300) + ".pdf", "", "example.com/" + strings.Repeat("a", 234) + "-eaf1675c31e7128d.pdf", nil},
+		{"https://example.com/" + strings.Repeat("%20", 100), "text/html", "example.com/" + strings.Repeat("%20", 77) + "-04d3859a6299f6f9.html", nil},
+		{"https://example.com/" + strings.Repeat("a/", 600) + "b", "text/html", "example.com/_long/b29118dfe7646ead2bc2516d06f4fec19e7cecb94b33017bb22a67b08e94d77a.html", nil},
 	}
 
 	for _, tt := range tests {
@@ -93,6 +107,21 @@ func TestGenerateFilePathTableDriven(t *testing.T) {
 	}
 }
 
+func TestGenerateFilePathPreferredExtension(t *testing.T) {
+	mappings := filepath.Join(t.TempDir(), "mime-types.json")
+	err := os.WriteFile(mappings, []byte(`{
+		"types": {".gpkg": ["application/geopackage+sqlite3"], ".geopackage": ["application/geopackage+sqlite3"]},
+		"preferred_extensions": {"application/geopackage+sqlite3": ".gpkg"}
+	}`), 0600)
+	assert.NoError(t, err)
+	assert.NoError(t, mirrorMime.LoadAdditionalMimeTypes(mappings))
+
+	u, _ := url.Parse("https://example.com/data/boundaries")
+	path, err := GenerateFilePath(u, "application/geopackage+sqlite3")
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com/data/boundaries.gpkg", path)
+}
+
 func TestFindCssUrls(t *testing.T) {
 	testCases := []struct {
 		name     string
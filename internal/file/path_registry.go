@@ -0,0 +1,95 @@
+package file
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// CollisionKind describes how two URLs collide
+type CollisionKind string
+
+const (
+	// CollisionSameKey means two different URLs map to the same path
+	CollisionSameKey CollisionKind = "same_key"
+	// CollisionFileDirectory means one URL maps to a file at a path that another URL needs as a directory
+	CollisionFileDirectory CollisionKind = "file_directory"
+)
+
+// CollisionError is returned when a URL maps to a path that collides with the path of another URL
+type CollisionError struct {
+	Kind        CollisionKind
+	Path        string
+	URL         string
+	ExistingURL string
+}
+
+func (e *CollisionError) Error() string {
+	switch e.Kind {
+	case CollisionFileDirectory:
+		return fmt.Sprintf("%s is saved at %s, which collides with a file or directory of %s", e.URL, e.Path, e.ExistingURL)
+	default:
+		return fmt.Sprintf("%s and %s are both saved at %s", e.URL, e.ExistingURL, e.Path)
+	}
+}
+
+// PathRegistry remembers which URL each path was generated for, to detect URLs whose
+// paths collide. It is safe for concurrent use.
+type PathRegistry struct {
+	mu          sync.Mutex
+	files       map[string]string
+	directories map[string]string
+}
+
+func NewPathRegistry() *PathRegistry {
+	return &PathRegistry{
+		files:       map[string]string{},
+		directories: map[string]string{},
+	}
+}
+
+// Register records that the URL is saved at the path, returning a *CollisionError if a different
+// URL is saved at the same path, or if the path is a directory of another URL's path or vice versa
+func (r *PathRegistry) Register(u *url.URL, path string) error {
+	key := canonicalURL(u)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.files[path]; ok {
+		if existing == key {
+			return nil
+		}
+		return &CollisionError{Kind: CollisionSameKey, Path: path, URL: key, ExistingURL: existing}
+	}
+	r.files[path] = key
+
+	if existing, ok := r.directories[path]; ok {
+		return &CollisionError{Kind: CollisionFileDirectory, Path: path, URL: key, ExistingURL: existing}
+	}
+
+	var collision error
+	for dir := filepath.Dir(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if _, ok := r.directories[dir]; ok {
+			break
+		}
+		r.directories[dir] = key
+
+		if existing, ok := r.files[dir]; ok && collision == nil {
+			collision = &CollisionError{Kind: CollisionFileDirectory, Path: path, URL: key, ExistingURL: existing}
+		}
+	}
+
+	return collision
+}
+
+// canonicalURL identifies a URL regardless of its fragment, the case of its host and its percent-encoding
+func canonicalURL(u *url.URL) string {
+	canonical := strings.ToLower(u.Host) + normalizePercentEncoding(u.EscapedPath())
+	if u.RawQuery != "" {
+		canonical += "?" + u.RawQuery
+	}
+	return canonical
+}
@@ -0,0 +1,75 @@
+package file
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func register(t *testing.T, registry *PathRegistry, rawURL string, contentType string) error {
+	u, err := url.Parse(rawURL)
+	assert.NoError(t, err)
+
+	path, err := GenerateFilePath(u, contentType)
+	assert.NoError(t, err)
+
+	return registry.Register(u, path)
+}
+
+func TestPathRegistry(t *testing.T) {
+	t.Run("the same URL can be registered more than once", func(t *testing.T) {
+		registry := NewPathRegistry()
+		assert.NoError(t, register(t, registry, "https://example.com/foo", "text/html"))
+		assert.NoError(t, register(t, registry, "https://example.com/foo#section", "text/html"))
+		assert.NoError(t, register(t, registry, "https://EXAMPLE.com/%66oo", "text/html"))
+	})
+
+	t.Run("URLs with different paths don't collide", func(t *testing.T) {
+		registry := NewPathRegistry()
+		assert.NoError(t, register(t, registry, "https://example.com/foo", "text/html"))
+		assert.NoError(t, register(t, registry, "https://example.com/foo/", "text/html"))
+		assert.NoError(t, register(t, registry, "https://example.com/foo/bar", "text/html"))
+	})
+
+	t.Run("different URLs with the same path collide", func(t *testing.T) {
+		registry := NewPathRegistry()
+		assert.NoError(t, register(t, registry, "https://example.com/foo", "text/html"))
+
+		err := register(t, registry, "https://example.com/foo.html", "text/html")
+		assert.Equal(t, &CollisionError{
+			Kind:        CollisionSameKey,
+			Path:        "example.com/foo.html",
+			URL:         "example.com/foo.html",
+			ExistingURL: "example.com/foo",
+		}, err)
+
+		err = register(t, registry, "https://example.com/foo?page=2", "text/html")
+		assert.ErrorContains(t, err, "example.com/foo?page=2 and example.com/foo are both saved at example.com/foo.html")
+	})
+
+	t.Run("a file collides with a directory of a later URL", func(t *testing.T) {
+		registry := NewPathRegistry()
+		assert.NoError(t, register(t, registry, "https://example.com/foo.csv", "text/csv"))
+
+		err := register(t, registry, "https://example.com/foo.csv/preview", "text/html")
+		assert.Equal(t, &CollisionError{
+			Kind:        CollisionFileDirectory,
+			Path:        "example.com/foo.csv/preview.html",
+			URL:         "example.com/foo.csv/preview",
+			ExistingURL: "example.com/foo.csv",
+		}, err)
+	})
+
+	t.Run("a directory collides with a file of a later URL", func(t *testing.T) {
+		registry := NewPathRegistry()
+		assert.NoError(t, register(t, registry, "https://example.com/foo.csv/preview", "text/html"))
+		assert.NoError(t, register(t, registry, "https://example.com/foo.csv/data", "text/html"))
+
+		err := register(t, registry, "https://example.com/foo.csv", "text/csv")
+		var collision *CollisionError
+		assert.ErrorAs(t, err, &collision)
+		assert.Equal(t, CollisionFileDirectory, collision.Kind)
+		assert.Equal(t, "example.com/foo.csv/preview", collision.ExistingURL)
+	})
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"mime"
+	"strconv"
+	"sync"
+)
+
+// OtherLabelValue is the value of a bounded label for values seen after its limit was reached
+const OtherLabelValue = "other"
+
+// UnknownLabelValue is the value of a label whose value is missing or invalid
+const UnknownLabelValue = "unknown"
+
+// maxLabelValues bounds the number of distinct values of the domain and media_type labels
+const maxLabelValues = 50
+
+// boundedLabel limits the values of a label to the first values seen, so that values chosen by
+// the crawled site, such as its content types, can't create an unbounded number of series
+type boundedLabel struct {
+	mu     sync.Mutex
+	limit  int
+	values map[string]struct{}
+}
+
+func newBoundedLabel(limit int) *boundedLabel {
+	return &boundedLabel{limit: limit, values: map[string]struct{}{}}
+}
+
+// value returns the label value to record for the value
+func (b *boundedLabel) value(value string) string {
+	if value == "" {
+		return UnknownLabelValue
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.values[value]; ok {
+		return value
+	}
+	if len(b.values) >= b.limit {
+		return OtherLabelValue
+	}
+	b.values[value] = struct{}{}
+	return value
+}
+
+// StatusClass returns the class of an HTTP status code, such as 4xx for 404
+func StatusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return UnknownLabelValue
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// mediaTypeLabel returns the media type of a Content-Type without its parameters
+func mediaTypeLabel(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
@@ -1,19 +1,18 @@
 package metrics
 
 import (
-	"context"
 	"mirrorer/internal/config"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rs/zerolog/log"
 )
 
-var httpClient = &http.Client{}
-
 type Metrics struct {
 	httpErrorCounter          prometheus.Counter
 	downloadErrorCounter      prometheus.Counter
@@ -23,6 +22,29 @@ type Metrics struct {
 	fileUploadCounter         prometheus.Counter
 	fileUploadFailuresCounter prometheus.Counter
 	mirrorLastUpdatedGauge    prometheus.Gauge
+	backendFileUploadCounter  *prometheus.CounterVec
+	backendFileUploadFailures *prometheus.CounterVec
+	uploadDecisionCounter     *prometheus.CounterVec
+	uploadQueueDepth          prometheus.Gauge
+	uploadDuration            prometheus.Histogram
+	localDiskUsage            prometheus.Gauge
+	pathCollisionCounter      *prometheus.CounterVec
+	contentTypeFallbacks      *prometheus.CounterVec
+	contentTypeMismatches     *prometheus.CounterVec
+	unknownContentTypes       *prometheus.CounterVec
+	httpConnections           *prometheus.CounterVec
+	ignoredCookiesCounter     prometheus.Counter
+	dnsLookupDuration         prometheus.Histogram
+	responseCounter           *prometheus.CounterVec
+	responseDuration          *prometheus.HistogramVec
+	responseSize              prometheus.Histogram
+	crawlErrorCounter         *prometheus.CounterVec
+	domainDownloadCounter     *prometheus.CounterVec
+	backendUploadDuration     *prometheus.HistogramVec
+
+	// the values of the domain and media_type labels, which are bounded
+	domains    *boundedLabel
+	mediaTypes *boundedLabel
 }
 
 func NewMetrics(reg *prometheus.Registry) *Metrics {
@@ -77,6 +99,108 @@ func NewMetrics(reg *prometheus.Registry) *Metrics {
 			Help:        "Last time the mirror was updated",
 			ConstLabels: defaultLabels,
 		}),
+		backendFileUploadCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_backend_files_uploaded_total",
+			Help:        "Total number of files the crawler has uploaded to each mirror backend",
+			ConstLabels: defaultLabels,
+		}, []string{"backend"}),
+		backendFileUploadFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_backend_file_upload_failures_total",
+			Help:        "Total number of upload failures encountered by the crawler for each mirror backend",
+			ConstLabels: defaultLabels,
+		}, []string{"backend"}),
+		uploadDecisionCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_upload_decisions_total",
+			Help:        "Total number of files the crawler skipped because the mirror held identical content, or uploaded because they were new or changed",
+			ConstLabels: defaultLabels,
+		}, []string{"decision"}),
+		uploadQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "govuk_mirror_crawler_upload_queue_depth",
+			Help:        "Number of files waiting to be uploaded to the mirror",
+			ConstLabels: defaultLabels,
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "govuk_mirror_crawler_upload_duration_seconds",
+			Help:        "Time taken to upload a file to the mirror, including retries",
+			ConstLabels: defaultLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.01, 2, 14),
+		}),
+		localDiskUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "govuk_mirror_crawler_local_disk_usage_bytes",
+			Help:        "Size of the downloaded files held on local disk",
+			ConstLabels: defaultLabels,
+		}),
+		pathCollisionCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_path_collisions_total",
+			Help:        "Total number of crawled URLs whose storage path collided with the path of another URL",
+			ConstLabels: defaultLabels,
+		}, []string{"kind"}),
+		contentTypeFallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_content_type_fallbacks_total",
+			Help:        "Total number of responses without a valid Content-Type header, by where their content type was taken from instead",
+			ConstLabels: defaultLabels,
+		}, []string{"source"}),
+		contentTypeMismatches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_content_type_mismatches_total",
+			Help:        "Total number of responses whose content looks like a different type to their Content-Type header, by the type sniffed from the content",
+			ConstLabels: defaultLabels,
+		}, []string{"sniffed_type"}),
+		unknownContentTypes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_unknown_content_types_total",
+			Help:        "Total number of responses whose content type has no known file extension, by content type",
+			ConstLabels: defaultLabels,
+		}, []string{"media_type"}),
+		httpConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_http_connections_total",
+			Help:        "Total number of connections the crawler's requests were sent over, by whether the connection was reused from the pool",
+			ConstLabels: defaultLabels,
+		}, []string{"reused"}),
+		ignoredCookiesCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_pages_with_ignored_cookies_total",
+			Help:        "Total number of crawled responses that set cookies the crawler ignored because of COOKIE_POLICY",
+			ConstLabels: defaultLabels,
+		}),
+		dnsLookupDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "govuk_mirror_crawler_dns_lookup_duration_seconds",
+			Help:        "Time taken by the DNS lookups of the crawler's new connections",
+			ConstLabels: defaultLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 12),
+		}),
+		responseCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_responses_total",
+			Help:        "Total number of responses received by the crawler, including redirects and errors, by status class, domain and media type",
+			ConstLabels: defaultLabels,
+		}, []string{"status_class", "domain", "media_type"}),
+		responseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "govuk_mirror_crawler_response_duration_seconds",
+			Help:        "Time taken to receive the headers of each response to the crawler, by domain",
+			ConstLabels: defaultLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"domain"}),
+		responseSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "govuk_mirror_crawler_response_size_bytes",
+			Help:        "Size of the bodies of the responses read by the crawler",
+			ConstLabels: defaultLabels,
+			Buckets:     prometheus.ExponentialBuckets(1024, 4, 10),
+		}),
+		crawlErrorCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_errors_by_kind_total",
+			Help:        "Total number of errors encountered by the crawler, by kind of error and domain",
+			ConstLabels: defaultLabels,
+		}, []string{"kind", "domain"}),
+		domainDownloadCounter: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "govuk_mirror_crawler_downloads_total",
+			Help:        "Total number of files downloaded by the crawler, by domain and media type",
+			ConstLabels: defaultLabels,
+		}, []string{"domain", "media_type"}),
+		backendUploadDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "govuk_mirror_crawler_backend_upload_duration_seconds",
+			Help:        "Time taken by each attempt to upload a file to each mirror backend",
+			ConstLabels: defaultLabels,
+			Buckets:     prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"backend"}),
+		domains:    newBoundedLabel(maxLabelValues),
+		mediaTypes: newBoundedLabel(maxLabelValues),
 	}
 
 	reg.MustRegister(m.httpErrorCounter)
@@ -86,6 +210,25 @@ func NewMetrics(reg *prometheus.Registry) *Metrics {
 	reg.MustRegister(m.crawlerDuration)
 	reg.MustRegister(m.fileUploadCounter)
 	reg.MustRegister(m.fileUploadFailuresCounter)
+	reg.MustRegister(m.backendFileUploadCounter)
+	reg.MustRegister(m.backendFileUploadFailures)
+	reg.MustRegister(m.uploadDecisionCounter)
+	reg.MustRegister(m.uploadQueueDepth)
+	reg.MustRegister(m.uploadDuration)
+	reg.MustRegister(m.localDiskUsage)
+	reg.MustRegister(m.pathCollisionCounter)
+	reg.MustRegister(m.contentTypeFallbacks)
+	reg.MustRegister(m.contentTypeMismatches)
+	reg.MustRegister(m.unknownContentTypes)
+	reg.MustRegister(m.httpConnections)
+	reg.MustRegister(m.ignoredCookiesCounter)
+	reg.MustRegister(m.dnsLookupDuration)
+	reg.MustRegister(m.responseCounter)
+	reg.MustRegister(m.responseDuration)
+	reg.MustRegister(m.responseSize)
+	reg.MustRegister(m.crawlErrorCounter)
+	reg.MustRegister(m.domainDownloadCounter)
+	reg.MustRegister(m.backendUploadDuration)
 
 	return m
 }
@@ -139,6 +282,97 @@ func FileUploadFailed(m *Metrics) {
 	m.fileUploadFailuresCounter.Inc()
 }
 
+func BackendFileUploaded(m *Metrics, backend string) {
+	m.backendFileUploadCounter.With(prometheus.Labels{"backend": backend}).Inc()
+}
+
+func BackendFileUploadFailed(m *Metrics, backend string) {
+	m.backendFileUploadFailures.With(prometheus.Labels{"backend": backend}).Inc()
+}
+
+func UploadDecision(m *Metrics, decision string) {
+	m.uploadDecisionCounter.With(prometheus.Labels{"decision": decision}).Inc()
+}
+
+func UploadQueueEnqueued(m *Metrics) {
+	m.uploadQueueDepth.Inc()
+}
+
+func UploadQueueDequeued(m *Metrics) {
+	m.uploadQueueDepth.Dec()
+}
+
+func LocalFileStored(m *Metrics, size int64) {
+	m.localDiskUsage.Add(float64(size))
+}
+
+func LocalFileDeleted(m *Metrics, size int64) {
+	m.localDiskUsage.Sub(float64(size))
+}
+
+func PathCollision(m *Metrics, kind string) {
+	m.pathCollisionCounter.With(prometheus.Labels{"kind": kind}).Inc()
+}
+
+func ContentTypeFallback(m *Metrics, source string) {
+	m.contentTypeFallbacks.With(prometheus.Labels{"source": source}).Inc()
+}
+
+func ContentTypeMismatch(m *Metrics, sniffedType string) {
+	m.contentTypeMismatches.With(prometheus.Labels{"sniffed_type": sniffedType}).Inc()
+}
+
+func UnknownContentType(m *Metrics, mediaType string) {
+	m.unknownContentTypes.With(prometheus.Labels{"media_type": mediaType}).Inc()
+}
+
+func HTTPConnection(m *Metrics, reused bool) {
+	m.httpConnections.With(prometheus.Labels{"reused": strconv.FormatBool(reused)}).Inc()
+}
+
+func IgnoredCookies(m *Metrics) {
+	m.ignoredCookiesCounter.Inc()
+}
+
+func DNSLookupDuration(m *Metrics, d time.Duration) {
+	m.dnsLookupDuration.Observe(d.Seconds())
+}
+
+// ResponseReceived records a response to the crawler and the time taken to receive its headers
+func ResponseReceived(m *Metrics, domain string, statusCode int, contentType string, d time.Duration) {
+	domain = m.domains.value(strings.ToLower(domain))
+	m.responseCounter.With(prometheus.Labels{
+		"status_class": StatusClass(statusCode),
+		"domain":       domain,
+		"media_type":   m.mediaTypes.value(mediaTypeLabel(contentType)),
+	}).Inc()
+	m.responseDuration.With(prometheus.Labels{"domain": domain}).Observe(d.Seconds())
+}
+
+func ResponseSize(m *Metrics, size int64) {
+	m.responseSize.Observe(float64(size))
+}
+
+// CrawlError records an error encountered by the crawler, of a kind such as timeout
+func CrawlError(m *Metrics, domain string, kind string) {
+	m.crawlErrorCounter.With(prometheus.Labels{"kind": kind, "domain": m.domains.value(strings.ToLower(domain))}).Inc()
+}
+
+func DomainDownload(m *Metrics, domain string, contentType string) {
+	m.domainDownloadCounter.With(prometheus.Labels{
+		"domain":     m.domains.value(strings.ToLower(domain)),
+		"media_type": m.mediaTypes.value(mediaTypeLabel(contentType)),
+	}).Inc()
+}
+
+func BackendUploadDuration(m *Metrics, backend string, d time.Duration) {
+	m.backendUploadDuration.With(prometheus.Labels{"backend": backend}).Observe(d.Seconds())
+}
+
+func UploadDuration(m *Metrics, d time.Duration) {
+	m.uploadDuration.Observe(d.Seconds())
+}
+
 func CrawlerDuration(m *Metrics, t time.Time) {
 	m.crawlerDuration.Set(time.Since(t).Minutes())
 }
@@ -179,17 +413,127 @@ func (m Metrics) MirrorLastUpdatedGauge() prometheus.Gauge {
 	return m.mirrorLastUpdatedGauge
 }
 
+func (m Metrics) BackendFileUploadCounter() *prometheus.CounterVec {
+	return m.backendFileUploadCounter
+}
+
+func (m Metrics) BackendFileUploadFailuresCounter() *prometheus.CounterVec {
+	return m.backendFileUploadFailures
+}
+
+func (m Metrics) UploadDecisionCounter() *prometheus.CounterVec {
+	return m.uploadDecisionCounter
+}
+
+func (m Metrics) UploadQueueDepth() prometheus.Gauge {
+	return m.uploadQueueDepth
+}
+
+func (m Metrics) LocalDiskUsage() prometheus.Gauge {
+	return m.localDiskUsage
+}
+
+func (m Metrics) PathCollisionCounter() *prometheus.CounterVec {
+	return m.pathCollisionCounter
+}
+
+func (m Metrics) ContentTypeFallbacks() *prometheus.CounterVec {
+	return m.contentTypeFallbacks
+}
+
+func (m Metrics) ContentTypeMismatches() *prometheus.CounterVec {
+	return m.contentTypeMismatches
+}
+
+func (m Metrics) UnknownContentTypes() *prometheus.CounterVec {
+	return m.unknownContentTypes
+}
+
+func (m Metrics) UploadDuration() prometheus.Histogram {
+	return m.uploadDuration
+}
+
+func (m Metrics) HTTPConnections() *prometheus.CounterVec {
+	return m.httpConnections
+}
+
+func (m Metrics) IgnoredCookiesCounter() prometheus.Counter {
+	return m.ignoredCookiesCounter
+}
+
+func (m Metrics) DNSLookupDuration() prometheus.Histogram {
+	return m.dnsLookupDuration
+}
+
+func (m Metrics) ResponseCounter() *prometheus.CounterVec {
+	return m.responseCounter
+}
+
+func (m Metrics) ResponseDuration() *prometheus.HistogramVec {
+	return m.responseDuration
+}
+
+func (m Metrics) ResponseSize() prometheus.Histogram {
+	return m.responseSize
+}
+
+func (m Metrics) CrawlErrorCounter() *prometheus.CounterVec {
+	return m.crawlErrorCounter
+}
+
+func (m Metrics) DomainDownloadCounter() *prometheus.CounterVec {
+	return m.domainDownloadCounter
+}
+
+func (m Metrics) BackendUploadDuration() *prometheus.HistogramVec {
+	return m.backendUploadDuration
+}
+
 func (m ResponseMetrics) MirrorResponseStatusCode() prometheus.GaugeVec {
 	return *m.mirrorResponseStatusCode
 }
 
+// RunTotals are the totals counted by the crawler so far
+type RunTotals struct {
+	PagesCrawled    int64 `json:"pages_crawled"`
+	FilesDownloaded int64 `json:"files_downloaded"`
+	HTTPErrors      int64 `json:"http_errors"`
+	DownloadErrors  int64 `json:"download_errors"`
+	FilesUploaded   int64 `json:"files_uploaded"`
+	UploadFailures  int64 `json:"upload_failures"`
+	// PagesWithIgnoredCookies is the number of responses that set cookies ignored because of
+	// COOKIE_POLICY, which browsers would have been served differently
+	PagesWithIgnoredCookies int64 `json:"pages_with_ignored_cookies"`
+}
+
+// Totals returns the totals of the crawler's counters
+func Totals(m *Metrics) RunTotals {
+	return RunTotals{
+		PagesCrawled:            counterValue(m.crawledPagesCounter),
+		FilesDownloaded:         counterValue(m.downloadCounter),
+		HTTPErrors:              counterValue(m.httpErrorCounter),
+		DownloadErrors:          counterValue(m.downloadErrorCounter),
+		FilesUploaded:           counterValue(m.fileUploadCounter),
+		UploadFailures:          counterValue(m.fileUploadFailuresCounter),
+		PagesWithIgnoredCookies: counterValue(m.ignoredCookiesCounter),
+	}
+}
+
+func counterValue(c prometheus.Counter) int64 {
+	metric := &dto.Metric{}
+	if err := c.Write(metric); err != nil {
+		return 0
+	}
+	return int64(metric.GetCounter().GetValue())
+}
+
 func UpdateEndJobMetrics(m *Metrics, startTime time.Time, cfg *config.Config) {
 	CrawlerDuration(m, startTime)
 	timeNow := float64(time.Now().Unix())
 	mirrorLastUpdatedGauge(m, timeNow)
 }
 
-func fetchMirrorAvailabilityMetric(backend string, url string) (int, error) {
+func fetchMirrorAvailabilityMetric(client *http.Client, backend string, url string) (int, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Error().Str("metric", "govuk_mirror_response_status_code").Str("backend", backend).Err(err).Msg("Failed to form a HTTP GET request")
@@ -197,17 +541,20 @@ func fetchMirrorAvailabilityMetric(backend string, url string) (int, error) {
 	}
 	req.Header.Set("Backend-Override", backend)
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Error().Str("metric", "govuk_mirror_response_status_code").Str("backend", backend).Err(err).Msg("Failed to get a HTTP response")
 		return 0, err
 	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
 
 	return resp.StatusCode, nil
 }
 
-func updateMirrorResponseStatusCode(m *ResponseMetrics, url string, backend string) error {
-	statusCode, err := fetchMirrorAvailabilityMetric(backend, url)
+func updateMirrorResponseStatusCode(client *http.Client, m *ResponseMetrics, url string, backend string) error {
+	statusCode, err := fetchMirrorAvailabilityMetric(client, backend, url)
 	if err != nil {
 		log.Error().Str("metric", "govuk_mirror_response_status_code").Str("backend", backend).Err(err).Msg("Failed to get a HTTP status code")
 		return err
@@ -217,39 +564,12 @@ func updateMirrorResponseStatusCode(m *ResponseMetrics, url string, backend stri
 	return nil
 }
 
-func UpdateMirrorResponseStatusCode(m *ResponseMetrics, cfg *config.Config) {
+// UpdateMirrorResponseStatusCode probes MIRROR_AVAILABILITY_URL through each backend with the client
+func UpdateMirrorResponseStatusCode(client *http.Client, m *ResponseMetrics, cfg *config.Config) {
 	for _, backend := range cfg.MirrorBackends {
-		err := updateMirrorResponseStatusCode(m, cfg.MirrorAvailabilityUrl, backend)
+		err := updateMirrorResponseStatusCode(client, m, cfg.MirrorAvailabilityUrl, backend)
 		if err != nil {
 			log.Error().Str("metric", "govuk_mirror_response_status_code").Str("backend", backend).Err(err).Msg("Error updating metrics")
 		}
 	}
 }
-
-func PushMetrics(reg *prometheus.Registry, ctx context.Context, cfg *config.Config) {
-	ticker := time.NewTicker(cfg.MetricRefreshInterval)
-
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			err := push.New(cfg.PushGatewayUrl, "mirror_metrics").Gatherer(reg).Push()
-
-			if err != nil {
-				log.Error().Err(err).Msg("Error pushing metrics to Prometheus Pushgateway")
-			}
-
-		case <-ctx.Done():
-			err := push.New(cfg.PushGatewayUrl, "mirror_metrics").Gatherer(reg).Push()
-
-			if err != nil {
-				log.Error().Err(err).Msg("Error pushing metrics to Prometheus Pushgateway")
-			}
-
-			log.Info().Msg("PushMetrics goroutine is shutting down...")
-
-			return
-		}
-	}
-}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"fmt"
 	"mirrorer/internal/config"
 	"net/http"
 	"net/http/httptest"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -56,6 +58,119 @@ func TestIncrementCrawledPagesCounterMetric(t *testing.T) {
 	assert.Equal(t, float64(3), testutil.ToFloat64(m.CrawledPagesCounter()))
 }
 
+func TestIncrementBackendFileUploadMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	BackendFileUploaded(m, "mirrorS3")
+	BackendFileUploaded(m, "mirrorS3")
+	BackendFileUploaded(m, "mirrorGCS")
+	BackendFileUploadFailed(m, "mirrorGCS")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.BackendFileUploadCounter().WithLabelValues("mirrorS3")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.BackendFileUploadCounter().WithLabelValues("mirrorGCS")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.BackendFileUploadFailuresCounter().WithLabelValues("mirrorGCS")))
+}
+
+func TestIncrementUploadDecisionMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	UploadDecision(m, "skipped_identical")
+	UploadDecision(m, "skipped_identical")
+	UploadDecision(m, "uploaded_changed")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.UploadDecisionCounter().WithLabelValues("skipped_identical")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.UploadDecisionCounter().WithLabelValues("uploaded_changed")))
+}
+
+func TestUploadQueueDepthGaugeMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	UploadQueueEnqueued(m)
+	UploadQueueEnqueued(m)
+	UploadQueueDequeued(m)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.UploadQueueDepth()))
+}
+
+func TestUploadDurationHistogramMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	UploadDuration(m, 100*time.Millisecond)
+	UploadDuration(m, 2*time.Second)
+
+	metric := &dto.Metric{}
+	assert.NoError(t, m.UploadDuration().Write(metric))
+	assert.Equal(t, uint64(2), metric.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 2.1, metric.GetHistogram().GetSampleSum(), 0.0001)
+}
+
+func TestLabelledResponseMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+
+	ResponseReceived(m, "WWW.GOV.UK", http.StatusNotFound, "text/html; charset=utf-8", 100*time.Millisecond)
+	ResponseReceived(m, "assets.publishing.service.gov.uk", http.StatusOK, "", 200*time.Millisecond)
+	DomainDownload(m, "assets.publishing.service.gov.uk", "application/pdf")
+	CrawlError(m, "www.gov.uk", "client_error")
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.ResponseCounter().WithLabelValues("4xx", "www.gov.uk", "text/html")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.ResponseCounter().WithLabelValues("2xx", "assets.publishing.service.gov.uk", "unknown")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.DomainDownloadCounter().WithLabelValues("assets.publishing.service.gov.uk", "application/pdf")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.CrawlErrorCounter().WithLabelValues("client_error", "www.gov.uk")))
+	assert.Equal(t, 2, testutil.CollectAndCount(m.ResponseDuration()))
+}
+
+func TestBoundedLabels(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+
+	for i := range maxLabelValues + 10 {
+		ResponseReceived(m, "www.gov.uk", http.StatusOK, fmt.Sprintf("application/x-type-%d", i), time.Millisecond)
+	}
+
+	// the types beyond the limit are counted together
+	assert.Equal(t, maxLabelValues+1, testutil.CollectAndCount(m.ResponseCounter()))
+	assert.Equal(t, float64(10), testutil.ToFloat64(m.ResponseCounter().WithLabelValues("2xx", "www.gov.uk", OtherLabelValue)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.ResponseCounter().WithLabelValues("2xx", "www.gov.uk", "application/x-type-0")))
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{
+		http.StatusOK:                 "2xx",
+		http.StatusMovedPermanently:   "3xx",
+		http.StatusTooManyRequests:    "4xx",
+		http.StatusServiceUnavailable: "5xx",
+		0:                             "unknown",
+		999:                           "unknown",
+	}
+
+	for statusCode, expected := range tests {
+		assert.Equal(t, expected, StatusClass(statusCode), statusCode)
+	}
+}
+
+func TestTotals(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewMetrics(reg)
+	CrawledPagesCounter(m)
+	CrawledPagesCounter(m)
+	DownloadCounter(m)
+	HttpCrawlerError(m)
+	FileUploaded(m)
+	FileUploadFailed(m)
+	IgnoredCookies(m)
+
+	assert.Equal(t, RunTotals{
+		PagesCrawled:            2,
+		FilesDownloaded:         1,
+		HTTPErrors:              1,
+		DownloadErrors:          0,
+		FilesUploaded:           1,
+		UploadFailures:          1,
+		PagesWithIgnoredCookies: 1,
+	}, Totals(m))
+}
+
 func TestCrawlerDurationGaugeMetric(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		reg := prometheus.NewRegistry()
@@ -81,11 +196,12 @@ func TestAllMetricsAreEmittedAndCorrectlyPrefixed(t *testing.T) {
 
 	// GaugeVecs need a label for the metric to be emitted
 	responseMetrics.mirrorResponseStatusCode.With(prometheus.Labels{"backend": "backend"}).Set(float64(200))
+	initialiseMetricVecs(m)
 
 	metricValues, err := reg.Gather()
 	assert.NoError(t, err)
 
-	numMetrics := reflect.TypeOf(Metrics{}).NumField() + reflect.TypeOf(ResponseMetrics{}).NumField()
+	numMetrics := numCollectors(Metrics{}) + numCollectors(ResponseMetrics{})
 	assert.Equal(t, len(metricValues), numMetrics)
 
 	for _, metric := range metricValues {
@@ -107,6 +223,7 @@ func TestAllMetricsHaveAStaticHostLabel(t *testing.T) {
 
 	// GaugeVecs need a label for the metric to be emitted
 	responseMetrics.mirrorResponseStatusCode.With(prometheus.Labels{"backend": "backend"}).Set(float64(200))
+	initialiseMetricVecs(m)
 
 	metrics, err := reg.Gather()
 	assert.NoError(t, err)
@@ -124,6 +241,36 @@ func TestAllMetricsHaveAStaticHostLabel(t *testing.T) {
 	}
 }
 
+// initialiseMetricVecs sets a label on every metric vector so that they are emitted
+func initialiseMetricVecs(m *Metrics) {
+	BackendFileUploaded(m, "backend")
+	BackendFileUploadFailed(m, "backend")
+	UploadDecision(m, "skipped_identical")
+	PathCollision(m, "same_key")
+	ContentTypeFallback(m, "sniffed")
+	ContentTypeMismatch(m, "text/html")
+	UnknownContentType(m, "application/x-unknown")
+	HTTPConnection(m, true)
+	ResponseReceived(m, "www.gov.uk", http.StatusOK, "text/html", time.Second)
+	CrawlError(m, "www.gov.uk", "timeout")
+	DomainDownload(m, "www.gov.uk", "text/html")
+	BackendUploadDuration(m, "backend", time.Second)
+}
+
+// numCollectors returns the number of metrics in a struct, ignoring its other fields
+func numCollectors(v any) int {
+	collector := reflect.TypeOf((*prometheus.Collector)(nil)).Elem()
+	t := reflect.TypeOf(v)
+
+	n := 0
+	for i := range t.NumField() {
+		if t.Field(i).Type.Implements(collector) {
+			n++
+		}
+	}
+	return n
+}
+
 func setup() (*ResponseMetrics, *config.Config) {
 	reg := prometheus.NewRegistry()
 	m := NewResponseMetrics(reg)
@@ -156,7 +303,7 @@ func TestFetchMirrorAvailabilityMetric200StatusCode(t *testing.T) {
 	ts := createTestServer(timestamp, http.StatusOK)
 	defer ts.Close()
 
-	responseCode, err := fetchMirrorAvailabilityMetric("backend1", ts.URL)
+	responseCode, err := fetchMirrorAvailabilityMetric(ts.Client(), "backend1", ts.URL)
 	assert.NoError(t, err)
 
 	assert.Equal(t, http.StatusOK, responseCode)
@@ -167,7 +314,7 @@ func TestFetchMirrorAvailabilityMetric500StatusCode(t *testing.T) {
 	ts := createTestServer(timestamp, http.StatusInternalServerError)
 	defer ts.Close()
 
-	responseCode, err := fetchMirrorAvailabilityMetric("backend1", ts.URL)
+	responseCode, err := fetchMirrorAvailabilityMetric(ts.Client(), "backend1", ts.URL)
 	assert.NoError(t, err)
 
 	assert.Equal(t, http.StatusInternalServerError, responseCode)
@@ -183,7 +330,7 @@ func TestUpdateMetrics(t *testing.T) {
 	cfg.MirrorAvailabilityUrl = ts.URL
 	cfg.MetricRefreshInterval = 1 * time.Second
 
-	UpdateMirrorResponseStatusCode(m, cfg)
+	UpdateMirrorResponseStatusCode(ts.Client(), m, cfg)
 
 	assert.Equal(t, 2, testutil.CollectAndCount(m.mirrorResponseStatusCode))
 	assert.Equal(t, float64(http.StatusOK), testutil.ToFloat64(m.mirrorResponseStatusCode.WithLabelValues("backend1")))
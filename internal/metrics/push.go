@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"mirrorer/internal/config"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultPushJob is the job the metrics are pushed to when PROMETHEUS_PUSHGATEWAY_JOB is empty
+const defaultPushJob = "mirror_metrics"
+
+// pushTimeout bounds each request to the Pushgateway
+const pushTimeout = 30 * time.Second
+
+// NewPushgatewayClient returns a client that authenticates to the Pushgateway with the basic
+// auth or bearer token credentials of the configuration, if any
+func NewPushgatewayClient(cfg *config.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &pushgatewayAuth{
+			next:     http.DefaultTransport,
+			username: cfg.PushGatewayUsername,
+			password: cfg.PushGatewayPassword,
+			token:    cfg.PushGatewayBearerToken,
+		},
+	}
+}
+
+// pushgatewayAuth adds the Pushgateway credentials to each request
+type pushgatewayAuth struct {
+	next     http.RoundTripper
+	username string
+	password string
+	token    string
+}
+
+func (a *pushgatewayAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	if a.username == "" && a.token == "" {
+		return a.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	} else {
+		req.SetBasicAuth(a.username, a.password)
+	}
+	return a.next.RoundTrip(req)
+}
+
+// newPusher returns a pusher of the registry's metrics to the job and grouping key of the
+// configuration
+func newPusher(reg prometheus.Gatherer, cfg *config.Config) *push.Pusher {
+	job := cfg.PushGatewayJob
+	if job == "" {
+		job = defaultPushJob
+	}
+
+	pusher := push.New(cfg.PushGatewayUrl, job).Gatherer(reg).Client(NewPushgatewayClient(cfg, pushTimeout))
+	for _, label := range slices.Sorted(maps.Keys(cfg.PushGatewayGrouping)) {
+		pusher = pusher.Grouping(label, cfg.PushGatewayGrouping[label])
+	}
+	// so that the metrics of parallel runs are kept apart
+	if cfg.PushGatewayGroupByRunID {
+		pusher = pusher.Grouping("run_id", cfg.RunID)
+	}
+	return pusher
+}
+
+// pushWithRetries pushes the metrics, retrying a failed push up to PROMETHEUS_PUSHGATEWAY_MAX_RETRIES
+// times with exponential backoff
+func pushWithRetries(ctx context.Context, pusher *push.Pusher, cfg *config.Config) error {
+	backoff := cfg.PushGatewayRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := pusher.PushContext(ctx)
+		if err == nil || attempt >= cfg.PushGatewayMaxRetries {
+			return err
+		}
+
+		// full jitter, so that parallel runs don't retry in lockstep
+		delay := time.Duration(rand.Int64N(int64(backoff) + 1))
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("delay", delay).Msg("Retrying push to Prometheus Pushgateway")
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+	}
+}
+
+// PushMetrics pushes the registry's metrics to the Pushgateway every METRIC_REFRESH_INTERVAL,
+// and once more when the context is done
+func PushMetrics(reg *prometheus.Registry, ctx context.Context, cfg *config.Config) {
+	pusher := newPusher(reg, cfg)
+
+	// so that the metrics of the previous run aren't mistaken for this run's before the first push
+	if cfg.PushGatewayDeleteOnStart {
+		if err := pusher.Delete(); err != nil {
+			log.Error().Err(err).Msg("Error deleting the previous run's metrics from Prometheus Pushgateway")
+		}
+	}
+
+	ticker := time.NewTicker(cfg.MetricRefreshInterval)
+
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := pushWithRetries(ctx, pusher, cfg)
+
+			if err != nil {
+				log.Error().Err(err).Msg("Error pushing metrics to Prometheus Pushgateway")
+			}
+
+		case <-ctx.Done():
+			// the final push isn't cancelled with the context
+			err := pushWithRetries(context.Background(), pusher, cfg)
+
+			if err != nil {
+				log.Error().Err(err).Msg("Error pushing metrics to Prometheus Pushgateway")
+			}
+
+			log.Info().Msg("PushMetrics goroutine is shutting down...")
+
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"context"
+	"mirrorer/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// pushgatewayRequest is a request received by a fake Pushgateway
+type pushgatewayRequest struct {
+	method        string
+	path          string
+	authorization string
+}
+
+// newFakePushgateway starts a server that records its requests, failing the first failures of them
+func newFakePushgateway(t *testing.T, failures int) (*httptest.Server, func() []pushgatewayRequest) {
+	var mu sync.Mutex
+	requests := []pushgatewayRequest{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		requests = append(requests, pushgatewayRequest{method: r.Method, path: r.URL.Path, authorization: r.Header.Get("Authorization")})
+		if len(requests) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []pushgatewayRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]pushgatewayRequest{}, requests...)
+	}
+}
+
+// parsePushPath splits a /metrics/job/<job>/<label>/<value>... path into its job and grouping labels
+func parsePushPath(t *testing.T, path string) (string, map[string]string) {
+	segments := strings.Split(strings.TrimPrefix(path, "/metrics/job/"), "/")
+	if !assert.Equal(t, 1, len(segments)%2, "unexpected push path %q", path) {
+		return "", nil
+	}
+
+	grouping := map[string]string{}
+	for i := 1; i < len(segments); i += 2 {
+		grouping[segments[i]] = segments[i+1]
+	}
+	return segments[0], grouping
+}
+
+func TestNewPushgatewayClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      *config.Config
+		expected string
+	}{
+		{name: "no credentials", cfg: &config.Config{}, expected: ""},
+		{name: "basic auth", cfg: &config.Config{PushGatewayUsername: "mirror", PushGatewayPassword: "secret"}, expected: "Basic bWlycm9yOnNlY3JldA=="},
+		{name: "bearer token", cfg: &config.Config{PushGatewayBearerToken: "token"}, expected: "Bearer token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newFakePushgateway(t, 0)
+
+			resp, err := NewPushgatewayClient(test.cfg, time.Second).Get(server.URL + "/-/ready")
+			assert.NoError(t, err)
+			_ = resp.Body.Close()
+
+			assert.Equal(t, test.expected, requests()[0].authorization)
+		})
+	}
+}
+
+func TestPushWithRetries(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	NewMetrics(reg)
+
+	t.Run("the metrics are pushed to the job and grouping key", func(t *testing.T) {
+		server, requests := newFakePushgateway(t, 0)
+		cfg := &config.Config{
+			PushGatewayUrl:          server.URL,
+			PushGatewayJob:          "mirror",
+			PushGatewayGrouping:     map[string]string{"shard": "2", "environment": "staging"},
+			PushGatewayGroupByRunID: true,
+			RunID:                   "run-1",
+		}
+
+		assert.NoError(t, pushWithRetries(t.Context(), newPusher(reg, cfg), cfg))
+		if assert.Len(t, requests(), 1) {
+			assert.Equal(t, http.MethodPut, requests()[0].method)
+			// the push library keeps the grouping key in a map, so the labels come in any order
+			job, grouping := parsePushPath(t, requests()[0].path)
+			assert.Equal(t, "mirror", job)
+			assert.Equal(t, map[string]string{"environment": "staging", "shard": "2", "run_id": "run-1"}, grouping)
+		}
+	})
+
+	t.Run("the job defaults to mirror_metrics", func(t *testing.T) {
+		server, requests := newFakePushgateway(t, 0)
+		cfg := &config.Config{PushGatewayUrl: server.URL}
+
+		assert.NoError(t, pushWithRetries(t.Context(), newPusher(reg, cfg), cfg))
+		assert.Equal(t, "/metrics/job/mirror_metrics", requests()[0].path)
+	})
+
+	t.Run("failed pushes are retried", func(t *testing.T) {
+		server, requests := newFakePushgateway(t, 2)
+		cfg := &config.Config{PushGatewayUrl: server.URL, PushGatewayMaxRetries: 2, PushGatewayRetryBackoff: time.Millisecond}
+
+		assert.NoError(t, pushWithRetries(t.Context(), newPusher(reg, cfg), cfg))
+		assert.Len(t, requests(), 3)
+	})
+
+	t.Run("the push fails once the retries run out", func(t *testing.T) {
+		server, requests := newFakePushgateway(t, 3)
+		cfg := &config.Config{PushGatewayUrl: server.URL, PushGatewayMaxRetries: 2, PushGatewayRetryBackoff: time.Millisecond}
+
+		err := pushWithRetries(t.Context(), newPusher(reg, cfg), cfg)
+		assert.ErrorContains(t, err, "unexpected status code 503")
+		assert.Len(t, requests(), 3)
+	})
+
+	t.Run("retries stop when the context is done", func(t *testing.T) {
+		server, requests := newFakePushgateway(t, 1)
+		cfg := &config.Config{PushGatewayUrl: server.URL, PushGatewayMaxRetries: 2, PushGatewayRetryBackoff: time.Hour}
+
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		defer cancel()
+
+		err := pushWithRetries(ctx, newPusher(reg, cfg), cfg)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Len(t, requests(), 1)
+	})
+}
+
+func TestPushMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	NewMetrics(reg)
+
+	tests := []struct {
+		name          string
+		deleteOnStart bool
+		expected      []string
+	}{
+		{name: "the metrics are pushed when the context is done", expected: []string{http.MethodPut}},
+		{name: "the previous run's metrics are deleted first", deleteOnStart: true, expected: []string{http.MethodDelete, http.MethodPut}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := newFakePushgateway(t, 0)
+			cfg := &config.Config{
+				PushGatewayUrl:           server.URL,
+				PushGatewayDeleteOnStart: test.deleteOnStart,
+				MetricRefreshInterval:    time.Hour,
+			}
+
+			ctx, cancel := context.WithCancel(t.Context())
+			cancel()
+			PushMetrics(reg, ctx, cfg)
+
+			methods := []string{}
+			for _, request := range requests() {
+				methods = append(methods, request.method)
+			}
+			assert.Equal(t, test.expected, methods)
+		})
+	}
+}
@@ -1,8 +1,15 @@
 package mime
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"mime"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 )
 
 var additionalMimeTypes = map[string][]string{
@@ -22,7 +29,51 @@ var additionalMimeTypes = map[string][]string{
 	".woff2": {"font/woff2"},
 }
 
-func LoadAdditionalMimeTypes() error {
+// compressibleMediaTypes are the text-based media types worth compressing before upload.
+// Formats such as PDF, images and office documents are already compressed.
+var compressibleMediaTypes = []string{
+	"application/atom+xml",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+	"text/calendar",
+	"text/css",
+	"text/csv",
+	"text/html",
+	"text/javascript",
+	"text/plain",
+	"text/xml",
+}
+
+// IsCompressible reports whether files of the content type are text-based and worth compressing
+func IsCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(compressibleMediaTypes, mediaType) ||
+		strings.HasSuffix(mediaType, "+xml") ||
+		strings.HasSuffix(mediaType, "+json")
+}
+
+// Mappings are extra mappings between extensions and media types, loaded from a JSON file
+type Mappings struct {
+	// Types maps extensions, such as ".gpkg", to the media types files with them are served as
+	Types map[string][]string `json:"types"`
+	// PreferredExtensions maps media types to the extension added to the paths of files served as them
+	PreferredExtensions map[string]string `json:"preferred_extensions"`
+}
+
+var (
+	preferredExtensionsMu sync.RWMutex
+	preferredExtensions   = map[string]string{}
+)
+
+// LoadAdditionalMimeTypes registers the built-in extension mappings, and those in mappingsFile if
+// it isn't empty. Every invalid mapping in the file is reported.
+func LoadAdditionalMimeTypes(mappingsFile string) error {
 	for ext, types := range additionalMimeTypes {
 		for _, typ := range types {
 			if err := mime.AddExtensionType(ext, typ); err != nil {
@@ -30,5 +81,87 @@ func LoadAdditionalMimeTypes() error {
 			}
 		}
 	}
-	return nil
+
+	if mappingsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(mappingsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read mime types %s: %w", mappingsFile, err)
+	}
+
+	mappings := Mappings{}
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return fmt.Errorf("failed to parse mime types %s: %w", mappingsFile, err)
+	}
+
+	return mappings.register()
+}
+
+func (mappings Mappings) register() error {
+	var errs []error
+
+	for _, ext := range slices.Sorted(maps.Keys(mappings.Types)) {
+		if !validExtension(ext) {
+			errs = append(errs, fmt.Errorf("invalid extension %q", ext))
+			continue
+		}
+		for _, typ := range mappings.Types[ext] {
+			// mime.AddExtensionType accepts a bare token such as "pdf"
+			if mediaType, _, err := mime.ParseMediaType(typ); err != nil || !strings.Contains(mediaType, "/") {
+				errs = append(errs, fmt.Errorf("invalid media type %q for extension %s", typ, ext))
+				continue
+			}
+			if err := mime.AddExtensionType(ext, typ); err != nil {
+				errs = append(errs, fmt.Errorf("error adding mime type %s with extension %s: %w", typ, ext, err))
+			}
+		}
+	}
+
+	preferredExtensionsMu.Lock()
+	defer preferredExtensionsMu.Unlock()
+
+	for _, typ := range slices.Sorted(maps.Keys(mappings.PreferredExtensions)) {
+		ext := mappings.PreferredExtensions[typ]
+		mediaType, _, err := mime.ParseMediaType(typ)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid media type %q for preferred extension %s: %w", typ, ext, err))
+			continue
+		}
+
+		extensions, _ := mime.ExtensionsByType(mediaType)
+		if !slices.Contains(extensions, ext) {
+			errs = append(errs, fmt.Errorf("preferred extension %s is not an extension of %s", ext, mediaType))
+			continue
+		}
+
+		preferredExtensions[mediaType] = ext
+	}
+
+	return errors.Join(errs...)
+}
+
+func validExtension(ext string) bool {
+	return len(ext) > 1 && strings.HasPrefix(ext, ".") && !strings.ContainsAny(ext[1:], "./\\")
+}
+
+// PreferredExtension returns the extension configured for files of the content type, if any
+func PreferredExtension(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+
+	preferredExtensionsMu.RLock()
+	defer preferredExtensionsMu.RUnlock()
+
+	ext, ok := preferredExtensions[mediaType]
+	return ext, ok
+}
+
+// IsKnownType reports whether any extension is registered for the media type
+func IsKnownType(mediaType string) bool {
+	extensions, err := mime.ExtensionsByType(mediaType)
+	return err == nil && len(extensions) > 0
 }
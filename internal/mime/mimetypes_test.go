@@ -2,11 +2,23 @@ package mime
 
 import (
 	"mime"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
+// writeMappings writes a mime types file for LoadAdditionalMimeTypes, returning its path
+func writeMappings(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "mime-types.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write mime types: %v", err)
+	}
+	return path
+}
+
 func TestLoadAdditionalMimeTypes(t *testing.T) {
-	if err := LoadAdditionalMimeTypes(); err != nil {
+	if err := LoadAdditionalMimeTypes(""); err != nil {
 		t.Errorf("LoadAdditionalMimeTypes() got error = %v", err)
 	}
 
@@ -17,3 +29,93 @@ func TestLoadAdditionalMimeTypes(t *testing.T) {
 		t.Errorf("TypeByExtension(%v) = %v; want %v", ext, got, want)
 	}
 }
+
+func TestLoadAdditionalMimeTypesFromFile(t *testing.T) {
+	path := writeMappings(t, `{
+		"types": {".mirrortest": ["application/x-mirror-test"], ".mirrortst": ["application/x-mirror-test"]},
+		"preferred_extensions": {"application/x-mirror-test": ".mirrortest"}
+	}`)
+
+	if err := LoadAdditionalMimeTypes(path); err != nil {
+		t.Fatalf("LoadAdditionalMimeTypes() got error = %v", err)
+	}
+
+	if got := mime.TypeByExtension(".mirrortst"); got != "application/x-mirror-test" {
+		t.Errorf("TypeByExtension(.mirrortst) = %v; want application/x-mirror-test", got)
+	}
+	if got, ok := PreferredExtension("application/x-mirror-test; charset=binary"); !ok || got != ".mirrortest" {
+		t.Errorf("PreferredExtension() = %v, %v; want .mirrortest, true", got, ok)
+	}
+	if !IsKnownType("application/x-mirror-test") {
+		t.Errorf("IsKnownType() = false; want true")
+	}
+}
+
+func TestLoadAdditionalMimeTypesReportsEveryError(t *testing.T) {
+	path := writeMappings(t, `{
+		"types": {"invalid": ["application/x-invalid"], ".invalidtype": ["invalid"]},
+		"preferred_extensions": {"application/x-unregistered": ".unregistered"}
+	}`)
+
+	err := LoadAdditionalMimeTypes(path)
+	if err == nil {
+		t.Fatal("LoadAdditionalMimeTypes() got no error")
+	}
+
+	for _, want := range []string{
+		`invalid extension "invalid"`,
+		`invalid media type "invalid" for extension .invalidtype`,
+		"preferred extension .unregistered is not an extension of application/x-unregistered",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadAdditionalMimeTypes() error = %v; want it to contain %q", err, want)
+		}
+	}
+}
+
+func TestLoadAdditionalMimeTypesMissingFile(t *testing.T) {
+	if err := LoadAdditionalMimeTypes(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadAdditionalMimeTypes() got no error")
+	}
+}
+
+func TestUnknownTypes(t *testing.T) {
+	unknownTypes := NewUnknownTypes(2)
+
+	for _, mediaType := range []string{"application/x-a", "application/x-b", "application/x-a", "application/x-c", "application/x-d"} {
+		unknownTypes.Record(mediaType)
+	}
+
+	want := map[string]int{"application/x-a": 2, "application/x-b": 1, OtherUnknownType: 2}
+	got := unknownTypes.Counts()
+	if len(got) != len(want) {
+		t.Fatalf("Counts() = %v; want %v", got, want)
+	}
+	for mediaType, count := range want {
+		if got[mediaType] != count {
+			t.Errorf("Counts() = %v; want %v", got, want)
+		}
+	}
+}
+
+func TestIsCompressible(t *testing.T) {
+	tests := map[string]bool{
+		"text/html; charset=utf-8": true,
+		"text/css":                 true,
+		"application/javascript":   true,
+		"application/json":         true,
+		"text/csv":                 true,
+		"application/xml":          true,
+		"application/rss+xml":      true,
+		"application/pdf":          false,
+		"image/png":                false,
+		"application/vnd.openxmlformats-officedocument.wordprocessingml.document": false,
+		"": false,
+	}
+
+	for contentType, want := range tests {
+		if got := IsCompressible(contentType); got != want {
+			t.Errorf("IsCompressible(%q) = %v; want %v", contentType, got, want)
+		}
+	}
+}
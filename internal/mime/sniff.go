@@ -0,0 +1,175 @@
+package mime
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Source is where the content type of a response came from
+type Source string
+
+const (
+	SourceHeader             Source = "header"
+	SourceContentDisposition Source = "content_disposition"
+	SourceExtension          Source = "extension"
+	SourceSniffed            Source = "sniffed"
+)
+
+// ooxmlMediaTypes are the Office Open XML media types, keyed by the directory holding the
+// main part of the document in the zip archive
+var ooxmlMediaTypes = map[string]string{
+	"word/": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"xl/":   "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"ppt/":  "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// genericMediaTypes are sniffed for content that doesn't have a recognisable signature, so
+// they never disagree with a Content-Type header
+var genericMediaTypes = []string{
+	"application/octet-stream",
+	"text/plain",
+}
+
+// sniffedAliases are the other names in use for the types that http.DetectContentType returns
+var sniffedAliases = map[string][]string{
+	"image/x-icon":    {"image/vnd.microsoft.icon"},
+	"application/zip": {"application/x-zip-compressed"},
+}
+
+// Detection is the content type decided for a response
+type Detection struct {
+	// ContentType is the content type the response is saved and uploaded with
+	ContentType string
+	// MediaType is ContentType without its parameters
+	MediaType string
+	// Source is where ContentType came from
+	Source Source
+	// Sniffed is the media type the body looks like
+	Sniffed string
+	// Mismatch reports whether the body looks like a different type to the Content-Type header
+	Mismatch bool
+}
+
+// DetectContentType decides the content type of a response. A valid Content-Type header is
+// always used. Otherwise the type is taken from the extension of the Content-Disposition filename,
+// then from the extension of the URL path, and finally sniffed from the body.
+func DetectContentType(header http.Header, urlPath string, body []byte) Detection {
+	sniffed := Sniff(body)
+	detection := Detection{Sniffed: sniffed}
+
+	if contentType := header.Get("Content-Type"); contentType != "" {
+		// mime.ParseMediaType accepts a bare token such as "pdf"
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && strings.Contains(mediaType, "/") {
+			detection.ContentType, detection.MediaType, detection.Source = contentType, mediaType, SourceHeader
+			detection.Mismatch = disagree(mediaType, sniffed)
+			return detection
+		}
+	}
+
+	detection.ContentType, detection.Source = typeByFilename(header.Get("Content-Disposition")), SourceContentDisposition
+	if detection.ContentType == "" {
+		detection.ContentType, detection.Source = mime.TypeByExtension(path.Ext(urlPath)), SourceExtension
+	}
+	if detection.ContentType == "" {
+		detection.ContentType, detection.Source = sniffed, SourceSniffed
+	}
+
+	detection.MediaType, _, _ = mime.ParseMediaType(detection.ContentType)
+	return detection
+}
+
+// Sniff returns the media type of the body from its first bytes, recognising office and
+// OpenDocument files, SVG and JSON as well as the types known to http.DetectContentType
+func Sniff(body []byte) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+
+	switch sniffed {
+	case "application/zip":
+		if officeType := sniffZip(body); officeType != "" {
+			return officeType
+		}
+	case "text/xml", "text/plain":
+		trimmed := bytes.TrimSpace(body)
+		if bytes.Contains(trimmed[:min(len(trimmed), 512)], []byte("<svg")) {
+			return "image/svg+xml"
+		}
+		if sniffed == "text/plain" && len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			return "application/json"
+		}
+	}
+
+	return sniffed
+}
+
+// sniffZip recognises OpenDocument files by their mimetype entry, and Office Open XML files by
+// the directory holding their main part. Only OpenDocument media types are taken from the
+// mimetype entry, so that the types sniffed are a fixed set.
+func sniffZip(body []byte) string {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return ""
+	}
+
+	for _, f := range archive.File {
+		if f.Name == "mimetype" {
+			r, err := f.Open()
+			if err != nil {
+				return ""
+			}
+			mediaType, err := io.ReadAll(io.LimitReader(r, 128))
+			_ = r.Close()
+			if err != nil || !strings.HasPrefix(string(mediaType), "application/vnd.oasis.opendocument.") {
+				return ""
+			}
+			return strings.TrimSpace(string(mediaType))
+		}
+
+		for dir, mediaType := range ooxmlMediaTypes {
+			if strings.HasPrefix(f.Name, dir) {
+				return mediaType
+			}
+		}
+	}
+
+	return ""
+}
+
+// typeByFilename returns the content type for the extension of the filename in a Content-Disposition header
+func typeByFilename(disposition string) string {
+	if disposition == "" {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(disposition)
+	if err != nil || params["filename"] == "" {
+		return ""
+	}
+
+	return mime.TypeByExtension(path.Ext(params["filename"]))
+}
+
+// disagree reports whether the sniffed media type contradicts the one in the Content-Type header
+func disagree(mediaType string, sniffed string) bool {
+	switch {
+	case sniffed == mediaType || slices.Contains(genericMediaTypes, sniffed):
+		return false
+	case slices.Contains(sniffedAliases[sniffed], mediaType):
+		return false
+	case sniffed == "text/xml":
+		// XML is sniffed as text/xml whatever its more specific type
+		return mediaType != "application/xml" && !strings.HasSuffix(mediaType, "+xml")
+	case sniffed == "application/json":
+		return !strings.HasSuffix(mediaType, "+json")
+	case sniffed == "application/zip":
+		// office documents and other vendor formats are zip archives that weren't recognised
+		return !strings.HasPrefix(mediaType, "application/vnd.")
+	}
+	return true
+}
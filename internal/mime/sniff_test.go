@@ -0,0 +1,127 @@
+package mime
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// zipBody returns a zip archive holding the named files, each with the given content
+func zipBody(t *testing.T, files ...[2]string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := w.Create(f[0])
+		if err != nil {
+			t.Fatalf("could not create zip entry: %v", err)
+		}
+		if _, err := fw.Write([]byte(f[1])); err != nil {
+			t.Fatalf("could not write zip entry: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("could not close zip: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want string
+	}{
+		{"HTML", []byte("<!DOCTYPE html><html><body>page</body></html>"), "text/html"},
+		{"PDF", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"PNG", []byte("\x89PNG\x0D\x0A\x1A\x0A"), "image/png"},
+		{"SVG", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`), "image/svg+xml"},
+		{"XML", []byte(`<?xml version="1.0"?><urlset></urlset>`), "text/xml"},
+		{"JSON", []byte(` {"a": [1, 2]}`), "application/json"},
+		{"text", []byte("body { color: red }"), "text/plain"},
+		{"word document", zipBody(t, [2]string{"[Content_Types].xml", "<Types/>"}, [2]string{"word/document.xml", "<w:document/>"}), "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"spreadsheet", zipBody(t, [2]string{"[Content_Types].xml", "<Types/>"}, [2]string{"xl/workbook.xml", "<workbook/>"}), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"OpenDocument text", zipBody(t, [2]string{"mimetype", "application/vnd.oasis.opendocument.text"}, [2]string{"content.xml", "<office:document-content/>"}), "application/vnd.oasis.opendocument.text"},
+		{"zip with an unknown mimetype entry", zipBody(t, [2]string{"mimetype", "application/x-anything"}), "application/zip"},
+		{"zip", zipBody(t, [2]string{"data.csv", "a,b"}), "application/zip"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Sniff(tt.body); got != tt.want {
+				t.Errorf("Sniff() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	pdf := []byte("%PDF-1.7\n")
+	css := []byte("body { color: red }")
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		urlPath string
+		body    []byte
+		want    Detection
+	}{
+		{
+			name:    "Content-Type header",
+			header:  http.Header{"Content-Type": {"application/pdf"}},
+			urlPath: "/guidance",
+			body:    pdf,
+			want:    Detection{ContentType: "application/pdf", MediaType: "application/pdf", Source: SourceHeader, Sniffed: "application/pdf"},
+		},
+		{
+			name:    "Content-Type header for content without a signature",
+			header:  http.Header{"Content-Type": {"text/css; charset=utf-8"}},
+			urlPath: "/style",
+			body:    css,
+			want:    Detection{ContentType: "text/css; charset=utf-8", MediaType: "text/css", Source: SourceHeader, Sniffed: "text/plain"},
+		},
+		{
+			name:    "Content-Type header that doesn't match the content",
+			header:  http.Header{"Content-Type": {"text/html"}},
+			urlPath: "/guidance",
+			body:    pdf,
+			want:    Detection{ContentType: "text/html", MediaType: "text/html", Source: SourceHeader, Sniffed: "application/pdf", Mismatch: true},
+		},
+		{
+			name:    "Content-Type header with a more specific XML type",
+			header:  http.Header{"Content-Type": {"application/atom+xml"}},
+			urlPath: "/feed",
+			body:    []byte(`<?xml version="1.0"?><feed></feed>`),
+			want:    Detection{ContentType: "application/atom+xml", MediaType: "application/atom+xml", Source: SourceHeader, Sniffed: "text/xml"},
+		},
+		{
+			name:    "Content-Disposition filename",
+			header:  http.Header{"Content-Disposition": {`attachment; filename="data.pdf"`}},
+			urlPath: "/download",
+			body:    css,
+			want:    Detection{ContentType: "application/pdf", MediaType: "application/pdf", Source: SourceContentDisposition, Sniffed: "text/plain"},
+		},
+		{
+			name:    "URL extension",
+			header:  http.Header{"Content-Type": {"invalid"}},
+			urlPath: "/style.css",
+			body:    css,
+			want:    Detection{ContentType: "text/css; charset=utf-8", MediaType: "text/css", Source: SourceExtension, Sniffed: "text/plain"},
+		},
+		{
+			name:    "sniffed",
+			header:  http.Header{},
+			urlPath: "/guidance",
+			body:    pdf,
+			want:    Detection{ContentType: "application/pdf", MediaType: "application/pdf", Source: SourceSniffed, Sniffed: "application/pdf"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContentType(tt.header, tt.urlPath, tt.body); got != tt.want {
+				t.Errorf("DetectContentType() = %+v; want %+v", got, tt.want)
+			}
+		})
+	}
+}
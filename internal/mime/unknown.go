@@ -0,0 +1,44 @@
+package mime
+
+import (
+	"maps"
+	"sync"
+)
+
+// OtherUnknownType is the label recorded for unknown types once the limit of distinct types is reached
+const OtherUnknownType = "other"
+
+// UnknownTypes counts the media types seen during a crawl that have no registered extension,
+// so that mappings can be added for them. It is safe for concurrent use.
+type UnknownTypes struct {
+	mu     sync.Mutex
+	counts map[string]int
+	limit  int
+}
+
+// NewUnknownTypes returns an UnknownTypes that counts at most limit distinct media types,
+// counting any others as OtherUnknownType
+func NewUnknownTypes(limit int) *UnknownTypes {
+	return &UnknownTypes{counts: map[string]int{}, limit: limit}
+}
+
+// Record counts a response of the media type, returning the label it was counted under
+func (u *UnknownTypes) Record(mediaType string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.counts[mediaType]; !ok && len(u.counts) >= u.limit {
+		mediaType = OtherUnknownType
+	}
+	u.counts[mediaType]++
+
+	return mediaType
+}
+
+// Counts returns the number of responses of each unknown media type
+func (u *UnknownTypes) Counts() map[string]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return maps.Clone(u.counts)
+}
@@ -24,16 +24,31 @@ type PageFetcher struct {
 	client  *http.Client
 }
 
-func NewPageFetcher(baseUrl string) (*PageFetcher, error) {
+// Option configures optional behaviour of the PageFetcher returned by NewPageFetcher
+type Option func(*PageFetcher)
+
+// WithHTTPClient makes the PageFetcher send requests with the client instead of a default one
+func WithHTTPClient(client *http.Client) Option {
+	return func(pf *PageFetcher) {
+		pf.client = client
+	}
+}
+
+func NewPageFetcher(baseUrl string, opts ...Option) (*PageFetcher, error) {
 	base, err := url.Parse(baseUrl)
 	if err != nil {
 		return nil, fmt.Errorf("invalid base URL: %s", baseUrl)
 	}
 
-	return &PageFetcher{
+	pf := &PageFetcher{
 		baseUrl: base,
 		client:  &http.Client{},
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(pf)
+	}
+
+	return pf, nil
 }
 
 func (pf *PageFetcher) FetchLivePage(path string) (*Page, error) {
@@ -61,6 +61,32 @@ func TestNewPageFetcher(t *testing.T) {
 		_, err := page_fetcher.NewPageFetcher(domain)
 		assert.Error(t, err)
 	})
+
+	t.Run("sends requests with the given HTTP client", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("page"))
+		}))
+		defer server.Close()
+
+		used := false
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			used = true
+			return http.DefaultTransport.RoundTrip(req)
+		})}
+		fetcher, err := page_fetcher.NewPageFetcher(server.URL, page_fetcher.WithHTTPClient(client))
+		assert.NoError(t, err)
+
+		page, err := fetcher.FetchLivePage("/page")
+		assert.NoError(t, err)
+		assert.Equal(t, "page", page.Body)
+		assert.True(t, used, "the HTTP client was not used")
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
 }
 
 func TestFetchLivePage(t *testing.T) {
@@ -0,0 +1,238 @@
+package preflight
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mirrorer/internal/aws_client_interfaces"
+	"mirrorer/internal/config"
+	"mirrorer/internal/credentials"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/antchfx/xmlquery"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TestObjectPrefix is the prefix of the object written to check a bucket can be written to
+const TestObjectPrefix = ".govuk-mirror-preflight/"
+
+// BucketWritable checks that an object can be written to the bucket and deleted again
+func BucketWritable(name string, client aws_client_interfaces.S3PreflightAPI, bucket string, runID string) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) error {
+			key := TestObjectPrefix + runID
+
+			_, err := client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:      aws.String(bucket),
+				Key:         aws.String(key),
+				Body:        bytes.NewReader([]byte(runID)),
+				ContentType: aws.String("text/plain"),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write %s to bucket %s: %w", key, bucket, err)
+			}
+
+			_, err = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to delete %s from bucket %s: %w", key, bucket, err)
+			}
+
+			return nil
+		},
+	}
+}
+
+// GCSBucketWritable checks that an object can be written to the GCS bucket with the JSON API and
+// deleted again. The client is expected to handle authentication, as for the GCS uploader.
+func GCSBucketWritable(name string, client *http.Client, endpoint string, bucket string, runID string) Check {
+	return Check{
+		Name: name,
+		Run: func(ctx context.Context) error {
+			key := TestObjectPrefix + runID
+			endpoint := strings.TrimSuffix(endpoint, "/")
+
+			insertURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=media&name=%s", endpoint, url.PathEscape(bucket), url.QueryEscape(key))
+			if err := gcsRequest(ctx, client, http.MethodPost, insertURL, []byte(runID)); err != nil {
+				return fmt.Errorf("failed to write %s to bucket %s: %w", key, bucket, err)
+			}
+
+			deleteURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", endpoint, url.PathEscape(bucket), url.PathEscape(key))
+			if err := gcsRequest(ctx, client, http.MethodDelete, deleteURL, nil); err != nil {
+				return fmt.Errorf("failed to delete %s from bucket %s: %w", key, bucket, err)
+			}
+
+			return nil
+		},
+	}
+}
+
+// gcsRequest makes a request to the GCS JSON API, returning an error unless it succeeds
+func gcsRequest(ctx context.Context, client *http.Client, method string, rawURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("GCS API responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// PushgatewayReachable checks that the Pushgateway is ready to receive metrics
+func PushgatewayReachable(client *http.Client, pushGatewayURL string) Check {
+	return Check{
+		Name: "pushgateway",
+		Run: func(ctx context.Context) error {
+			if pushGatewayURL == "" {
+				return fmt.Errorf("%w: PROMETHEUS_PUSHGATEWAY_URL is not set", ErrSkipped)
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(pushGatewayURL, "/")+"/-/ready", nil)
+			if err != nil {
+				return err
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				return fmt.Errorf("failed to reach the Pushgateway: %w", err)
+			}
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("the Pushgateway is not ready: %s", resp.Status)
+			}
+			return nil
+		},
+	}
+}
+
+// SitemapParses checks that the sitemap of the site is a sitemap index or URL set
+func SitemapParses(client *http.Client, cfg *config.Config, requestCredentials *credentials.Rules) Check {
+	return Check{
+		Name: "sitemap",
+		Run: func(ctx context.Context) error {
+			if cfg.Site == "" {
+				return fmt.Errorf("%w: SITE is not set", ErrSkipped)
+			}
+
+			sitemapURL, err := SitemapURL(cfg.Site)
+			if err != nil {
+				return err
+			}
+
+			resp, err := siteRequest(ctx, client, cfg, requestCredentials, sitemapURL)
+			if err != nil {
+				return fmt.Errorf("failed to fetch %s: %w", sitemapURL, err)
+			}
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("failed to fetch %s: %s", sitemapURL, resp.Status)
+			}
+
+			doc, err := xmlquery.Parse(resp.Body)
+			if err != nil {
+				return fmt.Errorf("failed to parse %s: %w", sitemapURL, err)
+			}
+			if xmlquery.FindOne(doc, "/sitemapindex|/urlset") == nil {
+				return fmt.Errorf("%s is not a sitemap index or URL set", sitemapURL)
+			}
+			return nil
+		},
+	}
+}
+
+// RateLimitAccepted checks that the site doesn't rate limit the crawler's requests, which
+// carry the rate limit token in HEADERS or the request credentials
+func RateLimitAccepted(client *http.Client, cfg *config.Config, requestCredentials *credentials.Rules) Check {
+	return Check{
+		Name: "rate_limit",
+		Run: func(ctx context.Context) error {
+			if cfg.Site == "" {
+				return fmt.Errorf("%w: SITE is not set", ErrSkipped)
+			}
+
+			resp, err := siteRequest(ctx, client, cfg, requestCredentials, cfg.Site)
+			if err != nil {
+				return fmt.Errorf("failed to fetch %s: %w", cfg.Site, err)
+			}
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			if resp.StatusCode == http.StatusTooManyRequests {
+				return fmt.Errorf("%s rate limited the request, check the rate limit header in HEADERS or REQUEST_CREDENTIALS_FILE", cfg.Site)
+			}
+			return nil
+		},
+	}
+}
+
+// DiskSpace checks that the file system holding dir has at least minFree bytes free
+func DiskSpace(dir string, minFree uint64) Check {
+	return Check{
+		Name: "disk_space",
+		Run: func(ctx context.Context) error {
+			free, err := freeSpace(dir)
+			if err != nil {
+				return err
+			}
+			if free < minFree {
+				return fmt.Errorf("%d bytes free in %s, need at least %d", free, dir, minFree)
+			}
+			return nil
+		},
+	}
+}
+
+// SitemapURL returns the site itself if it is an XML file, and otherwise the sitemap.xml at its root
+func SitemapURL(site string) (string, error) {
+	u, err := url.Parse(site)
+	if err != nil {
+		return "", fmt.Errorf("invalid site %s: %w", site, err)
+	}
+
+	if strings.HasSuffix(u.Path, ".xml") {
+		return u.String(), nil
+	}
+	return u.JoinPath("/sitemap.xml").String(), nil
+}
+
+// siteRequest makes a GET request to the site with the same User-Agent, headers and credentials as the crawler
+func siteRequest(ctx context.Context, client *http.Client, cfg *config.Config, requestCredentials *credentials.Rules, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	for key, value := range cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	requestCredentials.Apply(req.URL, req.Header)
+
+	return client.Do(req)
+}
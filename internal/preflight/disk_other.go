@@ -0,0 +1,9 @@
+//go:build !(linux || darwin)
+
+package preflight
+
+import "fmt"
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, fmt.Errorf("%w: free space can't be checked on this platform", ErrSkipped)
+}
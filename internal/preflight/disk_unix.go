@@ -0,0 +1,17 @@
+//go:build linux || darwin
+
+package preflight
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the file system holding dir
+func freeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get the free space in %s: %w", dir, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,92 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	StatusSkip Status = "skip"
+)
+
+// ErrSkipped is returned, wrapped with the reason, by checks that don't apply to the configuration
+var ErrSkipped = errors.New("skipped")
+
+// Check is a named check run before crawling
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name      string  `json:"name"`
+	Status    Status  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+}
+
+// Report is the outcome of every check, in the order they were given
+type Report struct {
+	Checks []Result `json:"checks"`
+}
+
+// OK reports whether no check failed
+func (r Report) OK() bool {
+	return len(r.Failed()) == 0
+}
+
+// Failed returns the results of the checks that failed
+func (r Report) Failed() []Result {
+	failed := []Result{}
+	for _, result := range r.Checks {
+		if result.Status == StatusFail {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Run runs the checks in parallel, each with the timeout
+func Run(ctx context.Context, timeout time.Duration, checks ...Check) Report {
+	results := make([]Result, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Go(func() {
+			results[i] = run(ctx, timeout, check)
+		})
+	}
+	wg.Wait()
+
+	return Report{Checks: results}
+}
+
+func run(ctx context.Context, timeout time.Duration, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	result := Result{
+		Name:      check.Name,
+		Status:    StatusPass,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	switch {
+	case errors.Is(err, ErrSkipped):
+		result.Status, result.Detail = StatusSkip, err.Error()
+	case err != nil:
+		result.Status, result.Detail = StatusFail, err.Error()
+	}
+
+	return result
+}
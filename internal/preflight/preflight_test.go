@@ -0,0 +1,203 @@
+package preflight
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mirrorer/internal/aws_client_mocks"
+	"mirrorer/internal/config"
+	"mirrorer/internal/credentials"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	checks := []Check{
+		{Name: "pass", Run: func(ctx context.Context) error { return nil }},
+		{Name: "fail", Run: func(ctx context.Context) error { return errors.New("broken") }},
+		{Name: "skip", Run: func(ctx context.Context) error { return fmt.Errorf("%w: not configured", ErrSkipped) }},
+		{Name: "timeout", Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}
+
+	report := Run(context.Background(), 50*time.Millisecond, checks...)
+
+	assert.Len(t, report.Checks, 4)
+	for i, want := range []struct {
+		status Status
+		detail string
+	}{
+		{StatusPass, ""},
+		{StatusFail, "broken"},
+		{StatusSkip, "skipped: not configured"},
+		{StatusFail, "context deadline exceeded"},
+	} {
+		assert.Equal(t, checks[i].Name, report.Checks[i].Name)
+		assert.Equal(t, want.status, report.Checks[i].Status)
+		assert.Equal(t, want.detail, report.Checks[i].Detail)
+	}
+	assert.GreaterOrEqual(t, report.Checks[3].LatencyMS, float64(50))
+
+	assert.False(t, report.OK())
+	assert.Equal(t, []string{"fail", "timeout"}, []string{report.Failed()[0].Name, report.Failed()[1].Name})
+}
+
+func TestBucketWritable(t *testing.T) {
+	t.Run("writes and deletes a test object", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3PreflightAPI{}
+
+		err := BucketWritable("bucket", s3Client, "mirror", "run-1").Run(context.Background())
+		assert.NoError(t, err)
+
+		assert.Equal(t, 1, s3Client.PutObjectCallCount())
+		_, put, _ := s3Client.PutObjectArgsForCall(0)
+		assert.Equal(t, "mirror", aws.ToString(put.Bucket))
+		assert.Equal(t, ".govuk-mirror-preflight/run-1", aws.ToString(put.Key))
+
+		assert.Equal(t, 1, s3Client.DeleteObjectCallCount())
+		_, deleted, _ := s3Client.DeleteObjectArgsForCall(0)
+		assert.Equal(t, ".govuk-mirror-preflight/run-1", aws.ToString(deleted.Key))
+	})
+
+	t.Run("fails if the object can't be written", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3PreflightAPI{}
+		s3Client.PutObjectReturns(nil, errors.New("access denied"))
+
+		err := BucketWritable("bucket", s3Client, "mirror", "run-1").Run(context.Background())
+		assert.ErrorContains(t, err, "failed to write .govuk-mirror-preflight/run-1 to bucket mirror: access denied")
+		assert.Equal(t, 0, s3Client.DeleteObjectCallCount())
+	})
+
+	t.Run("fails if the object can't be deleted", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3PreflightAPI{}
+		s3Client.DeleteObjectReturns(nil, errors.New("access denied"))
+
+		err := BucketWritable("bucket", s3Client, "mirror", "run-1").Run(context.Background())
+		assert.ErrorContains(t, err, "failed to delete")
+	})
+}
+
+func TestGCSBucketWritable(t *testing.T) {
+	t.Run("writes and deletes a test object", func(t *testing.T) {
+		requests := []string{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests = append(requests, r.Method+" "+r.URL.RequestURI())
+			if r.Method == http.MethodDelete {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}))
+		defer server.Close()
+
+		err := GCSBucketWritable("bucket", server.Client(), server.URL+"/", "mirror", "run-1").Run(t.Context())
+		assert.NoError(t, err)
+
+		assert.Equal(t, []string{
+			"POST /upload/storage/v1/b/mirror/o?uploadType=media&name=.govuk-mirror-preflight%2Frun-1",
+			"DELETE /storage/v1/b/mirror/o/.govuk-mirror-preflight%2Frun-1",
+		}, requests)
+	})
+
+	t.Run("fails if the object can't be written", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		err := GCSBucketWritable("bucket", server.Client(), server.URL, "mirror", "run-1").Run(t.Context())
+		assert.ErrorContains(t, err, "failed to write .govuk-mirror-preflight/run-1 to bucket mirror: GCS API responded with 403 Forbidden")
+	})
+}
+
+func TestPushgatewayReachable(t *testing.T) {
+	ready := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/-/ready", r.URL.Path)
+	}))
+	defer ready.Close()
+
+	notReady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer notReady.Close()
+
+	assert.NoError(t, PushgatewayReachable(ready.Client(), ready.URL+"/").Run(context.Background()))
+	assert.ErrorContains(t, PushgatewayReachable(notReady.Client(), notReady.URL).Run(context.Background()), "503 Service Unavailable")
+	assert.ErrorIs(t, PushgatewayReachable(http.DefaultClient, "").Run(context.Background()), ErrSkipped)
+}
+
+func TestSitemapParses(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "sitemap index", path: "/sitemap.xml", status: http.StatusOK, body: `<?xml version="1.0"?><sitemapindex><sitemap><loc>https://example.com/sitemaps/1.xml</loc></sitemap></sitemapindex>`},
+		{name: "URL set", path: "/sitemap.xml", status: http.StatusOK, body: `<?xml version="1.0"?><urlset><url><loc>https://example.com/</loc></url></urlset>`},
+		{name: "not a sitemap", path: "/sitemap.xml", status: http.StatusOK, body: `<?xml version="1.0"?><feed></feed>`, wantErr: "is not a sitemap index or URL set"},
+		{name: "invalid XML", path: "/sitemap.xml", status: http.StatusOK, body: `<urlset><url>`, wantErr: "failed to parse"},
+		{name: "missing", path: "/sitemap.xml", status: http.StatusNotFound, wantErr: "404 Not Found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, tt.path, r.URL.Path)
+				assert.Equal(t, "test-agent", r.Header.Get("User-Agent"))
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			cfg := &config.Config{Site: server.URL, UserAgent: "test-agent"}
+			err := SitemapParses(server.Client(), cfg, &credentials.Rules{}).Run(context.Background())
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimitAccepted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Rate-Limit-Token") != "token" {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	cfg := &config.Config{Site: server.URL, Headers: map[string]string{"Rate-Limit-Token": "token"}}
+	assert.NoError(t, RateLimitAccepted(server.Client(), cfg, &credentials.Rules{}).Run(context.Background()))
+
+	cfg.Headers = map[string]string{}
+	assert.ErrorContains(t, RateLimitAccepted(server.Client(), cfg, &credentials.Rules{}).Run(context.Background()), "rate limited the request")
+}
+
+func TestDiskSpace(t *testing.T) {
+	assert.NoError(t, DiskSpace(t.TempDir(), 1).Run(context.Background()))
+	assert.ErrorContains(t, DiskSpace(t.TempDir(), 1<<62).Run(context.Background()), "need at least")
+}
+
+func TestSitemapURL(t *testing.T) {
+	tests := map[string]string{
+		"https://www.gov.uk":                "https://www.gov.uk/sitemap.xml",
+		"https://www.gov.uk/":               "https://www.gov.uk/sitemap.xml",
+		"https://www.gov.uk/sitemap.xml":    "https://www.gov.uk/sitemap.xml",
+		"https://www.gov.uk/sitemaps/1.xml": "https://www.gov.uk/sitemaps/1.xml",
+	}
+
+	for site, want := range tests {
+		got, err := SitemapURL(site)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, site)
+	}
+}
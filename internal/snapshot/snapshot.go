@@ -0,0 +1,350 @@
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mirrorer/internal/aws_client_interfaces"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+)
+
+// maxDeleteObjects is the most objects S3 deletes in a single DeleteObjects request
+const maxDeleteObjects = 1000
+
+// publishedMarkerSuffix is appended to a snapshot's run ID to form the key of the object marking
+// it as published, which sits beside the snapshot's prefix rather than under it so that it isn't
+// served as part of the snapshot
+const publishedMarkerSuffix = ".published"
+
+// ErrNoSnapshotPublished is returned when the pointer object does not exist yet
+var ErrNoSnapshotPublished = errors.New("no snapshot has been published")
+
+// Pointer is the object that records which snapshot of the mirror is live. The CDN
+// serves objects from under its Prefix.
+type Pointer struct {
+	RunID       string    `json:"run_id"`
+	Prefix      string    `json:"prefix"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// VerificationError is returned when a snapshot is incomplete and must not be published
+type VerificationError struct {
+	RunID   string
+	Failed  []string
+	Missing []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("snapshot %s is incomplete: %d files failed to upload and %d files are missing", e.RunID, len(e.Failed), len(e.Missing))
+}
+
+// Prefix returns the key prefix of the snapshot of a crawl run
+func Prefix(root string, runID string) string {
+	return root + runID + "/"
+}
+
+func markerKey(root string, runID string) string {
+	return root + runID + publishedMarkerSuffix
+}
+
+// Publisher publishes snapshots uploaded under a root prefix by switching the pointer object
+// to them, so that a whole crawl goes live at once. Snapshots are ordered by run ID, which
+// must therefore sort chronologically.
+type Publisher struct {
+	s3         aws_client_interfaces.S3SnapshotAPI
+	bucketName string
+	root       string
+	pointerKey string
+}
+
+func NewPublisher(s3 aws_client_interfaces.S3SnapshotAPI, bucketName string, root string, pointerKey string) *Publisher {
+	return &Publisher{
+		s3:         s3,
+		bucketName: bucketName,
+		root:       root,
+		pointerKey: pointerKey,
+	}
+}
+
+// Verify checks that no file failed to upload and that every uploaded key is present in the bucket
+func (p *Publisher) Verify(ctx context.Context, runID string, uploaded []string, failed []string) error {
+	present := map[string]struct{}{}
+	err := p.listKeys(ctx, Prefix(p.root, runID), func(key string) {
+		present[key] = struct{}{}
+	})
+	if err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for _, key := range uploaded {
+		if _, ok := present[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(failed) > 0 || len(missing) > 0 {
+		return &VerificationError{RunID: runID, Failed: failed, Missing: missing}
+	}
+
+	if len(uploaded) == 0 {
+		return fmt.Errorf("snapshot %s is empty", runID)
+	}
+
+	return nil
+}
+
+// Publish marks the snapshot of the run as published and switches the pointer to it. Only
+// published snapshots are listed, so snapshots of runs that failed verification are never
+// rolled back to.
+func (p *Publisher) Publish(ctx context.Context, runID string) error {
+	body, err := json.Marshal(Pointer{
+		RunID:       runID,
+		Prefix:      Prefix(p.root, runID),
+		PublishedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = p.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(p.bucketName),
+		Key:         aws.String(markerKey(p.root, runID)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write published marker of snapshot %s: %w", runID, err)
+	}
+
+	_, err = p.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(p.bucketName),
+		Key:          aws.String(p.pointerKey),
+		Body:         bytes.NewReader(body),
+		ContentType:  aws.String("application/json"),
+		CacheControl: aws.String("no-cache"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot pointer: %w", err)
+	}
+
+	log.Info().Str("bucket", p.bucketName).Str("run_id", runID).Msg("Published snapshot")
+	return nil
+}
+
+// Current returns the pointer to the live snapshot, or ErrNoSnapshotPublished
+func (p *Publisher) Current(ctx context.Context) (*Pointer, error) {
+	output, err := p.s3.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(p.bucketName),
+		Key:    aws.String(p.pointerKey),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, ErrNoSnapshotPublished
+		}
+		return nil, fmt.Errorf("failed to read snapshot pointer: %w", err)
+	}
+	defer (func() {
+		_ = output.Body.Close()
+	})()
+
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot pointer: %w", err)
+	}
+
+	pointer := &Pointer{}
+	if err := json.Unmarshal(body, pointer); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot pointer: %w", err)
+	}
+
+	return pointer, nil
+}
+
+// List returns the run IDs of the published snapshots in the bucket, oldest first
+func (p *Publisher) List(ctx context.Context) ([]string, error) {
+	_, published, err := p.listRuns(ctx)
+	return published, err
+}
+
+// listRuns returns the run IDs of every snapshot in the bucket and of those that were
+// published, both oldest first
+func (p *Publisher) listRuns(ctx context.Context) (all []string, published []string, err error) {
+	all, published = []string{}, []string{}
+
+	paginator := s3.NewListObjectsV2Paginator(p.s3, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(p.bucketName),
+		Prefix:    aws.String(p.root),
+		Delimiter: aws.String("/"),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list snapshots in bucket %s: %w", p.bucketName, err)
+		}
+
+		for _, prefix := range page.CommonPrefixes {
+			runID := strings.TrimSuffix(strings.TrimPrefix(aws.ToString(prefix.Prefix), p.root), "/")
+			all = append(all, runID)
+		}
+
+		for _, object := range page.Contents {
+			if runID, ok := strings.CutSuffix(strings.TrimPrefix(aws.ToString(object.Key), p.root), publishedMarkerSuffix); ok {
+				published = append(published, runID)
+			}
+		}
+	}
+
+	slices.Sort(all)
+	slices.Sort(published)
+	return all, published, nil
+}
+
+// Rollback switches the pointer to an earlier snapshot, which must be one of the retained published snapshots
+func (p *Publisher) Rollback(ctx context.Context, runID string) error {
+	if err := p.CheckRetained(ctx, runID); err != nil {
+		return err
+	}
+
+	return p.Publish(ctx, runID)
+}
+
+// CheckRetained returns an error unless the snapshot of the run is one of the retained published
+// snapshots, so that it can be rolled back to
+func (p *Publisher) CheckRetained(ctx context.Context, runID string) error {
+	runIDs, err := p.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(runIDs, runID) {
+		return fmt.Errorf("snapshot %s is not retained in bucket %s", runID, p.bucketName)
+	}
+
+	return nil
+}
+
+// Previous returns the run ID of the newest published snapshot older than the live one
+func (p *Publisher) Previous(ctx context.Context) (string, error) {
+	current, err := p.Current(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	runIDs, err := p.List(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, runID := range slices.Backward(runIDs) {
+		if runID < current.RunID {
+			return runID, nil
+		}
+	}
+
+	return "", fmt.Errorf("no snapshot older than %s is retained in bucket %s", current.RunID, p.bucketName)
+}
+
+// CollectGarbage deletes every published snapshot except the newest retain published snapshots
+// and the live one, along with unpublished snapshots older than the newest published one, as
+// those are of runs that failed verification. Newer unpublished snapshots may still be uploading,
+// so they are left alone. It returns the run IDs of the deleted snapshots.
+func (p *Publisher) CollectGarbage(ctx context.Context, retain int) ([]string, error) {
+	all, published, err := p.listRuns(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := p.Current(ctx)
+	if err != nil && !errors.Is(err, ErrNoSnapshotPublished) {
+		return nil, err
+	}
+
+	if len(published) == 0 {
+		return []string{}, nil
+	}
+
+	kept := map[string]bool{}
+	for _, runID := range published[max(len(published)-retain, 0):] {
+		kept[runID] = true
+	}
+	if current != nil {
+		kept[current.RunID] = true
+	}
+	newestPublished := published[len(published)-1]
+
+	deleted := []string{}
+	for _, runID := range all {
+		if kept[runID] || runID > newestPublished {
+			continue
+		}
+
+		if err := p.deleteSnapshot(ctx, runID); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, runID)
+	}
+
+	return deleted, nil
+}
+
+// deleteSnapshot deletes the objects of a snapshot and its published marker, which is deleted in
+// the last batch so that a snapshot that was only partly deleted is still listed
+func (p *Publisher) deleteSnapshot(ctx context.Context, runID string) error {
+	objects := []types.ObjectIdentifier{}
+	err := p.listKeys(ctx, Prefix(p.root, runID), func(key string) {
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+	})
+	if err != nil {
+		return err
+	}
+	objects = append(objects, types.ObjectIdentifier{Key: aws.String(markerKey(p.root, runID))})
+
+	for batch := range slices.Chunk(objects, maxDeleteObjects) {
+		output, err := p.s3.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(p.bucketName),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %w", runID, err)
+		}
+		if len(output.Errors) > 0 {
+			return fmt.Errorf("failed to delete %d objects of snapshot %s: %s", len(output.Errors), runID, aws.ToString(output.Errors[0].Message))
+		}
+	}
+
+	log.Info().Str("bucket", p.bucketName).Str("run_id", runID).Int("objects", len(objects)).Msg("Deleted snapshot")
+	return nil
+}
+
+func (p *Publisher) listKeys(ctx context.Context, prefix string, fn func(key string)) error {
+	paginator := s3.NewListObjectsV2Paginator(p.s3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(p.bucketName),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list objects under %s in bucket %s: %w", prefix, p.bucketName, err)
+		}
+
+		for _, object := range page.Contents {
+			fn(aws.ToString(object.Key))
+		}
+	}
+
+	return nil
+}
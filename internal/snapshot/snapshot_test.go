@@ -0,0 +1,229 @@
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mirrorer/internal/aws_client_mocks"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBucket makes the fake S3 client behave like a bucket holding the given keys
+func fakeBucket(keys []string, currentRunID string) *aws_client_mocks.FakeS3SnapshotAPI {
+	s3Client := &aws_client_mocks.FakeS3SnapshotAPI{}
+
+	s3Client.ListObjectsV2Stub = func(ctx context.Context, input *s3.ListObjectsV2Input, f ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		output := &s3.ListObjectsV2Output{}
+		seenPrefixes := map[string]bool{}
+
+		for _, key := range keys {
+			rest, ok := strings.CutPrefix(key, aws.ToString(input.Prefix))
+			if !ok {
+				continue
+			}
+
+			if delimiter := aws.ToString(input.Delimiter); delimiter != "" {
+				if before, _, found := strings.Cut(rest, delimiter); found {
+					prefix := aws.ToString(input.Prefix) + before + delimiter
+					if !seenPrefixes[prefix] {
+						seenPrefixes[prefix] = true
+						output.CommonPrefixes = append(output.CommonPrefixes, types.CommonPrefix{Prefix: aws.String(prefix)})
+					}
+					continue
+				}
+			}
+
+			output.Contents = append(output.Contents, types.Object{Key: aws.String(key)})
+		}
+
+		return output, nil
+	}
+
+	s3Client.GetObjectStub = func(ctx context.Context, input *s3.GetObjectInput, f ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if currentRunID == "" {
+			return nil, &types.NoSuchKey{}
+		}
+		body, _ := json.Marshal(Pointer{RunID: currentRunID, Prefix: Prefix("snapshots/", currentRunID)})
+		return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(string(body)))}, nil
+	}
+
+	s3Client.DeleteObjectsReturns(&s3.DeleteObjectsOutput{}, nil)
+
+	return s3Client
+}
+
+var bucketKeys = []string{
+	"current.json",
+	"snapshots/20260101T000000Z.published",
+	"snapshots/20260101T000000Z/www.gov.uk/index.html",
+	"snapshots/20260102T000000Z.published",
+	"snapshots/20260102T000000Z/www.gov.uk/index.html",
+	"snapshots/20260103T000000Z.published",
+	"snapshots/20260103T000000Z/www.gov.uk/index.html",
+	"snapshots/20260103T000000Z/www.gov.uk/guidance.html",
+}
+
+// bucketKeysWithFailedRun has a run that failed verification, and so was never published,
+// between two published snapshots, and a newer run that is still uploading
+var bucketKeysWithFailedRun = []string{
+	"current.json",
+	"snapshots/20260101T000000Z.published",
+	"snapshots/20260101T000000Z/www.gov.uk/index.html",
+	"snapshots/20260102T000000Z/www.gov.uk/index.html",
+	"snapshots/20260103T000000Z.published",
+	"snapshots/20260103T000000Z/www.gov.uk/index.html",
+	"snapshots/20260104T000000Z/www.gov.uk/index.html",
+}
+
+func TestPublisher(t *testing.T) {
+	t.Run("Verify passes when every uploaded key is present", func(t *testing.T) {
+		publisher := NewPublisher(fakeBucket(bucketKeys, ""), "test-bucket", "snapshots/", "current.json")
+
+		err := publisher.Verify(t.Context(), "20260103T000000Z", []string{
+			"snapshots/20260103T000000Z/www.gov.uk/index.html",
+			"snapshots/20260103T000000Z/www.gov.uk/guidance.html",
+		}, nil)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Verify fails when files are missing or failed to upload", func(t *testing.T) {
+		publisher := NewPublisher(fakeBucket(bucketKeys, ""), "test-bucket", "snapshots/", "current.json")
+
+		err := publisher.Verify(t.Context(), "20260103T000000Z", []string{
+			"snapshots/20260103T000000Z/www.gov.uk/index.html",
+			"snapshots/20260103T000000Z/www.gov.uk/missing.html",
+		}, []string{"snapshots/20260103T000000Z/www.gov.uk/failed.html"})
+
+		var verificationErr *VerificationError
+		assert.ErrorAs(t, err, &verificationErr)
+		assert.Equal(t, []string{"snapshots/20260103T000000Z/www.gov.uk/missing.html"}, verificationErr.Missing)
+		assert.Equal(t, []string{"snapshots/20260103T000000Z/www.gov.uk/failed.html"}, verificationErr.Failed)
+	})
+
+	t.Run("Verify fails when nothing was uploaded", func(t *testing.T) {
+		publisher := NewPublisher(fakeBucket(bucketKeys, ""), "test-bucket", "snapshots/", "current.json")
+
+		err := publisher.Verify(t.Context(), "20260104T000000Z", nil, nil)
+		assert.ErrorContains(t, err, "snapshot 20260104T000000Z is empty")
+	})
+
+	t.Run("Publish marks the snapshot as published and writes the pointer", func(t *testing.T) {
+		s3Client := fakeBucket(bucketKeys, "")
+		publisher := NewPublisher(s3Client, "test-bucket", "snapshots/", "current.json")
+
+		err := publisher.Publish(t.Context(), "20260103T000000Z")
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, s3Client.PutObjectCallCount())
+		_, markerInput, _ := s3Client.PutObjectArgsForCall(0)
+		assert.Equal(t, aws.String("snapshots/20260103T000000Z.published"), markerInput.Key)
+
+		_, input, _ := s3Client.PutObjectArgsForCall(1)
+		assert.Equal(t, aws.String("current.json"), input.Key)
+		assert.Equal(t, aws.String("no-cache"), input.CacheControl)
+
+		body, err := io.ReadAll(input.Body)
+		assert.NoError(t, err)
+		pointer := Pointer{}
+		assert.NoError(t, json.Unmarshal(body, &pointer))
+		assert.Equal(t, "20260103T000000Z", pointer.RunID)
+		assert.Equal(t, "snapshots/20260103T000000Z/", pointer.Prefix)
+	})
+
+	t.Run("Current returns ErrNoSnapshotPublished when there is no pointer", func(t *testing.T) {
+		publisher := NewPublisher(fakeBucket(bucketKeys, ""), "test-bucket", "snapshots/", "current.json")
+
+		_, err := publisher.Current(t.Context())
+		assert.ErrorIs(t, err, ErrNoSnapshotPublished)
+	})
+
+	t.Run("List returns the snapshots oldest first", func(t *testing.T) {
+		publisher := NewPublisher(fakeBucket(bucketKeys, ""), "test-bucket", "snapshots/", "current.json")
+
+		runIDs, err := publisher.List(t.Context())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"20260101T000000Z", "20260102T000000Z", "20260103T000000Z"}, runIDs)
+	})
+
+	t.Run("Previous returns the snapshot before the live one", func(t *testing.T) {
+		publisher := NewPublisher(fakeBucket(bucketKeys, "20260103T000000Z"), "test-bucket", "snapshots/", "current.json")
+
+		runID, err := publisher.Previous(t.Context())
+		assert.NoError(t, err)
+		assert.Equal(t, "20260102T000000Z", runID)
+	})
+
+	t.Run("Rollback re-points to a retained snapshot", func(t *testing.T) {
+		s3Client := fakeBucket(bucketKeys, "20260103T000000Z")
+		publisher := NewPublisher(s3Client, "test-bucket", "snapshots/", "current.json")
+
+		err := publisher.Rollback(t.Context(), "20260101T000000Z")
+		assert.NoError(t, err)
+		_, input, _ := s3Client.PutObjectArgsForCall(s3Client.PutObjectCallCount() - 1)
+		assert.Equal(t, aws.String("current.json"), input.Key)
+	})
+
+	t.Run("Rollback refuses a snapshot that is not retained", func(t *testing.T) {
+		s3Client := fakeBucket(bucketKeys, "20260103T000000Z")
+		publisher := NewPublisher(s3Client, "test-bucket", "snapshots/", "current.json")
+
+		err := publisher.Rollback(t.Context(), "20251231T000000Z")
+		assert.ErrorContains(t, err, "snapshot 20251231T000000Z is not retained")
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+	})
+
+	t.Run("CollectGarbage deletes all but the newest snapshots, keeping the live one", func(t *testing.T) {
+		// the live snapshot was rolled back to the oldest one
+		s3Client := fakeBucket(bucketKeys, "20260101T000000Z")
+		publisher := NewPublisher(s3Client, "test-bucket", "snapshots/", "current.json")
+
+		deleted, err := publisher.CollectGarbage(t.Context(), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"20260102T000000Z"}, deleted)
+
+		assert.Equal(t, 1, s3Client.DeleteObjectsCallCount())
+		_, input, _ := s3Client.DeleteObjectsArgsForCall(0)
+		assert.Equal(t, []types.ObjectIdentifier{
+			{Key: aws.String("snapshots/20260102T000000Z/www.gov.uk/index.html")},
+			{Key: aws.String("snapshots/20260102T000000Z.published")},
+		}, input.Delete.Objects)
+	})
+
+	t.Run("only considers published snapshots when a run failed verification", func(t *testing.T) {
+		s3Client := fakeBucket(bucketKeysWithFailedRun, "20260103T000000Z")
+		publisher := NewPublisher(s3Client, "test-bucket", "snapshots/", "current.json")
+
+		runIDs, err := publisher.List(t.Context())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"20260101T000000Z", "20260103T000000Z"}, runIDs)
+
+		previous, err := publisher.Previous(t.Context())
+		assert.NoError(t, err)
+		assert.Equal(t, "20260101T000000Z", previous)
+
+		err = publisher.Rollback(t.Context(), "20260102T000000Z")
+		assert.ErrorContains(t, err, "snapshot 20260102T000000Z is not retained")
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+
+		// the failed run is deleted, but not the run that is still uploading
+		deleted, err := publisher.CollectGarbage(t.Context(), 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"20260102T000000Z"}, deleted)
+	})
+
+	t.Run("CollectGarbage returns an error if objects could not be deleted", func(t *testing.T) {
+		s3Client := fakeBucket(bucketKeys, "20260103T000000Z")
+		s3Client.DeleteObjectsReturns(nil, errors.New("access denied"))
+		publisher := NewPublisher(s3Client, "test-bucket", "snapshots/", "current.json")
+
+		_, err := publisher.CollectGarbage(t.Context(), 1)
+		assert.ErrorContains(t, err, "access denied")
+	})
+}
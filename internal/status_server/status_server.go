@@ -0,0 +1,41 @@
+package status_server
+
+import (
+	"encoding/json"
+	"mirrorer/internal/crawler"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// NewHandler returns the handler of the crawler's status server, which serves the metrics of
+// the registry at /metrics, the crawl's progress at /progress and a health check at /healthz
+func NewHandler(reg *prometheus.Registry, progress *crawler.Progress) http.Handler {
+	mux := http.NewServeMux()
+	// the handler's own metrics aren't registered, so that they aren't pushed with the crawler's
+	mux.Handle("GET /metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", healthz)
+	mux.HandleFunc("GET /progress", progressHandler(progress))
+	return mux
+}
+
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func progressHandler(progress *crawler.Progress) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.MarshalIndent(progress.Report(), "", "  ")
+		if err != nil {
+			log.Error().Err(err).Msg("Error encoding the crawl's progress")
+			http.Error(w, "error encoding the progress", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(append(body, '\n'))
+	}
+}
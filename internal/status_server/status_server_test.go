@@ -0,0 +1,75 @@
+package status_server
+
+import (
+	"encoding/json"
+	"io"
+	"mirrorer/internal/crawler"
+	"mirrorer/internal/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHandler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := metrics.NewMetrics(reg)
+	metrics.CrawledPagesCounter(m)
+
+	server := httptest.NewServer(NewHandler(reg, crawler.NewProgress()))
+	defer server.Close()
+
+	get := func(t *testing.T, path string) (*http.Response, string) {
+		resp, err := http.Get(server.URL + path)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, string(body)
+	}
+
+	t.Run("metrics are served from the registry", func(t *testing.T) {
+		resp, body := get(t, "/metrics")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, body, `govuk_mirror_crawled_pages_total{host="unknown"} 1`)
+		assert.NotContains(t, body, "promhttp_metric_handler_errors_total")
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		resp, body := get(t, "/healthz")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "ok\n", body)
+	})
+
+	t.Run("progress is served as JSON", func(t *testing.T) {
+		resp, body := get(t, "/progress")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var report map[string]any
+		assert.NoError(t, json.Unmarshal([]byte(body), &report))
+		assert.ElementsMatch(t, []string{"start_time", "discovered", "visited", "queued", "failed", "skipped", "rate", "eta"}, keys(report))
+		assert.Equal(t, float64(0), report["queued"])
+		assert.Nil(t, report["eta"])
+	})
+
+	t.Run("other paths are not found", func(t *testing.T) {
+		resp, _ := get(t, "/status")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func keys(m map[string]any) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
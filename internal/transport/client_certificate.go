@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// clientCertificate is the certificate presented to servers that ask for one, loaded from
+// CLIENT_CERT and CLIENT_KEY and reloaded when either file changes, so that rotated
+// certificates are used without restarting
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	// failedModTimes are the modification times of the files that last failed to reload, so that
+	// the failure is only logged once for each change to the files rather than at every handshake
+	failedModTimes *[2]time.Time
+}
+
+// newClientCertificate loads the certificate and key, returning an error if they can't be used
+func newClientCertificate(certFile string, keyFile string) (*clientCertificate, error) {
+	c := &clientCertificate{certFile: certFile, keyFile: keyFile}
+
+	modTimes, err := c.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTimes); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// get returns the certificate for a TLS handshake, first reloading it if the files have changed.
+// If the new files can't be loaded, such as when only one of them has been replaced so far, the
+// previous certificate is kept and loading is tried again at the next handshake. The failure is
+// logged once until the files change again.
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTimes, err := c.stat()
+	if err == nil && modTimes != c.modTimes {
+		err = c.load(modTimes)
+	}
+
+	switch {
+	case err == nil:
+		c.failedModTimes = nil
+	case c.failedModTimes == nil || *c.failedModTimes != modTimes:
+		log.Warn().Err(err).Msg("Failed to reload client certificate, keeping the previous one")
+		c.failedModTimes = &modTimes
+	}
+
+	return c.cert, nil
+}
+
+// load reads the certificate and key, recording the modification times of the files read
+func (c *clientCertificate) load(modTimes [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate %s and key %s: %w", c.certFile, c.keyFile, err)
+	}
+
+	c.cert = &cert
+	c.modTimes = modTimes
+	return nil
+}
+
+// stat returns the modification times of the certificate and key files
+func (c *clientCertificate) stat() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
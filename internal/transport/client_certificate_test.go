@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA issues client certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	return &testCA{cert: cert, key: key}
+}
+
+// writeClientCertificate issues a client certificate for the common name, writing it and its key
+// to the PEM files
+func (ca *testCA) writeClientCertificate(t *testing.T, commonName string, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+// newMutualTLSServer starts a server that requires a client certificate issued by the CA, and
+// responds with the certificate's common name
+func newMutualTLSServer(ca *testCA) *httptest.Server {
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	return server
+}
+
+func TestNewClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	server := newMutualTLSServer(ca)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	ca.writeClientCertificate(t, "mirror", certFile, keyFile)
+
+	cfg := defaultHTTPConfig()
+	cfg.ConnectTo = []string{"example.com:443:" + serverURL.Host}
+	cfg.CABundle = writeCABundle(t, server)
+
+	t.Run("the server rejects requests without a client certificate", func(t *testing.T) {
+		transport, err := New(cfg)
+		assert.NoError(t, err)
+
+		_, err = (&http.Client{Transport: transport}).Get("https://example.com/")
+		assert.Error(t, err)
+	})
+
+	t.Run("the client certificate is presented and reloaded when rotated", func(t *testing.T) {
+		cfg := cfg
+		cfg.ClientCert, cfg.ClientKey = certFile, keyFile
+		transport, err := New(cfg)
+		assert.NoError(t, err)
+		client := &http.Client{Transport: transport}
+
+		assert.Equal(t, "mirror", get(t, client, "https://example.com/"))
+
+		ca.writeClientCertificate(t, "mirror-rotated", certFile, keyFile)
+		// make sure the rotation is seen, however coarse the file system's modification times
+		later := time.Now().Add(time.Minute)
+		assert.NoError(t, os.Chtimes(certFile, later, later))
+		assert.NoError(t, os.Chtimes(keyFile, later, later))
+		transport.CloseIdleConnections()
+
+		assert.Equal(t, "mirror-rotated", get(t, client, "https://example.com/"))
+	})
+
+	t.Run("the previous certificate is kept until the new one can be loaded", func(t *testing.T) {
+		certFile, keyFile := filepath.Join(dir, "kept.pem"), filepath.Join(dir, "kept-key.pem")
+		ca.writeClientCertificate(t, "mirror", certFile, keyFile)
+
+		cfg := cfg
+		cfg.ClientCert, cfg.ClientKey = certFile, keyFile
+		transport, err := New(cfg)
+		assert.NoError(t, err)
+		client := &http.Client{Transport: transport}
+
+		// only the certificate has been replaced, so it doesn't match the key
+		otherKeyFile := filepath.Join(dir, "other-key.pem")
+		ca.writeClientCertificate(t, "mirror-rotated", certFile, otherKeyFile)
+		later := time.Now().Add(time.Minute)
+		assert.NoError(t, os.Chtimes(certFile, later, later))
+		transport.CloseIdleConnections()
+
+		assert.Equal(t, "mirror", get(t, client, "https://example.com/"))
+	})
+
+	t.Run("an invalid certificate is reported", func(t *testing.T) {
+		cfg := cfg
+		cfg.ClientCert, cfg.ClientKey = certFile, filepath.Join(dir, "missing-key.pem")
+
+		_, err := New(cfg)
+		assert.ErrorContains(t, err, "failed to read client certificate")
+	})
+}
+
+func TestClientCertificateReloadFailureIsLoggedOncePerChange(t *testing.T) {
+	var logs bytes.Buffer
+	previousLogger := log.Logger
+	log.Logger = zerolog.New(&logs)
+	t.Cleanup(func() { log.Logger = previousLogger })
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem")
+	ca.writeClientCertificate(t, "mirror", certFile, keyFile)
+
+	c, err := newClientCertificate(certFile, keyFile)
+	assert.NoError(t, err)
+
+	// only the certificate has been replaced, so it doesn't match the key
+	ca.writeClientCertificate(t, "mirror-rotated", certFile, filepath.Join(dir, "other-key.pem"))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+
+	for range 3 {
+		_, err := c.get(nil)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, strings.Count(logs.String(), "Failed to reload client certificate"))
+
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	_, err = c.get(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(logs.String(), "Failed to reload client certificate"))
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// hostPort is a host and port, either of which is empty to match any in a connect-to override
+type hostPort struct {
+	host string
+	port string
+}
+
+// connectTo sends connections for a host and port to another host and port, like curl --connect-to
+type connectTo struct {
+	from hostPort
+	to   hostPort
+}
+
+// overrides changes the address connections are made to, keeping the Host header and the
+// TLS server name of the requests sent over them
+type overrides struct {
+	resolve   map[hostPort]string
+	connectTo []connectTo
+}
+
+// parseOverrides parses RESOLVE entries of the form host:port:address, like curl --resolve, and
+// CONNECT_TO entries of the form host:port:connect-host:connect-port, like curl --connect-to.
+// IPv6 addresses are written in square brackets. Every invalid entry is reported.
+func parseOverrides(resolve []string, connects []string) (*overrides, error) {
+	o := &overrides{resolve: map[hostPort]string{}}
+	var errs []error
+
+	for _, entry := range resolve {
+		host, port, address, err := splitOverride(entry)
+		if err != nil || host == "" || port == "" || address == "" {
+			errs = append(errs, fmt.Errorf("invalid RESOLVE entry %q, expected host:port:address", entry))
+			continue
+		}
+		address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		if net.ParseIP(address) == nil {
+			errs = append(errs, fmt.Errorf("invalid RESOLVE entry %q, %s is not an IP address", entry, address))
+			continue
+		}
+		o.resolve[hostPort{strings.ToLower(host), port}] = address
+	}
+
+	for _, entry := range connects {
+		host, port, target, err := splitOverride(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CONNECT_TO entry %q, expected host:port:connect-host:connect-port", entry))
+			continue
+		}
+		toHost, toPort, err := net.SplitHostPort(target)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid CONNECT_TO entry %q, expected host:port:connect-host:connect-port", entry))
+			continue
+		}
+		o.connectTo = append(o.connectTo, connectTo{
+			from: hostPort{strings.ToLower(host), port},
+			to:   hostPort{toHost, toPort},
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return o, nil
+}
+
+// splitOverride splits an override into the host and port it applies to, and the rest
+func splitOverride(entry string) (string, string, string, error) {
+	host, rest, ok := strings.Cut(entry, ":")
+	if !ok {
+		return "", "", "", errors.New("missing port")
+	}
+	port, rest, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", "", "", errors.New("missing address")
+	}
+	return host, port, rest, nil
+}
+
+// address returns the address to connect to for the address a request would be sent to.
+// Connect-to overrides are applied first, then resolve overrides to the host connected to.
+func (o *overrides) address(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	host = strings.ToLower(host)
+
+	for _, c := range o.connectTo {
+		if (c.from.host == "" || c.from.host == host) && (c.from.port == "" || c.from.port == port) {
+			if c.to.host != "" {
+				host = strings.ToLower(c.to.host)
+			}
+			if c.to.port != "" {
+				port = c.to.port
+			}
+			break
+		}
+	}
+
+	if ip, ok := o.resolve[hostPort{host, port}]; ok {
+		host = ip
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// dialContext wraps dial so that connections are made to the overridden addresses
+func (o *overrides) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		target, err := o.address(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, network, target)
+	}
+}
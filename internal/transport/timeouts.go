@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mirrorer/internal/config"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrTimeout is returned, wrapped with the time limit, by requests that take longer than their timeout
+var ErrTimeout = errors.New("request timed out")
+
+// timeouts limits the time taken by each request, including reading the response body, to the
+// timeout for the content type of the response, or to the default timeout if there is none.
+// This lets large downloads such as videos take longer than pages.
+type timeouts struct {
+	next          http.RoundTripper
+	timeout       time.Duration
+	byContentType map[string]time.Duration
+}
+
+// WithTimeouts wraps the transport to time out requests after HTTP_TIMEOUT, or after the timeout
+// in HTTP_CONTENT_TYPE_TIMEOUTS for the content type of the response. Zero means no time limit.
+// The time limit includes reading the response body, as with http.Client.Timeout, which should
+// not also be set.
+func WithTimeouts(next http.RoundTripper, cfg config.HTTPConfig) http.RoundTripper {
+	if cfg.HTTPTimeout == 0 && len(cfg.HTTPContentTypeTimeouts) == 0 {
+		return next
+	}
+
+	byContentType := map[string]time.Duration{}
+	for contentType, timeout := range cfg.HTTPContentTypeTimeouts {
+		byContentType[strings.ToLower(contentType)] = timeout
+	}
+
+	return &timeouts{next: next, timeout: cfg.HTTPTimeout, byContentType: byContentType}
+}
+
+func (t *timeouts) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	ctx, cancel := context.WithCancelCause(req.Context())
+
+	// the default timeout applies until the content type of the response is known
+	var timer *time.Timer
+	if t.timeout > 0 {
+		timer = afterTimeout(t.timeout, t.timeout, cancel)
+	}
+	stop := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		cancel(nil)
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		stop()
+		return nil, timeoutCause(ctx, err)
+	}
+
+	if timeout, ok := t.contentTypeTimeout(resp.Header.Get("Content-Type")); ok {
+		if timer == nil || timer.Stop() {
+			timer = afterTimeout(timeout-time.Since(start), timeout, cancel)
+		}
+	}
+
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, ctx: ctx, stop: stop}
+	return resp, nil
+}
+
+// contentTypeTimeout returns the timeout for the content type, or for its type with any subtype
+func (t *timeouts) contentTypeTimeout(contentType string) (time.Duration, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, false
+	}
+
+	if timeout, ok := t.byContentType[mediaType]; ok {
+		return timeout, true
+	}
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	timeout, ok := t.byContentType[mainType+"/*"]
+	return timeout, ok
+}
+
+// afterTimeout cancels the request with ErrTimeout after d, reporting the request's time limit
+func afterTimeout(d time.Duration, limit time.Duration, cancel context.CancelCauseFunc) *time.Timer {
+	return time.AfterFunc(d, func() {
+		cancel(fmt.Errorf("%w after %s", ErrTimeout, limit))
+	})
+}
+
+// timeoutCause returns the timeout that cancelled the request in place of the error it caused
+func timeoutCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, ErrTimeout) {
+		return cause
+	}
+	return err
+}
+
+// timeoutBody is a response body that stops the request's timer when it is closed
+type timeoutBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	stop func()
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = timeoutCause(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
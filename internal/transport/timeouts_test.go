@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"io"
+	"mirrorer/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithTimeouts(t *testing.T) {
+	// the server sends the headers straight away, then the body after a delay
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: WithTimeouts(http.DefaultTransport, config.HTTPConfig{
+		HTTPTimeout: 50 * time.Millisecond,
+		HTTPContentTypeTimeouts: map[string]time.Duration{
+			"application/pdf": 5 * time.Second,
+			"video/*":         5 * time.Second,
+		},
+	})}
+
+	read := func(contentType string) (string, error) {
+		resp, err := client.Get(server.URL + "/?type=" + url.QueryEscape(contentType))
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		timedOut    bool
+	}{
+		{name: "the default timeout applies to other content types", contentType: "text/html", timedOut: true},
+		{name: "content types can take longer", contentType: "application/pdf"},
+		{name: "content types are matched without parameters or case", contentType: "Application/PDF; name=report.pdf"},
+		{name: "a type can be given with any subtype", contentType: "video/mp4"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, err := read(test.contentType)
+			if test.timedOut {
+				assert.ErrorIs(t, err, ErrTimeout)
+				assert.ErrorContains(t, err, "request timed out after 50ms")
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "body", body)
+			}
+		})
+	}
+}
+
+func TestWithTimeoutsBeforeResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: WithTimeouts(http.DefaultTransport, config.HTTPConfig{HTTPTimeout: 50 * time.Millisecond})}
+
+	_, err := client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrTimeout)
+}
+
+func TestWithTimeoutsDisabled(t *testing.T) {
+	assert.Equal(t, http.DefaultTransport, WithTimeouts(http.DefaultTransport, config.HTTPConfig{}))
+}
@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"io"
+	"mirrorer/internal/metrics"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// tracing records each response, its latency and size, whether its request reused a pooled
+// connection, and how long DNS lookups took
+type tracing struct {
+	next http.RoundTripper
+	m    *metrics.Metrics
+}
+
+// WithMetrics wraps the transport to record responses, connection reuse and DNS lookup times in the metrics
+func WithMetrics(next http.RoundTripper, m *metrics.Metrics) http.RoundTripper {
+	return &tracing{next: next, m: m}
+}
+
+func (t *tracing) RoundTrip(req *http.Request) (*http.Response, error) {
+	var dnsStart time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			metrics.HTTPConnection(t.m, info.Reused)
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			metrics.DNSLookupDuration(t.m, time.Since(dnsStart))
+		},
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.ResponseReceived(t.m, req.URL.Hostname(), resp.StatusCode, resp.Header.Get("Content-Type"), time.Since(start))
+	resp.Body = &countingBody{ReadCloser: resp.Body, m: t.m}
+	return resp, nil
+}
+
+// countingBody is a response body that records the number of bytes read from it when it is closed
+type countingBody struct {
+	io.ReadCloser
+	m    *metrics.Metrics
+	size int64
+	once sync.Once
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	b.once.Do(func() {
+		metrics.ResponseSize(b.m, b.size)
+	})
+	return b.ReadCloser.Close()
+}
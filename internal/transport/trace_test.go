@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"mirrorer/internal/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("body"))
+	}))
+	defer server.Close()
+
+	m := metrics.NewMetrics(prometheus.NewRegistry())
+	transport, err := New(defaultHTTPConfig())
+	assert.NoError(t, err)
+	client := &http.Client{Transport: WithMetrics(transport, m)}
+
+	// the second and third requests reuse the connection of the first
+	for range 3 {
+		get(t, client, server.URL)
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.HTTPConnections().WithLabelValues("false")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.HTTPConnections().WithLabelValues("true")))
+
+	// the test server is reached by IP address, so there is no DNS lookup
+	assert.Equal(t, 1, testutil.CollectAndCount(m.DNSLookupDuration()))
+
+	// the responses are labelled by the server's host, without its port
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.ResponseCounter().WithLabelValues("2xx", "127.0.0.1", "text/plain")))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.ResponseDuration()))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.ResponseSize()))
+}
@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"mirrorer/internal/config"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// New returns the transport for requests to the crawled site. It connects to the addresses set by
+// RESOLVE and CONNECT_TO, goes through PROXY_URL if it is set, and trusts the certificates in
+// CA_BUNDLE as well as the system's. Servers that ask for a client certificate are given the
+// one in CLIENT_CERT and CLIENT_KEY. Its connection pool, HTTP/2 support and timeouts are set by
+// the HTTP_ settings. Every invalid setting is reported.
+func New(cfg config.HTTPConfig) (*http.Transport, error) {
+	var errs []error
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = cfg.HTTPMaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.HTTPMaxIdleConnsPerHost
+	t.MaxConnsPerHost = cfg.HTTPMaxConnsPerHost
+	t.IdleConnTimeout = cfg.HTTPIdleConnTimeout
+	t.TLSHandshakeTimeout = cfg.HTTPTLSHandshakeTimeout
+	t.ResponseHeaderTimeout = cfg.HTTPResponseHeaderTimeout
+	if !cfg.HTTP2 {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP1(true)
+	}
+
+	o, err := parseOverrides(cfg.Resolve, cfg.ConnectTo)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+		t.DialContext = o.dialContext(dialer.DialContext)
+	}
+
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			errs = append(errs, fmt.Errorf("PROXY_URL must be an absolute URL, got %q", cfg.ProxyURL))
+		} else {
+			t.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.CABundle != "" {
+		rootCAs, err := loadCABundle(cfg.CABundle)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			tlsConfig.RootCAs = rootCAs
+			t.TLSClientConfig = tlsConfig
+		}
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		clientCert, err := newClientCertificate(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			tlsConfig.GetClientCertificate = clientCert.get
+			t.TLSClientConfig = tlsConfig
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return t, nil
+}
+
+// NewClient returns a client for requests to the site, sending them with the transport returned
+// by New and timing them out with HTTP_TIMEOUT and HTTP_CONTENT_TYPE_TIMEOUTS
+func NewClient(cfg config.HTTPConfig) (*http.Client, error) {
+	t, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: WithTimeouts(t, cfg)}, nil
+}
+
+// loadCABundle returns the system's certificate pool with the certificates in the PEM file added
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", path, err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"encoding/pem"
+	"io"
+	"mirrorer/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCABundle writes the certificate of the test server to a PEM file, returning its path
+func writeCABundle(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(path, bundle, 0600))
+	return path
+}
+
+// defaultHTTPConfig returns the HTTP settings given by their defaults
+func defaultHTTPConfig() config.HTTPConfig {
+	return config.HTTPConfig{
+		HTTPTimeout:             60 * time.Second,
+		HTTPMaxIdleConns:        100,
+		HTTPMaxIdleConnsPerHost: 10,
+		HTTPIdleConnTimeout:     90 * time.Second,
+		HTTPTLSHandshakeTimeout: 10 * time.Second,
+		HTTP2:                   true,
+	}
+}
+
+func get(t *testing.T, client *http.Client, rawURL string) string {
+	resp, err := client.Get(rawURL)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+func TestNew(t *testing.T) {
+	// the test server's certificate is for example.com, so the TLS server name must be kept
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	t.Run("resolve overrides keep the Host header and server name", func(t *testing.T) {
+		transport, err := New(config.HTTPConfig{
+			Resolve:  []string{"example.com:" + serverURL.Port() + ":127.0.0.1"},
+			CABundle: writeCABundle(t, server),
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, "example.com:"+serverURL.Port(), get(t, &http.Client{Transport: transport}, "https://example.com:"+serverURL.Port()+"/"))
+	})
+
+	t.Run("connect-to overrides keep the Host header and server name", func(t *testing.T) {
+		transport, err := New(config.HTTPConfig{
+			ConnectTo: []string{"example.com:443:" + serverURL.Host},
+			CABundle:  writeCABundle(t, server),
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, "example.com", get(t, &http.Client{Transport: transport}, "https://example.com/"))
+	})
+
+	t.Run("the server isn't trusted without the CA bundle", func(t *testing.T) {
+		transport, err := New(config.HTTPConfig{ConnectTo: []string{"example.com:443:" + serverURL.Host}})
+		assert.NoError(t, err)
+
+		_, err = (&http.Client{Transport: transport}).Get("https://example.com/")
+		assert.ErrorContains(t, err, "certificate")
+	})
+
+	t.Run("requests go through the proxy", func(t *testing.T) {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("proxied " + r.URL.String()))
+		}))
+		defer proxy.Close()
+
+		transport, err := New(config.HTTPConfig{ProxyURL: proxy.URL})
+		assert.NoError(t, err)
+
+		assert.Equal(t, "proxied http://www.gov.uk/browse", get(t, &http.Client{Transport: transport}, "http://www.gov.uk/browse"))
+	})
+
+	t.Run("every invalid setting is reported", func(t *testing.T) {
+		_, err := New(config.HTTPConfig{
+			Resolve:   []string{"www.gov.uk:443", "www.gov.uk:443:origin"},
+			ConnectTo: []string{"www.gov.uk:443:origin"},
+			ProxyURL:  "proxy",
+			CABundle:  filepath.Join(t.TempDir(), "missing.pem"),
+		})
+
+		assert.ErrorContains(t, err, `invalid RESOLVE entry "www.gov.uk:443", expected host:port:address`)
+		assert.ErrorContains(t, err, `invalid RESOLVE entry "www.gov.uk:443:origin", origin is not an IP address`)
+		assert.ErrorContains(t, err, `invalid CONNECT_TO entry "www.gov.uk:443:origin"`)
+		assert.ErrorContains(t, err, `PROXY_URL must be an absolute URL, got "proxy"`)
+		assert.ErrorContains(t, err, "failed to read CA bundle")
+	})
+}
+
+func TestNewConnectionSettings(t *testing.T) {
+	cfg := defaultHTTPConfig()
+	cfg.HTTPMaxConnsPerHost = 20
+	cfg.HTTPResponseHeaderTimeout = 30 * time.Second
+
+	transport, err := New(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, transport.MaxIdleConns)
+	assert.Equal(t, 10, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 20, transport.MaxConnsPerHost)
+	assert.Equal(t, 90*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 10*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 30*time.Second, transport.ResponseHeaderTimeout)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	tests := []struct {
+		name  string
+		http2 bool
+		proto string
+	}{
+		{name: "HTTP/2 is used when the server supports it", http2: true, proto: "HTTP/2.0"},
+		{name: "HTTP/2 can be turned off", http2: false, proto: "HTTP/1.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultHTTPConfig()
+			cfg.HTTP2 = test.http2
+			cfg.ConnectTo = []string{"example.com:443:" + serverURL.Host}
+			cfg.CABundle = writeCABundle(t, server)
+
+			transport, err := New(cfg)
+			assert.NoError(t, err)
+			assert.Equal(t, test.proto, get(t, &http.Client{Transport: transport}, "https://example.com/"))
+		})
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	cfg := defaultHTTPConfig()
+	cfg.HTTPTimeout = 50 * time.Millisecond
+	client, err := NewClient(cfg)
+	assert.NoError(t, err)
+
+	_, err = client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	_, err = NewClient(config.HTTPConfig{ProxyURL: "proxy"})
+	assert.ErrorContains(t, err, "PROXY_URL must be an absolute URL")
+}
+
+func TestOverridesAddress(t *testing.T) {
+	o, err := parseOverrides(
+		[]string{"www.gov.uk:443:203.0.113.10", "origin.example.com:8443:[2001:db8::1]"},
+		[]string{"assets.example.com:443:origin.example.com:8443", "static.example.com::[2001:db8::2]:443", ":80:mirror.example.com:"},
+	)
+	assert.NoError(t, err)
+
+	tests := map[string]string{
+		"www.gov.uk:443":         "203.0.113.10:443",
+		"WWW.GOV.UK:443":         "203.0.113.10:443",
+		"www.gov.uk:80":          "mirror.example.com:80",
+		"assets.example.com:443": "[2001:db8::1]:8443",
+		"static.example.com:80":  "[2001:db8::2]:443",
+		"other.example.com:80":   "mirror.example.com:80",
+		"other.example.com:8080": "other.example.com:8080",
+	}
+
+	for addr, want := range tests {
+		got, err := o.address(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, addr)
+	}
+}
@@ -0,0 +1,96 @@
+package upload
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mirrorer/internal/mime"
+	"os"
+
+	"github.com/andybalholm/brotli"
+	"github.com/rs/zerolog/log"
+)
+
+// Compression is the Content-Encoding text-based files are compressed with before upload
+type Compression string
+
+const (
+	// NoCompression uploads files as they were downloaded
+	NoCompression Compression = "none"
+	// GzipCompression compresses text-based files with gzip
+	GzipCompression Compression = "gzip"
+	// BrotliCompression compresses text-based files with brotli
+	BrotliCompression Compression = "br"
+)
+
+func ParseCompression(compression string) (Compression, error) {
+	switch Compression(compression) {
+	case NoCompression, GzipCompression, BrotliCompression:
+		return Compression(compression), nil
+	default:
+		return "", fmt.Errorf("unknown compression %q, expected %q, %q or %q", compression, NoCompression, GzipCompression, BrotliCompression)
+	}
+}
+
+// WithCompression makes the uploader compress text-based files before uploading them,
+// setting their Content-Encoding. Change detection still uses the digest of the uncompressed content.
+func WithCompression(compression Compression) Option {
+	return func(u *S3Uploader) {
+		u.compression = compression
+	}
+}
+
+func (u S3Uploader) shouldCompress(contentType string) bool {
+	return u.compression != "" && u.compression != NoCompression && mime.IsCompressible(contentType)
+}
+
+// compressToTempFile writes the compressed content of src to a temporary file, returning it
+// rewound to the start. The caller is responsible for removing it with removeTempFile.
+func compressToTempFile(src io.Reader, compression Compression) (*os.File, error) {
+	tempFile, err := os.CreateTemp("", "govuk-mirror-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := compress(tempFile, src, compression); err != nil {
+		removeTempFile(tempFile)
+		return nil, err
+	}
+
+	if _, err := tempFile.Seek(0, io.SeekStart); err != nil {
+		removeTempFile(tempFile)
+		return nil, err
+	}
+
+	return tempFile, nil
+}
+
+func compress(dst io.Writer, src io.Reader, compression Compression) error {
+	var writer io.WriteCloser
+	switch compression {
+	case GzipCompression:
+		gzipWriter, err := gzip.NewWriterLevel(dst, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		writer = gzipWriter
+	case BrotliCompression:
+		writer = brotli.NewWriterLevel(dst, brotli.BestCompression)
+	default:
+		return fmt.Errorf("unknown compression %q", compression)
+	}
+
+	if _, err := io.Copy(writer, src); err != nil {
+		_ = writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+func removeTempFile(file *os.File) {
+	_ = file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		log.Error().Err(err).Str("file", file.Name()).Msg("failed to remove temporary file")
+	}
+}
@@ -0,0 +1,155 @@
+package upload
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"mirrorer/internal/aws_client_mocks"
+	"path"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCompression(t *testing.T) {
+	for _, valid := range []string{"none", "gzip", "br"} {
+		compression, err := ParseCompression(valid)
+		assert.NoError(t, err)
+		assert.Equal(t, Compression(valid), compression)
+	}
+
+	_, err := ParseCompression("zstd")
+	assert.ErrorContains(t, err, `unknown compression "zstd"`)
+}
+
+// capturePutObjectBody records the body of each PutObject call, since the file is closed after uploading
+func capturePutObjectBody(s3Client *aws_client_mocks.FakeS3ObjectUploadingAPI) *[]byte {
+	body := &[]byte{}
+	s3Client.PutObjectStub = func(ctx context.Context, input *s3.PutObjectInput, f ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+		content, err := io.ReadAll(input.Body)
+		*body = content
+		sum := md5.Sum(content)
+		return &s3.PutObjectOutput{ETag: aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)}, err
+	}
+	return body
+}
+
+func TestS3UploaderWithCompression(t *testing.T) {
+	files := map[string]string{
+		"page.html": "<html><body>some content some content some content</body></html>",
+		"doc.pdf":   "%PDF-1.7 some content",
+	}
+
+	decompressors := map[Compression]func(io.Reader) (io.Reader, error){
+		GzipCompression: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		BrotliCompression: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	}
+
+	for compression, decompress := range decompressors {
+		t.Run("compresses text-based files with "+string(compression), func(t *testing.T) {
+			tmpDir := setupFixtures(t, files)
+			defer teardownFixtures(t, tmpDir)
+
+			s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+			s3Client.HeadObjectReturns(nil, &types.NotFound{})
+			body := capturePutObjectBody(s3Client)
+			uploader := NewUploader(s3Client, "test-bucket", WithCompression(compression))
+
+			_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "page.html"), Key: "key", ContentType: "text/html; charset=utf-8"})
+			assert.NoError(t, err)
+
+			_, putCallArgs, _ := s3Client.PutObjectArgsForCall(0)
+			assert.Equal(t, aws.String(string(compression)), putCallArgs.ContentEncoding)
+			assert.Equal(t, sha256Hex(files["page.html"]), putCallArgs.Metadata[ContentHashMetadataKey], "the digest should be of the uncompressed content")
+
+			reader, err := decompress(bytes.NewReader(*body))
+			assert.NoError(t, err)
+			decompressed, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, files["page.html"], string(decompressed))
+		})
+	}
+
+	t.Run("leaves files that are already compressed alone", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(nil, &types.NotFound{})
+		body := capturePutObjectBody(s3Client)
+		uploader := NewUploader(s3Client, "test-bucket", WithCompression(GzipCompression))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "doc.pdf"), Key: "key", ContentType: "application/pdf"})
+		assert.NoError(t, err)
+
+		_, putCallArgs, _ := s3Client.PutObjectArgsForCall(0)
+		assert.Nil(t, putCallArgs.ContentEncoding)
+		assert.Equal(t, files["doc.pdf"], string(*body))
+	})
+
+	t.Run("if the object has the same content and encoding, does not upload the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentType:     aws.String("text/html"),
+			ContentEncoding: aws.String("gzip"),
+			Metadata:        map[string]string{ContentHashMetadataKey: sha256Hex(files["page.html"])},
+		}, nil)
+		uploader := NewUploader(s3Client, "test-bucket", WithCompression(GzipCompression))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "page.html"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, OutcomeSkippedIdentical, outcome)
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+	})
+
+	t.Run("if the object was uploaded uncompressed, uploads the file again", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentType: aws.String("text/html"),
+			Metadata:    map[string]string{ContentHashMetadataKey: sha256Hex(files["page.html"])},
+		}, nil)
+		uploader := NewUploader(s3Client, "test-bucket", WithCompression(GzipCompression))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "page.html"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, OutcomeUploadedChanged, outcome)
+		assert.Equal(t, 1, s3Client.PutObjectCallCount())
+	})
+
+	t.Run("compares the compressed content with the inventory", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		capturePutObjectBody(s3Client)
+		inventory := NewInventory()
+		uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory), WithCompression(GzipCompression))
+		file := File{Path: path.Join(tmpDir, "page.html"), Key: "key", ContentType: "text/html"}
+
+		outcome, err := uploader.UploadFile(t.Context(), file)
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedNew, outcome)
+
+		outcome, err = uploader.UploadFile(t.Context(), file)
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeSkippedIdentical, outcome, "compressing the same content should give the same ETag")
+		assert.Equal(t, 1, s3Client.PutObjectCallCount())
+	})
+}
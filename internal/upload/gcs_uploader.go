@@ -0,0 +1,260 @@
+package upload
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultGCSEndpoint is the base URL of the Google Cloud Storage JSON API
+const DefaultGCSEndpoint = "https://storage.googleapis.com"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// GCSAPIError is returned when the Google Cloud Storage JSON API responds with an unexpected status
+type GCSAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *GCSAPIError) Error() string {
+	return fmt.Sprintf("GCS API responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// gcsObject is the subset of the GCS object resource the uploader cares about
+type gcsObject struct {
+	Name        string            `json:"name,omitempty"`
+	Size        string            `json:"size,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	MD5Hash     string            `json:"md5Hash,omitempty"`
+	CRC32C      string            `json:"crc32c,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// GCSUploader uploads files to a Google Cloud Storage bucket using the JSON API.
+// The HTTP client is expected to handle authentication, which makes it possible
+// to point the uploader at a local fake GCS server in tests.
+type GCSUploader struct {
+	client     *http.Client
+	endpoint   string
+	bucketName string
+}
+
+func NewGCSUploader(client *http.Client, endpoint string, bucketName string) Uploader {
+	return GCSUploader{
+		client:     client,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		bucketName: bucketName,
+	}
+}
+
+func (u GCSUploader) UploadFile(ctx context.Context, f File) (Outcome, error) {
+	filePath, destinationKey, contentType := f.Path, f.Key, f.ContentType
+
+	_, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return "", err
+	}
+
+	remoteObject, err := u.getObject(ctx, destinationKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to get object metadata: %w", err)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
+	}
+	defer (func() {
+		err := file.Close()
+		if err != nil {
+			log.Error().Err(err).Str("file", filePath).Msg("failed to close file")
+		}
+	})()
+
+	md5Hasher := md5.New()
+	crc32cHasher := crc32.New(crc32cTable)
+	sha256Hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hasher, crc32cHasher, sha256Hasher), file); err != nil {
+		return "", fmt.Errorf("failed to copy file bytes into hashing buffer %s: %w", filePath, err)
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewind file %s: %w", filePath, err)
+	}
+
+	md5Hash := base64.StdEncoding.EncodeToString(md5Hasher.Sum(nil))
+	crc32cBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc32cBytes, crc32cHasher.Sum32())
+	crc32cHash := base64.StdEncoding.EncodeToString(crc32cBytes)
+	contentHash := hex.EncodeToString(sha256Hasher.Sum(nil))
+
+	outcome := compareGCSObject(remoteObject, md5Hash, contentHash, contentType)
+	if outcome == OutcomeSkippedIdentical {
+		return outcome, nil
+	}
+
+	if remoteObject != nil && remoteObject.ContentType != contentType {
+		log.Info().Msgf("File %s has a different content type on GCS than live, uploading", filePath)
+	}
+
+	err = u.insertObject(ctx, file, gcsObject{
+		Name:        destinationKey,
+		ContentType: contentType,
+		MD5Hash:     md5Hash,
+		CRC32C:      crc32cHash,
+		Metadata:    map[string]string{ContentHashMetadataKey: contentHash},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to write object: %w", err)
+	}
+
+	return outcome, nil
+}
+
+// compareGCSObject compares the local file with the remote object, preferring the
+// SHA-256 digest recorded at upload time and falling back to the MD5 digest GCS
+// keeps for objects uploaded by other tools
+func compareGCSObject(remoteObject *gcsObject, md5Hash string, contentHash string, contentType string) Outcome {
+	if remoteObject == nil {
+		return OutcomeUploadedNew
+	}
+
+	if remoteObject.ContentType != contentType {
+		return OutcomeUploadedChanged
+	}
+
+	if remoteHash, ok := remoteObject.Metadata[ContentHashMetadataKey]; ok {
+		if remoteHash != contentHash {
+			return OutcomeUploadedChanged
+		}
+		return OutcomeSkippedIdentical
+	}
+
+	if remoteObject.MD5Hash != md5Hash {
+		return OutcomeUploadedChanged
+	}
+
+	return OutcomeSkippedIdentical
+}
+
+// getObject fetches the metadata of an object, returning nil if it does not exist
+func (u GCSUploader) getObject(ctx context.Context, key string) (*gcsObject, error) {
+	reqUrl := fmt.Sprintf("%s/storage/v1/b/%s/o/%s", u.endpoint, url.PathEscape(u.bucketName), url.PathEscape(key))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer (func() {
+		_ = resp.Body.Close()
+	})()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newGCSAPIError(resp)
+	}
+
+	object := &gcsObject{}
+	if err := json.NewDecoder(resp.Body).Decode(object); err != nil {
+		return nil, fmt.Errorf("failed to decode object metadata: %w", err)
+	}
+
+	return object, nil
+}
+
+// insertObject streams the file to GCS as a multipart upload. GCS verifies the
+// MD5 and CRC32C hashes supplied in the metadata and rejects the upload if they do not match.
+func (u GCSUploader) insertObject(ctx context.Context, body io.Reader, object gcsObject) error {
+	reqUrl := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=multipart", u.endpoint, url.PathEscape(u.bucketName))
+
+	metadata, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	writer := multipart.NewWriter(pipeWriter)
+
+	go func() {
+		pipeWriter.CloseWithError(writeMultipartBody(writer, metadata, body, object.ContentType))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqUrl, pipeReader)
+	if err != nil {
+		_ = pipeReader.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", "multipart/related; boundary="+writer.Boundary())
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer (func() {
+		_ = resp.Body.Close()
+	})()
+
+	if resp.StatusCode != http.StatusOK {
+		return newGCSAPIError(resp)
+	}
+
+	return nil
+}
+
+func writeMultipartBody(writer *multipart.Writer, metadata []byte, body io.Reader, contentType string) error {
+	metadataPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"application/json; charset=UTF-8"},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := metadataPart.Write(metadata); err != nil {
+		return err
+	}
+
+	mediaPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {contentType},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(mediaPart, body); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+func newGCSAPIError(resp *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return errors.Join(&GCSAPIError{StatusCode: resp.StatusCode}, err)
+	}
+
+	return &GCSAPIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,245 @@
+package upload
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGCSObject struct {
+	metadata gcsObject
+	content  []byte
+}
+
+// fakeGCSServer implements the parts of the GCS JSON API used by GCSUploader
+type fakeGCSServer struct {
+	*httptest.Server
+	mu            sync.Mutex
+	objects       map[string]fakeGCSObject
+	uploadCount   int
+	getStatusCode int
+}
+
+func newFakeGCSServer(t *testing.T) *fakeGCSServer {
+	fake := &fakeGCSServer{objects: map[string]fakeGCSObject{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /storage/v1/b/test-bucket/o/{object}", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+
+		if fake.getStatusCode != 0 {
+			w.WriteHeader(fake.getStatusCode)
+			return
+		}
+
+		object, ok := fake.objects[r.PathValue("object")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		assert.NoError(t, json.NewEncoder(w).Encode(object.metadata))
+	})
+	mux.HandleFunc("POST /upload/storage/v1/b/test-bucket/o", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+
+		assert.Equal(t, "multipart", r.URL.Query().Get("uploadType"))
+
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+		reader := multipart.NewReader(r.Body, params["boundary"])
+
+		metadataPart, err := reader.NextPart()
+		assert.NoError(t, err)
+		metadata := gcsObject{}
+		assert.NoError(t, json.NewDecoder(metadataPart).Decode(&metadata))
+
+		mediaPart, err := reader.NextPart()
+		assert.NoError(t, err)
+		content, err := io.ReadAll(mediaPart)
+		assert.NoError(t, err)
+
+		md5Sum := md5.Sum(content)
+		crc32cBytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(crc32cBytes, crc32.Checksum(content, crc32.MakeTable(crc32.Castagnoli)))
+		if metadata.MD5Hash != base64.StdEncoding.EncodeToString(md5Sum[:]) ||
+			metadata.CRC32C != base64.StdEncoding.EncodeToString(crc32cBytes) {
+			http.Error(w, "checksum mismatch", http.StatusBadRequest)
+			return
+		}
+
+		metadata.Size = strconv.Itoa(len(content))
+		fake.objects[metadata.Name] = fakeGCSObject{metadata: metadata, content: content}
+		fake.uploadCount++
+
+		assert.NoError(t, json.NewEncoder(w).Encode(metadata))
+	})
+
+	fake.Server = httptest.NewServer(mux)
+	return fake
+}
+
+func (f *fakeGCSServer) putObject(name string, content string, contentType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	md5Sum := md5.Sum([]byte(content))
+	f.objects[name] = fakeGCSObject{
+		metadata: gcsObject{
+			Name:        name,
+			Size:        strconv.Itoa(len(content)),
+			ContentType: contentType,
+			MD5Hash:     base64.StdEncoding.EncodeToString(md5Sum[:]),
+		},
+		content: []byte(content),
+	}
+}
+
+func TestGCSUploader(t *testing.T) {
+	t.Run("returns an error if the file does not exist", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{})
+		defer teardownFixtures(t, tmpDir)
+
+		server := newFakeGCSServer(t)
+		defer server.Close()
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "unknown_file"), Key: "key", ContentType: "text/html"})
+		assert.Error(t, err)
+	})
+
+	t.Run("returns an error if getting the object metadata fails", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "some content",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		server := newFakeGCSServer(t)
+		defer server.Close()
+		server.getStatusCode = http.StatusForbidden
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+
+		var apiErr *GCSAPIError
+		assert.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+	})
+
+	t.Run("if the object does not exist in GCS, it uploads the new file with checksums", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "some content",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		server := newFakeGCSServer(t)
+		defer server.Close()
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "www.gov.uk/a_file.html", ContentType: "text/html"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedNew, outcome)
+
+		assert.Equal(t, 1, server.uploadCount)
+		object := server.objects["www.gov.uk/a_file.html"]
+		assert.Equal(t, "some content", string(object.content))
+		assert.Equal(t, "text/html", object.metadata.ContentType)
+		assert.Equal(t, sha256Hex("some content"), object.metadata.Metadata[ContentHashMetadataKey])
+	})
+
+	t.Run("if the object exists in GCS with the same content, does not upload the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "some content",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		server := newFakeGCSServer(t)
+		defer server.Close()
+		server.putObject("key", "some content", "text/html")
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeSkippedIdentical, outcome)
+
+		assert.Equal(t, 0, server.uploadCount)
+	})
+
+	t.Run("if the object exists in GCS with the same size but different content, uploads the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "some content",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		server := newFakeGCSServer(t)
+		defer server.Close()
+		server.putObject("key", "SOME CONTENT", "text/html")
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedChanged, outcome)
+
+		assert.Equal(t, 1, server.uploadCount)
+		assert.Equal(t, "some content", string(server.objects["key"].content))
+	})
+
+	t.Run("if the object exists in GCS, and the content-type is different, uploads the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "some content",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		server := newFakeGCSServer(t)
+		defer server.Close()
+		server.putObject("key", "some content", "application/octet-stream")
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/css"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 1, server.uploadCount)
+		assert.Equal(t, "text/css", server.objects["key"].metadata.ContentType)
+	})
+
+	t.Run("returns an error if inserting the object fails", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "some content",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = io.Copy(io.Discard, r.Body)
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}))
+		defer server.Close()
+		uploader := NewGCSUploader(server.Client(), server.URL, "test-bucket")
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+
+		var apiErr *GCSAPIError
+		assert.ErrorAs(t, err, &apiErr)
+		assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+		assert.True(t, strings.Contains(apiErr.Message, "slow down"))
+	})
+}
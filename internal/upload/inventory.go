@@ -0,0 +1,110 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"mirrorer/internal/aws_client_interfaces"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ObjectInfo describes an object that is already present in a bucket
+type ObjectInfo struct {
+	Size int64
+	ETag string
+	// Attributes are the content type and headers the object was written with. Listing a bucket
+	// doesn't return them, so they are nil for objects that weren't uploaded by this process.
+	Attributes *ObjectAttributes
+}
+
+// ObjectAttributes are the content type and headers of an object that decide whether it needs
+// to be written again even though its content hasn't changed
+type ObjectAttributes struct {
+	ContentType        string
+	ContentEncoding    string
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+}
+
+func newObjectAttributes(contentType string, headers ObjectHeaders) *ObjectAttributes {
+	return &ObjectAttributes{
+		ContentType:        contentType,
+		ContentEncoding:    headers.ContentEncoding,
+		CacheControl:       headers.CacheControl,
+		ContentDisposition: headers.ContentDisposition,
+		ContentLanguage:    headers.ContentLanguage,
+	}
+}
+
+// md5Hex returns the hex encoded MD5 digest of the object's content. S3 only uses the
+// MD5 digest as the ETag for objects uploaded in a single part, so ok is false for
+// multipart uploads.
+func (o ObjectInfo) md5Hex() (digest string, ok bool) {
+	etag := strings.Trim(o.ETag, `"`)
+	if len(etag) != 32 || strings.Contains(etag, "-") {
+		return "", false
+	}
+	return etag, true
+}
+
+// Inventory is an in-memory index of the objects in a bucket, built with a single
+// listing so that uploads don't need to look up every object individually
+type Inventory struct {
+	mu      sync.RWMutex
+	objects map[string]ObjectInfo
+}
+
+func NewInventory() *Inventory {
+	return &Inventory{objects: map[string]ObjectInfo{}}
+}
+
+// LoadInventory lists every object in the bucket into a new Inventory
+func LoadInventory(ctx context.Context, s3Client aws_client_interfaces.S3ObjectUploadingAPI, bucketName string) (*Inventory, error) {
+	inventory := NewInventory()
+
+	paginator := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucketName),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects in bucket %s: %w", bucketName, err)
+		}
+
+		for _, object := range page.Contents {
+			inventory.Put(aws.ToString(object.Key), ObjectInfo{
+				Size: aws.ToInt64(object.Size),
+				ETag: aws.ToString(object.ETag),
+			})
+		}
+	}
+
+	return inventory, nil
+}
+
+func (i *Inventory) Get(key string) (ObjectInfo, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	info, ok := i.objects[key]
+	return info, ok
+}
+
+func (i *Inventory) Put(key string, info ObjectInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.objects[key] = info
+}
+
+func (i *Inventory) Len() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return len(i.objects)
+}
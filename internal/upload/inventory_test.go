@@ -0,0 +1,66 @@
+package upload
+
+import (
+	"context"
+	"mirrorer/internal/aws_client_mocks"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadInventory(t *testing.T) {
+	t.Run("lists every page of objects in the bucket", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.ListObjectsV2Stub = func(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			if input.ContinuationToken == nil {
+				return &s3.ListObjectsV2Output{
+					Contents: []types.Object{
+						{Key: aws.String("www.gov.uk/index.html"), Size: aws.Int64(10), ETag: aws.String(`"etag-1"`)},
+					},
+					IsTruncated:           aws.Bool(true),
+					NextContinuationToken: aws.String("page-2"),
+				}, nil
+			}
+
+			return &s3.ListObjectsV2Output{
+				Contents: []types.Object{
+					{Key: aws.String("www.gov.uk/foo.html"), Size: aws.Int64(20), ETag: aws.String(`"etag-2"`)},
+				},
+				IsTruncated: aws.Bool(false),
+			}, nil
+		}
+
+		inventory, err := LoadInventory(t.Context(), s3Client, "test-bucket")
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, s3Client.ListObjectsV2CallCount())
+		_, firstCall, _ := s3Client.ListObjectsV2ArgsForCall(0)
+		assert.Equal(t, aws.String("test-bucket"), firstCall.Bucket)
+
+		assert.Equal(t, 2, inventory.Len())
+		info, ok := inventory.Get("www.gov.uk/foo.html")
+		assert.True(t, ok)
+		assert.Equal(t, ObjectInfo{Size: 20, ETag: `"etag-2"`}, info)
+	})
+
+	t.Run("returns an error if listing the bucket fails", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		expectedError := &types.NoSuchBucket{}
+		s3Client.ListObjectsV2Returns(nil, expectedError)
+
+		_, err := LoadInventory(t.Context(), s3Client, "test-bucket")
+		assert.ErrorIs(t, err, expectedError)
+	})
+}
+
+func TestObjectInfoMD5Hex(t *testing.T) {
+	digest, ok := ObjectInfo{ETag: `"9893532233caff98cd083a116b013c0b"`}.md5Hex()
+	assert.True(t, ok)
+	assert.Equal(t, "9893532233caff98cd083a116b013c0b", digest)
+
+	_, ok = ObjectInfo{ETag: `"d41d8cd98f00b204e9800998ecf8427e-2"`}.md5Hex()
+	assert.False(t, ok, "multipart ETags are not MD5 digests")
+}
@@ -0,0 +1,221 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Manifest records the files uploaded, or that failed to upload, during a crawl.
+// A nil Manifest records nothing.
+type Manifest struct {
+	mu       sync.Mutex
+	uploaded map[string]ManifestEntry
+	failed   map[string]struct{}
+	// partial holds the backends each partially failed key failed to upload to
+	partial map[string][]string
+}
+
+// ManifestEntry describes an object uploaded during a crawl. Size and SHA256 are of the
+// file on disk, before any compression, and are empty if the file could not be read.
+type ManifestEntry struct {
+	Key         string `json:"key"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	SHA256      string `json:"sha256,omitempty"`
+}
+
+// PartialFailure describes a file that was uploaded to some backends but not others
+type PartialFailure struct {
+	Key      string   `json:"key"`
+	Backends []string `json:"failed_backends"`
+}
+
+// ManifestFile is the JSON representation of a Manifest saved at the end of a crawl
+type ManifestFile struct {
+	RunID           string           `json:"run_id"`
+	KeyPrefix       string           `json:"key_prefix"`
+	Files           []ManifestEntry  `json:"files"`
+	Failed          []string         `json:"failed"`
+	PartiallyFailed []PartialFailure `json:"partially_failed,omitempty"`
+}
+
+func NewManifest() *Manifest {
+	return &Manifest{
+		uploaded: map[string]ManifestEntry{},
+		failed:   map[string]struct{}{},
+		partial:  map[string][]string{},
+	}
+}
+
+// NewManifestEntry describes the file to be uploaded, reading it to find its size and digest
+func NewManifestEntry(f File) (ManifestEntry, error) {
+	entry := ManifestEntry{Key: f.Key, ContentType: f.ContentType}
+
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return entry, fmt.Errorf("failed to open file %s: %w", f.Path, err)
+	}
+	defer (func() {
+		_ = file.Close()
+	})()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return entry, fmt.Errorf("failed to read file %s: %w", f.Path, err)
+	}
+
+	entry.Size = size
+	entry.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	return entry, nil
+}
+
+// RecordUploaded records that the entry's key was uploaded, forgetting any earlier failure to upload it
+func (m *Manifest) RecordUploaded(entry ManifestEntry) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uploaded[entry.Key] = entry
+	delete(m.failed, entry.Key)
+	delete(m.partial, entry.Key)
+}
+
+// RecordFailed records that the key failed to upload, unless it was uploaded successfully, even if
+// only to some backends, before
+func (m *Manifest) RecordFailed(key string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, uploaded := m.uploaded[key]
+	_, partial := m.partial[key]
+	if !uploaded && !partial {
+		m.failed[key] = struct{}{}
+	}
+}
+
+// RecordPartiallyFailed records that the key was uploaded to some backends but failed to upload to
+// the given ones, unless it was uploaded to every backend before
+func (m *Manifest) RecordPartiallyFailed(key string, backends []string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.uploaded[key]; !ok {
+		m.partial[key] = backends
+		delete(m.failed, key)
+	}
+}
+
+// Uploaded returns the sorted keys of the files that were uploaded
+func (m *Manifest) Uploaded() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(m.uploaded))
+}
+
+// Failed returns the sorted keys of the files that failed to upload
+func (m *Manifest) Failed() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(m.failed))
+}
+
+// PartiallyFailed returns the sorted keys of the files that were uploaded to some backends but not others
+func (m *Manifest) PartiallyFailed() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(m.partial))
+}
+
+// WriteFile saves the manifest as JSON, recording the run and the prefix its keys were uploaded under
+func (m *Manifest) WriteFile(path string, runID string, keyPrefix string) error {
+	m.mu.Lock()
+	manifestFile := ManifestFile{
+		RunID:     runID,
+		KeyPrefix: keyPrefix,
+		Files:     make([]ManifestEntry, 0, len(m.uploaded)),
+		Failed:    slices.Sorted(maps.Keys(m.failed)),
+	}
+	for _, key := range slices.Sorted(maps.Keys(m.uploaded)) {
+		manifestFile.Files = append(manifestFile.Files, m.uploaded[key])
+	}
+	for _, key := range slices.Sorted(maps.Keys(m.partial)) {
+		manifestFile.PartiallyFailed = append(manifestFile.PartiallyFailed, PartialFailure{Key: key, Backends: m.partial[key]})
+	}
+	m.mu.Unlock()
+
+	data, err := json.Marshal(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ReadManifestFile reads a manifest saved by Manifest.WriteFile
+func ReadManifestFile(path string) (*ManifestFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", path, err)
+	}
+
+	manifestFile := &ManifestFile{}
+	if err := json.Unmarshal(data, manifestFile); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+
+	return manifestFile, nil
+}
+
+// Differences compares the object in S3 with the entry, using the digest the uploader records
+// in the object's metadata, and describes each way they differ. The size of objects uploaded
+// compressed can't be compared, as S3 only knows their compressed size.
+func (e ManifestEntry) Differences(object *s3.HeadObjectOutput) []string {
+	differences := []string{}
+
+	if contentType := aws.ToString(object.ContentType); contentType != e.ContentType {
+		differences = append(differences, fmt.Sprintf("content type is %q, expected %q", contentType, e.ContentType))
+	}
+
+	if e.SHA256 == "" {
+		return differences
+	}
+
+	if aws.ToString(object.ContentEncoding) == "" && aws.ToInt64(object.ContentLength) != e.Size {
+		differences = append(differences, fmt.Sprintf("size is %d, expected %d", aws.ToInt64(object.ContentLength), e.Size))
+	}
+
+	if digest := object.Metadata[ContentHashMetadataKey]; digest != e.SHA256 {
+		differences = append(differences, fmt.Sprintf("checksum is %q, expected %q", digest, e.SHA256))
+	}
+
+	return differences
+}
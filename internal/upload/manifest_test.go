@@ -0,0 +1,163 @@
+package upload
+
+import (
+	"path"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	t.Run("a later successful upload clears an earlier failure", func(t *testing.T) {
+		manifest := NewManifest()
+		manifest.RecordFailed("b")
+		manifest.RecordUploaded(ManifestEntry{Key: "b"})
+		manifest.RecordUploaded(ManifestEntry{Key: "a"})
+
+		assert.Equal(t, []string{"a", "b"}, manifest.Uploaded())
+		assert.Empty(t, manifest.Failed())
+	})
+
+	t.Run("a later failure doesn't override a successful upload", func(t *testing.T) {
+		manifest := NewManifest()
+		manifest.RecordUploaded(ManifestEntry{Key: "a"})
+		manifest.RecordFailed("a")
+		manifest.RecordFailed("b")
+
+		assert.Equal(t, []string{"a"}, manifest.Uploaded())
+		assert.Equal(t, []string{"b"}, manifest.Failed())
+	})
+
+	t.Run("a partial failure is neither uploaded nor failed", func(t *testing.T) {
+		manifest := NewManifest()
+		manifest.RecordFailed("a")
+		manifest.RecordPartiallyFailed("a", []string{"mirrorS3Replica"})
+		manifest.RecordPartiallyFailed("b", []string{"mirrorGCS"})
+		manifest.RecordFailed("b")
+		manifest.RecordUploaded(ManifestEntry{Key: "c"})
+		manifest.RecordPartiallyFailed("c", []string{"mirrorGCS"})
+
+		assert.Equal(t, []string{"c"}, manifest.Uploaded())
+		assert.Empty(t, manifest.Failed())
+		assert.Equal(t, []string{"a", "b"}, manifest.PartiallyFailed())
+	})
+
+	t.Run("a nil manifest records nothing", func(t *testing.T) {
+		var manifest *Manifest
+		assert.NotPanics(t, func() {
+			manifest.RecordUploaded(ManifestEntry{Key: "a"})
+			manifest.RecordFailed("b")
+			manifest.RecordPartiallyFailed("c", []string{"mirrorGCS"})
+		})
+	})
+
+	t.Run("can be saved and read back", func(t *testing.T) {
+		manifest := NewManifest()
+		manifest.RecordUploaded(ManifestEntry{Key: "snapshots/run-1/b", Size: 3, ContentType: "text/html", SHA256: "abc"})
+		manifest.RecordUploaded(ManifestEntry{Key: "snapshots/run-1/a", Size: 5, ContentType: "text/css", SHA256: "def"})
+		manifest.RecordFailed("snapshots/run-1/c")
+		manifest.RecordPartiallyFailed("snapshots/run-1/d", []string{"mirrorS3Replica"})
+
+		manifestPath := path.Join(t.TempDir(), "manifest.json")
+		assert.NoError(t, manifest.WriteFile(manifestPath, "run-1", "snapshots/run-1/"))
+
+		manifestFile, err := ReadManifestFile(manifestPath)
+		assert.NoError(t, err)
+		assert.Equal(t, &ManifestFile{
+			RunID:     "run-1",
+			KeyPrefix: "snapshots/run-1/",
+			Files: []ManifestEntry{
+				{Key: "snapshots/run-1/a", Size: 5, ContentType: "text/css", SHA256: "def"},
+				{Key: "snapshots/run-1/b", Size: 3, ContentType: "text/html", SHA256: "abc"},
+			},
+			Failed:          []string{"snapshots/run-1/c"},
+			PartiallyFailed: []PartialFailure{{Key: "snapshots/run-1/d", Backends: []string{"mirrorS3Replica"}}},
+		}, manifestFile)
+	})
+}
+
+func TestNewManifestEntry(t *testing.T) {
+	tmpDir := setupFixtures(t, map[string]string{"file.txt": "test content"})
+	defer teardownFixtures(t, tmpDir)
+
+	entry, err := NewManifestEntry(File{Path: path.Join(tmpDir, "file.txt"), Key: "key", ContentType: "text/plain"})
+	assert.NoError(t, err)
+	assert.Equal(t, ManifestEntry{Key: "key", Size: 12, ContentType: "text/plain", SHA256: sha256Hex("test content")}, entry)
+
+	entry, err = NewManifestEntry(File{Path: path.Join(tmpDir, "missing.txt"), Key: "key", ContentType: "text/plain"})
+	assert.Error(t, err)
+	assert.Equal(t, ManifestEntry{Key: "key", ContentType: "text/plain"}, entry)
+}
+
+func TestManifestEntryDifferences(t *testing.T) {
+	entry := ManifestEntry{Key: "key", Size: 12, ContentType: "text/html", SHA256: "abc"}
+
+	tests := []struct {
+		name     string
+		entry    ManifestEntry
+		object   *s3.HeadObjectOutput
+		expected []string
+	}{
+		{
+			name:  "identical object",
+			entry: entry,
+			object: &s3.HeadObjectOutput{
+				ContentType:   aws.String("text/html"),
+				ContentLength: aws.Int64(12),
+				Metadata:      map[string]string{ContentHashMetadataKey: "abc"},
+			},
+			expected: []string{},
+		},
+		{
+			name:  "different object",
+			entry: entry,
+			object: &s3.HeadObjectOutput{
+				ContentType:   aws.String("text/plain"),
+				ContentLength: aws.Int64(10),
+				Metadata:      map[string]string{ContentHashMetadataKey: "def"},
+			},
+			expected: []string{
+				`content type is "text/plain", expected "text/html"`,
+				"size is 10, expected 12",
+				`checksum is "def", expected "abc"`,
+			},
+		},
+		{
+			name:  "compressed object",
+			entry: entry,
+			object: &s3.HeadObjectOutput{
+				ContentType:     aws.String("text/html"),
+				ContentEncoding: aws.String("gzip"),
+				ContentLength:   aws.Int64(8),
+				Metadata:        map[string]string{ContentHashMetadataKey: "abc"},
+			},
+			expected: []string{},
+		},
+		{
+			name:  "object uploaded without a checksum",
+			entry: entry,
+			object: &s3.HeadObjectOutput{
+				ContentType:   aws.String("text/html"),
+				ContentLength: aws.Int64(12),
+			},
+			expected: []string{`checksum is "", expected "abc"`},
+		},
+		{
+			name:  "entry without a checksum",
+			entry: ManifestEntry{Key: "key", ContentType: "text/html"},
+			object: &s3.HeadObjectOutput{
+				ContentType:   aws.String("text/html"),
+				ContentLength: aws.Int64(12),
+			},
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.entry.Differences(tt.object))
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mirrorer/internal/metrics"
+	"sync"
+	"time"
+)
+
+// PartialFailurePolicy decides what happens to a file that was uploaded to some backends but not others
+type PartialFailurePolicy string
+
+const (
+	// FailOnPartialFailure reports the file as failed if any backend failed
+	FailOnPartialFailure PartialFailurePolicy = "fail"
+	// ContinueOnPartialFailure reports the file as uploaded with a PartialUploadError naming the
+	// failed backends, as long as at least one backend succeeded
+	ContinueOnPartialFailure PartialFailurePolicy = "continue"
+)
+
+func ParsePartialFailurePolicy(policy string) (PartialFailurePolicy, error) {
+	switch PartialFailurePolicy(policy) {
+	case FailOnPartialFailure, ContinueOnPartialFailure:
+		return PartialFailurePolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown partial failure policy %q, expected %q or %q", policy, FailOnPartialFailure, ContinueOnPartialFailure)
+	}
+}
+
+// Backend is an Uploader for a single mirror, named after its MIRROR_BACKENDS override (e.g. mirrorS3)
+type Backend struct {
+	Name     string
+	Uploader Uploader
+}
+
+// BackendUploadError is returned when uploading to a specific backend fails
+type BackendUploadError struct {
+	Backend string
+	Err     error
+}
+
+func (e *BackendUploadError) Error() string {
+	return fmt.Sprintf("backend %s: %v", e.Backend, e.Err)
+}
+
+func (e *BackendUploadError) Unwrap() error {
+	return e.Err
+}
+
+// PartialUploadError is returned under ContinueOnPartialFailure when a file was uploaded to
+// some backends but not others
+type PartialUploadError struct {
+	// Outcome is the combined outcome across the backends that succeeded
+	Outcome  Outcome
+	Failures []*BackendUploadError
+}
+
+func (e *PartialUploadError) Error() string {
+	return fmt.Sprintf("file was not uploaded to every backend: %v", e.Unwrap())
+}
+
+func (e *PartialUploadError) Unwrap() error {
+	errs := make([]error, len(e.Failures))
+	for i, failure := range e.Failures {
+		errs[i] = failure
+	}
+	return errors.Join(errs...)
+}
+
+// Backends returns the names of the backends the file failed to upload to
+func (e *PartialUploadError) Backends() []string {
+	backends := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		backends[i] = failure.Backend
+	}
+	return backends
+}
+
+// MultiUploader uploads each file to several backends concurrently
+type MultiUploader struct {
+	backends []Backend
+	policy   PartialFailurePolicy
+	metrics  *metrics.Metrics
+}
+
+func NewMultiUploader(backends []Backend, policy PartialFailurePolicy, m *metrics.Metrics) Uploader {
+	return MultiUploader{
+		backends: backends,
+		policy:   policy,
+		metrics:  m,
+	}
+}
+
+// UploadFile uploads the file to every backend. The returned Outcome is the most significant
+// outcome across the backends that succeeded: a file that changed on any backend is reported as
+// changed, a file that was new on any backend as new, and otherwise as identical.
+func (u MultiUploader) UploadFile(ctx context.Context, f File) (Outcome, error) {
+	errs := make([]*BackendUploadError, len(u.backends))
+	outcomes := make([]Outcome, len(u.backends))
+
+	var wg sync.WaitGroup
+	for i, backend := range u.backends {
+		wg.Go(func() {
+			startTime := time.Now()
+			outcome, err := backend.Uploader.UploadFile(ctx, f)
+			metrics.BackendUploadDuration(u.metrics, backend.Name, time.Since(startTime))
+			if err != nil {
+				metrics.BackendFileUploadFailed(u.metrics, backend.Name)
+				errs[i] = &BackendUploadError{Backend: backend.Name, Err: err}
+			} else {
+				metrics.BackendFileUploaded(u.metrics, backend.Name)
+				outcomes[i] = outcome
+			}
+		})
+	}
+	wg.Wait()
+
+	outcome := combineOutcomes(outcomes)
+
+	failures := []*BackendUploadError{}
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	if len(failures) == 0 {
+		return outcome, nil
+	}
+
+	partialErr := &PartialUploadError{Outcome: outcome, Failures: failures}
+	if len(failures) < len(u.backends) && u.policy == ContinueOnPartialFailure {
+		return outcome, partialErr
+	}
+
+	return "", partialErr.Unwrap()
+}
+
+func combineOutcomes(outcomes []Outcome) Outcome {
+	combined := OutcomeSkippedIdentical
+	for _, outcome := range outcomes {
+		switch outcome {
+		case OutcomeUploadedChanged:
+			return OutcomeUploadedChanged
+		case OutcomeUploadedNew:
+			combined = OutcomeUploadedNew
+		}
+	}
+	return combined
+}
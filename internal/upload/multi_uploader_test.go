@@ -0,0 +1,151 @@
+package upload_test
+
+import (
+	"context"
+	"errors"
+	"mirrorer/internal/metrics"
+	"mirrorer/internal/upload"
+	"mirrorer/internal/upload/uploadfakes"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupBackends(errs map[string]error) ([]upload.Backend, map[string]*uploadfakes.FakeUploader) {
+	backends := []upload.Backend{}
+	fakes := map[string]*uploadfakes.FakeUploader{}
+
+	for _, name := range []string{"mirrorS3", "mirrorS3Replica", "mirrorGCS"} {
+		fake := &uploadfakes.FakeUploader{}
+		fake.UploadFileReturns(upload.OutcomeUploadedNew, errs[name])
+		fakes[name] = fake
+		backends = append(backends, upload.Backend{Name: name, Uploader: fake})
+	}
+
+	return backends, fakes
+}
+
+func TestParsePartialFailurePolicy(t *testing.T) {
+	policy, err := upload.ParsePartialFailurePolicy("fail")
+	assert.NoError(t, err)
+	assert.Equal(t, upload.FailOnPartialFailure, policy)
+
+	policy, err = upload.ParsePartialFailurePolicy("continue")
+	assert.NoError(t, err)
+	assert.Equal(t, upload.ContinueOnPartialFailure, policy)
+
+	_, err = upload.ParsePartialFailurePolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestMultiUploaderCombinesOutcomes(t *testing.T) {
+	m := metrics.NewMetrics(prometheus.NewRegistry())
+	backends, fakes := setupBackends(map[string]error{})
+	fakes["mirrorS3"].UploadFileReturns(upload.OutcomeSkippedIdentical, nil)
+	fakes["mirrorS3Replica"].UploadFileReturns(upload.OutcomeUploadedChanged, nil)
+	fakes["mirrorGCS"].UploadFileReturns(upload.OutcomeUploadedNew, nil)
+	uploader := upload.NewMultiUploader(backends, upload.FailOnPartialFailure, m)
+
+	outcome, err := uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+	assert.NoError(t, err)
+	assert.Equal(t, upload.OutcomeUploadedChanged, outcome)
+
+	fakes["mirrorS3Replica"].UploadFileReturns(upload.OutcomeSkippedIdentical, nil)
+	outcome, err = uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+	assert.NoError(t, err)
+	assert.Equal(t, upload.OutcomeUploadedNew, outcome)
+}
+
+func TestMultiUploader(t *testing.T) {
+	t.Run("uploads the file to every backend", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		backends, fakes := setupBackends(map[string]error{})
+		uploader := upload.NewMultiUploader(backends, upload.FailOnPartialFailure, m)
+
+		_, err := uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		for name, fake := range fakes {
+			assert.Equal(t, 1, fake.UploadFileCallCount(), "backend %s should have been called once", name)
+			_, f := fake.UploadFileArgsForCall(0)
+			assert.Equal(t, upload.File{Path: "path", Key: "key", ContentType: "text/html"}, f)
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.BackendFileUploadCounter().WithLabelValues(name)))
+		}
+		// the time taken by each backend is recorded separately
+		assert.Equal(t, len(fakes), testutil.CollectAndCount(m.BackendUploadDuration()))
+	})
+
+	t.Run("uploads to the backends concurrently", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		backends, fakes := setupBackends(map[string]error{})
+
+		// every backend blocks until all of them have been called
+		started := make(chan struct{}, len(fakes))
+		release := make(chan struct{})
+		for _, fake := range fakes {
+			fake.UploadFileStub = func(ctx context.Context, f upload.File) (upload.Outcome, error) {
+				started <- struct{}{}
+				<-release
+				return upload.OutcomeUploadedNew, nil
+			}
+		}
+		go func() {
+			for range fakes {
+				<-started
+			}
+			close(release)
+		}()
+
+		uploader := upload.NewMultiUploader(backends, upload.FailOnPartialFailure, m)
+		_, err := uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("with the fail policy, a partial failure fails the file", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		expectedErr := errors.New("bucket unavailable")
+		backends, _ := setupBackends(map[string]error{"mirrorGCS": expectedErr})
+		uploader := upload.NewMultiUploader(backends, upload.FailOnPartialFailure, m)
+
+		_, err := uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+		assert.ErrorIs(t, err, expectedErr)
+
+		var backendErr *upload.BackendUploadError
+		assert.ErrorAs(t, err, &backendErr)
+		assert.Equal(t, "mirrorGCS", backendErr.Backend)
+
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.BackendFileUploadCounter().WithLabelValues("mirrorS3")))
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.BackendFileUploadFailuresCounter().WithLabelValues("mirrorGCS")))
+	})
+
+	t.Run("with the continue policy, a partial failure returns the failed backends", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		backends, _ := setupBackends(map[string]error{"mirrorS3Replica": errors.New("bucket unavailable")})
+		uploader := upload.NewMultiUploader(backends, upload.ContinueOnPartialFailure, m)
+
+		_, err := uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+
+		var partialErr *upload.PartialUploadError
+		assert.ErrorAs(t, err, &partialErr)
+		assert.Equal(t, []string{"mirrorS3Replica"}, partialErr.Backends())
+		assert.ErrorContains(t, err, "bucket unavailable")
+
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.BackendFileUploadFailuresCounter().WithLabelValues("mirrorS3Replica")))
+		assert.Equal(t, float64(0), testutil.ToFloat64(m.BackendFileUploadFailuresCounter().WithLabelValues("mirrorS3")))
+	})
+
+	t.Run("with the continue policy, failing on every backend fails the file", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		err := errors.New("bucket unavailable")
+		backends, _ := setupBackends(map[string]error{"mirrorS3": err, "mirrorS3Replica": err, "mirrorGCS": err})
+		uploader := upload.NewMultiUploader(backends, upload.ContinueOnPartialFailure, m)
+
+		_, uploadErr := uploader.UploadFile(t.Context(), upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+		assert.ErrorIs(t, uploadErr, err)
+
+		var partialErr *upload.PartialUploadError
+		assert.False(t, errors.As(uploadErr, &partialErr))
+	})
+}
@@ -0,0 +1,291 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mirrorer/internal/aws_client_interfaces"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, other than the last part
+const MinPartSize = 5 * 1024 * 1024
+
+// MaxParts is the largest number of parts S3 accepts in a multipart upload
+const MaxParts = 10000
+
+// MultipartOptions configures when and how files are uploaded to S3 in multiple parts
+type MultipartOptions struct {
+	// Threshold is the file size in bytes at or above which files are uploaded in parts
+	Threshold int64
+	// PartSize is the size in bytes of each part, S3 requires at least 5 MiB
+	PartSize int64
+	// Concurrency is the number of parts of a file uploaded at the same time
+	Concurrency int
+}
+
+// multipartUpload is an upload that was started but not completed, which can be resumed
+// as long as the content being uploaded hasn't changed
+type multipartUpload struct {
+	uploadID    string
+	contentHash string
+}
+
+// multipartUploads tracks incomplete multipart uploads by destination key, so that
+// retrying a failed upload only sends the parts that are missing
+type multipartUploads struct {
+	mu      sync.Mutex
+	uploads map[string]multipartUpload
+}
+
+func (m *multipartUploads) get(key string) (multipartUpload, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	upload, ok := m.uploads[key]
+	return upload, ok
+}
+
+func (m *multipartUploads) put(key string, upload multipartUpload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uploads[key] = upload
+}
+
+func (m *multipartUploads) delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.uploads, key)
+}
+
+// WithMultipart makes the uploader upload files at or above opts.Threshold in parts,
+// in parallel and with a SHA-256 checksum for each part
+func WithMultipart(opts MultipartOptions) Option {
+	return func(u *S3Uploader) {
+		opts.Concurrency = max(opts.Concurrency, 1)
+		u.multipart = &opts
+		u.multipartUploads = &multipartUploads{uploads: map[string]multipartUpload{}}
+	}
+}
+
+func (u S3Uploader) shouldUploadInParts(size int64) bool {
+	return u.multipart != nil && u.multipart.Threshold > 0 && u.multipart.PartSize > 0 && size >= u.multipart.Threshold
+}
+
+// uploadInParts uploads the file with an S3 multipart upload. If an earlier attempt to upload
+// the same content failed, its upload is resumed and parts that were already uploaded with a
+// matching checksum are not sent again.
+func (u S3Uploader) uploadInParts(ctx context.Context, file io.ReaderAt, size int64, destinationKey string, contentType string, contentHash string, headers ObjectHeaders) (etag string, err error) {
+	partSize := u.multipart.PartSize
+	numParts := int((size + partSize - 1) / partSize)
+	if numParts > MaxParts {
+		return "", fmt.Errorf("file of %d bytes needs %d parts of %d bytes, more than the %d S3 allows", size, numParts, partSize, MaxParts)
+	}
+
+	uploadID, err := u.startOrResumeMultipartUpload(ctx, destinationKey, contentType, contentHash, headers)
+	if err != nil {
+		return "", err
+	}
+
+	uploadedParts, err := u.listUploadedParts(ctx, destinationKey, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	completedParts := make([]types.CompletedPart, numParts)
+
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(u.multipart.Concurrency)
+
+	for i := range numParts {
+		group.Go(func() error {
+			partNumber := int32(i + 1)
+			offset := int64(i) * partSize
+			part := io.NewSectionReader(file, offset, min(partSize, size-offset))
+
+			completedPart, err := u.uploadPart(groupCtx, part, destinationKey, uploadID, partNumber, uploadedParts[partNumber])
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", partNumber, err)
+			}
+
+			completedParts[i] = completedPart
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return "", err
+	}
+
+	output, err := u.s3.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucketName),
+		Key:             aws.String(destinationKey),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	u.multipartUploads.delete(destinationKey)
+
+	return aws.ToString(output.ETag), nil
+}
+
+func (u S3Uploader) startOrResumeMultipartUpload(ctx context.Context, destinationKey string, contentType string, contentHash string, headers ObjectHeaders) (string, error) {
+	if existing, ok := u.multipartUploads.get(destinationKey); ok {
+		if existing.contentHash == contentHash {
+			log.Info().Str("key", destinationKey).Str("upload_id", existing.uploadID).Msg("Resuming multipart upload")
+			return existing.uploadID, nil
+		}
+
+		// the content has changed since the upload was started, so its parts are no use
+		u.abortMultipartUpload(ctx, destinationKey, existing.uploadID)
+	}
+
+	output, err := u.s3.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(u.bucketName),
+		Key:                aws.String(destinationKey),
+		ContentType:        aws.String(contentType),
+		CacheControl:       optionalString(headers.CacheControl),
+		ContentDisposition: optionalString(headers.ContentDisposition),
+		ContentLanguage:    optionalString(headers.ContentLanguage),
+		ContentEncoding:    optionalString(headers.ContentEncoding),
+		ChecksumAlgorithm:  types.ChecksumAlgorithmSha256,
+		Metadata:           objectMetadata(headers, contentHash),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	uploadID := aws.ToString(output.UploadId)
+	u.multipartUploads.put(destinationKey, multipartUpload{uploadID: uploadID, contentHash: contentHash})
+
+	return uploadID, nil
+}
+
+func (u S3Uploader) listUploadedParts(ctx context.Context, destinationKey string, uploadID string) (map[int32]types.Part, error) {
+	uploadedParts := map[int32]types.Part{}
+
+	paginator := s3.NewListPartsPaginator(u.s3, &s3.ListPartsInput{
+		Bucket:   aws.String(u.bucketName),
+		Key:      aws.String(destinationKey),
+		UploadId: aws.String(uploadID),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list uploaded parts: %w", err)
+		}
+
+		for _, part := range page.Parts {
+			uploadedParts[aws.ToInt32(part.PartNumber)] = part
+		}
+	}
+
+	return uploadedParts, nil
+}
+
+// uploadPart uploads a single part, unless it was already uploaded with the same size and checksum
+func (u S3Uploader) uploadPart(ctx context.Context, part *io.SectionReader, destinationKey string, uploadID string, partNumber int32, uploaded types.Part) (types.CompletedPart, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, part); err != nil {
+		return types.CompletedPart{}, err
+	}
+	checksum := base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+
+	if aws.ToInt64(uploaded.Size) == part.Size() && aws.ToString(uploaded.ChecksumSHA256) == checksum {
+		return types.CompletedPart{
+			PartNumber:     aws.Int32(partNumber),
+			ETag:           uploaded.ETag,
+			ChecksumSHA256: aws.String(checksum),
+		}, nil
+	}
+
+	if _, err := part.Seek(0, io.SeekStart); err != nil {
+		return types.CompletedPart{}, err
+	}
+
+	output, err := u.s3.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:            aws.String(u.bucketName),
+		Key:               aws.String(destinationKey),
+		UploadId:          aws.String(uploadID),
+		PartNumber:        aws.Int32(partNumber),
+		Body:              part,
+		ContentLength:     aws.Int64(part.Size()),
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		ChecksumSHA256:    aws.String(checksum),
+	})
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+
+	return types.CompletedPart{
+		PartNumber:     aws.Int32(partNumber),
+		ETag:           output.ETag,
+		ChecksumSHA256: aws.String(checksum),
+	}, nil
+}
+
+func (u S3Uploader) abortMultipartUpload(ctx context.Context, destinationKey string, uploadID string) {
+	_, err := u.s3.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucketName),
+		Key:      aws.String(destinationKey),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		log.Error().Err(err).Str("key", destinationKey).Str("upload_id", uploadID).Msg("Failed to abort multipart upload")
+	}
+	u.multipartUploads.delete(destinationKey)
+}
+
+// AbortAbandonedMultipartUploads aborts every multipart upload in the bucket that was started
+// more than abandonedAfter ago, so that the storage used by their parts is released.
+// It returns the number of uploads that were aborted.
+func AbortAbandonedMultipartUploads(ctx context.Context, s3Client aws_client_interfaces.S3ObjectUploadingAPI, bucketName string, abandonedAfter time.Duration) (int, error) {
+	cutoff := time.Now().Add(-abandonedAfter)
+	aborted := 0
+
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(bucketName)}
+	for {
+		page, err := s3Client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads in bucket %s: %w", bucketName, err)
+		}
+
+		for _, upload := range page.Uploads {
+			if upload.Initiated == nil || !upload.Initiated.Before(cutoff) {
+				continue
+			}
+
+			_, err := s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucketName),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("failed to abort multipart upload of %s: %w", aws.ToString(upload.Key), err)
+			}
+			aborted++
+		}
+
+		if !aws.ToBool(page.IsTruncated) {
+			return aborted, nil
+		}
+
+		input.KeyMarker = page.NextKeyMarker
+		input.UploadIdMarker = page.NextUploadIdMarker
+	}
+}
@@ -0,0 +1,214 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mirrorer/internal/aws_client_mocks"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Base64(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func newMultipartS3Client() *aws_client_mocks.FakeS3ObjectUploadingAPI {
+	s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+	s3Client.HeadObjectReturns(nil, &types.NotFound{})
+	s3Client.CreateMultipartUploadReturns(&s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil)
+	s3Client.ListPartsReturns(&s3.ListPartsOutput{}, nil)
+	s3Client.UploadPartStub = func(ctx context.Context, input *s3.UploadPartInput, f ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+		return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", aws.ToInt32(input.PartNumber)))}, nil
+	}
+	s3Client.CompleteMultipartUploadReturns(&s3.CompleteMultipartUploadOutput{ETag: aws.String("etag-3")}, nil)
+	return s3Client
+}
+
+var testMultipartOptions = MultipartOptions{Threshold: 10, PartSize: 4, Concurrency: 2}
+
+func TestS3UploaderMultipart(t *testing.T) {
+	t.Run("uploads files below the threshold in a single request", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "012345678",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := newMultipartS3Client()
+		uploader := NewUploader(s3Client, "test-bucket", WithMultipart(testMultipartOptions))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/plain"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 1, s3Client.PutObjectCallCount())
+		assert.Equal(t, 0, s3Client.CreateMultipartUploadCallCount())
+	})
+
+	t.Run("uploads files at or above the threshold in parts with checksums", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "0123456789",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := newMultipartS3Client()
+		uploader := NewUploader(s3Client, "test-bucket", WithMultipart(testMultipartOptions))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/plain"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedNew, outcome)
+
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+		assert.Equal(t, 1, s3Client.CreateMultipartUploadCallCount())
+
+		_, createArgs, _ := s3Client.CreateMultipartUploadArgsForCall(0)
+		assert.Equal(t, aws.String("key"), createArgs.Key)
+		assert.Equal(t, aws.String("text/plain"), createArgs.ContentType)
+		assert.Equal(t, types.ChecksumAlgorithmSha256, createArgs.ChecksumAlgorithm)
+		assert.Equal(t, sha256Hex("0123456789"), createArgs.Metadata[ContentHashMetadataKey])
+
+		assert.Equal(t, 3, s3Client.UploadPartCallCount())
+		checksums := map[int32]string{}
+		for i := range s3Client.UploadPartCallCount() {
+			_, partArgs, _ := s3Client.UploadPartArgsForCall(i)
+			assert.Equal(t, aws.String("upload-1"), partArgs.UploadId)
+			checksums[aws.ToInt32(partArgs.PartNumber)] = aws.ToString(partArgs.ChecksumSHA256)
+		}
+		assert.Equal(t, map[int32]string{
+			1: sha256Base64("0123"),
+			2: sha256Base64("4567"),
+			3: sha256Base64("89"),
+		}, checksums)
+
+		assert.Equal(t, 1, s3Client.CompleteMultipartUploadCallCount())
+		_, completeArgs, _ := s3Client.CompleteMultipartUploadArgsForCall(0)
+		assert.Equal(t, []types.CompletedPart{
+			{PartNumber: aws.Int32(1), ETag: aws.String("etag-1"), ChecksumSHA256: aws.String(sha256Base64("0123"))},
+			{PartNumber: aws.Int32(2), ETag: aws.String("etag-2"), ChecksumSHA256: aws.String(sha256Base64("4567"))},
+			{PartNumber: aws.Int32(3), ETag: aws.String("etag-3"), ChecksumSHA256: aws.String(sha256Base64("89"))},
+		}, completeArgs.MultipartUpload.Parts)
+	})
+
+	t.Run("resumes a failed upload without sending parts that were already uploaded", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": "0123456789",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := newMultipartS3Client()
+		s3Client.CompleteMultipartUploadReturnsOnCall(0, nil, errors.New("connection reset"))
+		s3Client.CompleteMultipartUploadReturnsOnCall(1, &s3.CompleteMultipartUploadOutput{}, nil)
+		uploader := NewUploader(s3Client, "test-bucket", WithMultipart(testMultipartOptions))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/plain"})
+		assert.Error(t, err)
+
+		s3Client.ListPartsReturns(&s3.ListPartsOutput{
+			Parts: []types.Part{
+				{PartNumber: aws.Int32(1), Size: aws.Int64(4), ETag: aws.String("etag-1"), ChecksumSHA256: aws.String(sha256Base64("0123"))},
+				{PartNumber: aws.Int32(2), Size: aws.Int64(4), ETag: aws.String("etag-2"), ChecksumSHA256: aws.String(sha256Base64("4567"))},
+				// a part with a checksum that doesn't match is uploaded again
+				{PartNumber: aws.Int32(3), Size: aws.Int64(2), ETag: aws.String("etag-3"), ChecksumSHA256: aws.String(sha256Base64("xx"))},
+			},
+		}, nil)
+
+		_, err = uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/plain"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 1, s3Client.CreateMultipartUploadCallCount(), "the upload should be resumed")
+		assert.Equal(t, 4, s3Client.UploadPartCallCount(), "only the mismatched part should be uploaded again")
+		_, partArgs, _ := s3Client.UploadPartArgsForCall(3)
+		assert.Equal(t, aws.Int32(3), partArgs.PartNumber)
+		assert.Equal(t, 0, s3Client.AbortMultipartUploadCallCount())
+	})
+
+	t.Run("starts a new upload if the content changed since the failed upload", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file":       "0123456789",
+			"changed_file": "9876543210",
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := newMultipartS3Client()
+		s3Client.CompleteMultipartUploadReturnsOnCall(0, nil, errors.New("connection reset"))
+		s3Client.CompleteMultipartUploadReturnsOnCall(1, &s3.CompleteMultipartUploadOutput{}, nil)
+		uploader := NewUploader(s3Client, "test-bucket", WithMultipart(testMultipartOptions))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/plain"})
+		assert.Error(t, err)
+
+		_, err = uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "changed_file"), Key: "key", ContentType: "text/plain"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 2, s3Client.CreateMultipartUploadCallCount())
+		assert.Equal(t, 1, s3Client.AbortMultipartUploadCallCount())
+		_, abortArgs, _ := s3Client.AbortMultipartUploadArgsForCall(0)
+		assert.Equal(t, aws.String("upload-1"), abortArgs.UploadId)
+	})
+
+	t.Run("returns an error without starting an upload if the file needs too many parts", func(t *testing.T) {
+		tmpDir := setupFixtures(t, map[string]string{
+			"a_file": strings.Repeat("0", MaxParts+1),
+		})
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := newMultipartS3Client()
+		uploader := NewUploader(s3Client, "test-bucket", WithMultipart(MultipartOptions{Threshold: 10, PartSize: 1}))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/plain"})
+		assert.ErrorContains(t, err, "needs 10001 parts of 1 bytes, more than the 10000 S3 allows")
+
+		assert.Equal(t, 0, s3Client.CreateMultipartUploadCallCount())
+	})
+}
+
+func TestAbortAbandonedMultipartUploads(t *testing.T) {
+	t.Run("aborts uploads started before the cutoff across pages", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.ListMultipartUploadsReturnsOnCall(0, &s3.ListMultipartUploadsOutput{
+			Uploads: []types.MultipartUpload{
+				{Key: aws.String("old"), UploadId: aws.String("upload-1"), Initiated: aws.Time(time.Now().Add(-48 * time.Hour))},
+				{Key: aws.String("recent"), UploadId: aws.String("upload-2"), Initiated: aws.Time(time.Now().Add(-time.Hour))},
+			},
+			IsTruncated:        aws.Bool(true),
+			NextKeyMarker:      aws.String("recent"),
+			NextUploadIdMarker: aws.String("upload-2"),
+		}, nil)
+		s3Client.ListMultipartUploadsReturnsOnCall(1, &s3.ListMultipartUploadsOutput{
+			Uploads: []types.MultipartUpload{
+				{Key: aws.String("older"), UploadId: aws.String("upload-3"), Initiated: aws.Time(time.Now().Add(-72 * time.Hour))},
+			},
+		}, nil)
+
+		aborted, err := AbortAbandonedMultipartUploads(t.Context(), s3Client, "test-bucket", 24*time.Hour)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, aborted)
+
+		_, secondListArgs, _ := s3Client.ListMultipartUploadsArgsForCall(1)
+		assert.Equal(t, aws.String("recent"), secondListArgs.KeyMarker)
+		assert.Equal(t, aws.String("upload-2"), secondListArgs.UploadIdMarker)
+
+		assert.Equal(t, 2, s3Client.AbortMultipartUploadCallCount())
+		_, firstAbortArgs, _ := s3Client.AbortMultipartUploadArgsForCall(0)
+		assert.Equal(t, aws.String("old"), firstAbortArgs.Key)
+		_, secondAbortArgs, _ := s3Client.AbortMultipartUploadArgsForCall(1)
+		assert.Equal(t, aws.String("older"), secondAbortArgs.Key)
+	})
+
+	t.Run("returns an error if listing uploads fails", func(t *testing.T) {
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.ListMultipartUploadsReturns(nil, errors.New("access denied"))
+
+		_, err := AbortAbandonedMultipartUploads(t.Context(), s3Client, "test-bucket", 24*time.Hour)
+		assert.ErrorContains(t, err, "access denied")
+	})
+}
@@ -0,0 +1,200 @@
+package upload
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"mime"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Placeholders that can be used in the metadata values of an ObjectPolicy
+const (
+	SourceURLPlaceholder = "{source_url}"
+	RunIDPlaceholder     = "{run_id}"
+)
+
+// ObjectPolicy decides the caching headers and metadata objects are uploaded with
+type ObjectPolicy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule applies its headers and metadata to objects matching both its path pattern and
+// one of its media types. A rule without a path pattern or media types matches every object.
+type PolicyRule struct {
+	// PathPattern is a regular expression matched against the destination key
+	PathPattern string `json:"path_pattern,omitempty"`
+	// MediaTypes are media types such as text/html, or a wildcard such as image/*
+	MediaTypes         []string          `json:"media_types,omitempty"`
+	CacheControl       string            `json:"cache_control,omitempty"`
+	ContentDisposition string            `json:"content_disposition,omitempty"`
+	ContentLanguage    string            `json:"content_language,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+
+	pathRegexp *regexp.Regexp
+}
+
+// ObjectHeaders are the headers and metadata an object is uploaded with
+type ObjectHeaders struct {
+	CacheControl       string
+	ContentDisposition string
+	ContentLanguage    string
+	// ContentEncoding is set by the uploader when it compresses the file, never by the policy
+	ContentEncoding string
+	Metadata        map[string]string
+}
+
+// DefaultObjectPolicy makes caches revalidate the freshness marker and run info, caches
+// fingerprinted assets forever, HTML for five minutes and everything else for an hour, and
+// records where each object was crawled from
+func DefaultObjectPolicy() *ObjectPolicy {
+	policy, err := NewObjectPolicy([]PolicyRule{
+		{
+			PathPattern:  `(^|/)(last-updated\.txt|run-info\.json)$`,
+			CacheControl: "no-cache",
+		},
+		{
+			PathPattern:  `-[0-9a-f]{8,}\.[0-9a-z]+$`,
+			CacheControl: "public, max-age=31536000, immutable",
+		},
+		{
+			MediaTypes:   []string{"text/html"},
+			CacheControl: "public, max-age=300",
+		},
+		{
+			CacheControl: "public, max-age=3600",
+			Metadata: map[string]string{
+				"source-url":   SourceURLPlaceholder,
+				"crawl-run-id": RunIDPlaceholder,
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return policy
+}
+
+// LoadObjectPolicy reads an ObjectPolicy from a JSON file
+func LoadObjectPolicy(path string) (*ObjectPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object policy %s: %w", path, err)
+	}
+
+	policy := ObjectPolicy{}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse object policy %s: %w", path, err)
+	}
+
+	return NewObjectPolicy(policy.Rules)
+}
+
+// NewObjectPolicy validates the rules and compiles their path patterns
+func NewObjectPolicy(rules []PolicyRule) (*ObjectPolicy, error) {
+	var errs []error
+
+	for i := range rules {
+		rule := &rules[i]
+
+		if rule.PathPattern != "" {
+			pathRegexp, err := regexp.Compile(rule.PathPattern)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("rule %d: invalid path pattern: %w", i, err))
+			}
+			rule.pathRegexp = pathRegexp
+		}
+
+		for _, mediaType := range rule.MediaTypes {
+			if !strings.Contains(mediaType, "/") {
+				errs = append(errs, fmt.Errorf("rule %d: invalid media type %q", i, mediaType))
+			}
+		}
+
+		for key := range rule.Metadata {
+			if key == "" || key == ContentHashMetadataKey {
+				errs = append(errs, fmt.Errorf("rule %d: metadata key %q is not allowed", i, key))
+			}
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return &ObjectPolicy{Rules: rules}, nil
+}
+
+// Resolve returns the headers and metadata for the file. Each header comes from the first
+// matching rule that sets it, and metadata is merged from every matching rule with earlier
+// rules taking precedence. Metadata placeholders are replaced with the source URL of the
+// file and the crawl run ID, and metadata that resolves to an empty value is left out.
+func (p *ObjectPolicy) Resolve(f File, runID string) ObjectHeaders {
+	headers := ObjectHeaders{Metadata: map[string]string{}}
+	if p == nil {
+		return headers
+	}
+
+	mediaType, _, err := mime.ParseMediaType(f.ContentType)
+	if err != nil {
+		mediaType = f.ContentType
+	}
+
+	replacer := strings.NewReplacer(SourceURLPlaceholder, f.SourceURL, RunIDPlaceholder, runID)
+
+	for _, rule := range p.Rules {
+		if !rule.matches(f.Key, mediaType) {
+			continue
+		}
+
+		headers.CacheControl = firstNonEmpty(headers.CacheControl, rule.CacheControl)
+		headers.ContentDisposition = firstNonEmpty(headers.ContentDisposition, rule.ContentDisposition)
+		headers.ContentLanguage = firstNonEmpty(headers.ContentLanguage, rule.ContentLanguage)
+
+		for key, value := range rule.Metadata {
+			if _, ok := headers.Metadata[key]; !ok {
+				headers.Metadata[key] = replacer.Replace(value)
+			}
+		}
+	}
+
+	maps.DeleteFunc(headers.Metadata, func(_ string, value string) bool {
+		return value == ""
+	})
+
+	return headers
+}
+
+func (r PolicyRule) matches(key string, mediaType string) bool {
+	if r.pathRegexp != nil && !r.pathRegexp.MatchString(key) {
+		return false
+	}
+
+	if len(r.MediaTypes) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.MediaTypes {
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
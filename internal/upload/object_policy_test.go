@@ -0,0 +1,134 @@
+package upload
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultObjectPolicy(t *testing.T) {
+	policy := DefaultObjectPolicy()
+
+	tests := []struct {
+		name     string
+		file     File
+		expected ObjectHeaders
+	}{
+		{
+			name: "fingerprinted asset",
+			file: File{Key: "www.gov.uk/assets/static/application-1a2b3c4d5e6f.css", ContentType: "text/css", SourceURL: "https://www.gov.uk/assets/static/application-1a2b3c4d5e6f.css"},
+			expected: ObjectHeaders{
+				CacheControl: "public, max-age=31536000, immutable",
+				Metadata: map[string]string{
+					"source-url":   "https://www.gov.uk/assets/static/application-1a2b3c4d5e6f.css",
+					"crawl-run-id": "run-1",
+				},
+			},
+		},
+		{
+			name: "HTML page",
+			file: File{Key: "www.gov.uk/browse.html", ContentType: "text/html; charset=utf-8", SourceURL: "https://www.gov.uk/browse"},
+			expected: ObjectHeaders{
+				CacheControl: "public, max-age=300",
+				Metadata: map[string]string{
+					"source-url":   "https://www.gov.uk/browse",
+					"crawl-run-id": "run-1",
+				},
+			},
+		},
+		{
+			name: "freshness marker",
+			file: File{Key: "snapshots/run-1/www.gov.uk/last-updated.txt", ContentType: "text/plain; charset=utf-8"},
+			expected: ObjectHeaders{
+				CacheControl: "no-cache",
+				Metadata: map[string]string{
+					"crawl-run-id": "run-1",
+				},
+			},
+		},
+		{
+			name: "other file without a source URL",
+			file: File{Key: "www.gov.uk/guidance.pdf", ContentType: "application/pdf"},
+			expected: ObjectHeaders{
+				CacheControl: "public, max-age=3600",
+				Metadata: map[string]string{
+					"crawl-run-id": "run-1",
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, policy.Resolve(tt.file, "run-1"))
+		})
+	}
+}
+
+func TestObjectPolicy(t *testing.T) {
+	t.Run("takes each header from the first matching rule that sets it", func(t *testing.T) {
+		policy, err := NewObjectPolicy([]PolicyRule{
+			{MediaTypes: []string{"image/*"}, CacheControl: "max-age=60"},
+			{PathPattern: `\.pdf$`, ContentDisposition: "attachment", Metadata: map[string]string{"kind": "document"}},
+			{CacheControl: "max-age=10", ContentLanguage: "en", Metadata: map[string]string{"kind": "other", "run": RunIDPlaceholder}},
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, ObjectHeaders{
+			CacheControl:       "max-age=10",
+			ContentDisposition: "attachment",
+			ContentLanguage:    "en",
+			Metadata:           map[string]string{"kind": "document", "run": "run-1"},
+		}, policy.Resolve(File{Key: "www.gov.uk/file.pdf", ContentType: "application/pdf"}, "run-1"))
+
+		assert.Equal(t, ObjectHeaders{
+			CacheControl:    "max-age=60",
+			ContentLanguage: "en",
+			Metadata:        map[string]string{"kind": "other", "run": "run-1"},
+		}, policy.Resolve(File{Key: "www.gov.uk/image.png", ContentType: "image/png"}, "run-1"))
+	})
+
+	t.Run("a nil policy sets nothing", func(t *testing.T) {
+		var policy *ObjectPolicy
+		assert.Equal(t, ObjectHeaders{Metadata: map[string]string{}}, policy.Resolve(File{Key: "key"}, "run-1"))
+	})
+
+	t.Run("rejects invalid rules", func(t *testing.T) {
+		_, err := NewObjectPolicy([]PolicyRule{
+			{PathPattern: "("},
+			{MediaTypes: []string{"html"}},
+			{Metadata: map[string]string{ContentHashMetadataKey: "value"}},
+		})
+		assert.ErrorContains(t, err, "rule 0: invalid path pattern")
+		assert.ErrorContains(t, err, `rule 1: invalid media type "html"`)
+		assert.ErrorContains(t, err, `rule 2: metadata key "content-sha256" is not allowed`)
+	})
+
+	t.Run("loads a policy from a JSON file", func(t *testing.T) {
+		policyFile := filepath.Join(t.TempDir(), "policy.json")
+		err := os.WriteFile(policyFile, []byte(`{
+			"rules": [
+				{"media_types": ["text/html"], "cache_control": "no-cache", "metadata": {"source-url": "{source_url}"}}
+			]
+		}`), 0644)
+		assert.NoError(t, err)
+
+		policy, err := LoadObjectPolicy(policyFile)
+		assert.NoError(t, err)
+
+		assert.Equal(t, ObjectHeaders{
+			CacheControl: "no-cache",
+			Metadata:     map[string]string{"source-url": "https://www.gov.uk/"},
+		}, policy.Resolve(File{Key: "www.gov.uk/index.html", ContentType: "text/html", SourceURL: "https://www.gov.uk/"}, "run-1"))
+	})
+
+	t.Run("returns an error if the file is not valid JSON", func(t *testing.T) {
+		policyFile := filepath.Join(t.TempDir(), "policy.json")
+		assert.NoError(t, os.WriteFile(policyFile, []byte(`rules:`), 0644))
+
+		_, err := LoadObjectPolicy(policyFile)
+		assert.ErrorContains(t, err, "failed to parse object policy")
+	})
+}
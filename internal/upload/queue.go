@@ -0,0 +1,231 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"mirrorer/internal/metrics"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/rs/zerolog/log"
+)
+
+// retryableErrorCodes are the AWS error codes returned when S3 is throttling requests or temporarily unavailable
+var retryableErrorCodes = []string{
+	"SlowDown",
+	"Throttling",
+	"ThrottlingException",
+	"RequestLimitExceeded",
+	"RequestTimeout",
+	"ServiceUnavailable",
+	"InternalError",
+}
+
+// QueueOptions configures the worker pool of a Queue
+type QueueOptions struct {
+	// Workers is the number of files uploaded concurrently
+	Workers int
+	// Size is the number of files that can wait to be uploaded before Enqueue blocks
+	Size int
+	// MaxRetries is the number of times an upload that failed with a retryable error is retried
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubling with each attempt
+	RetryBackoff time.Duration
+	// KeyPrefix is prepended to the key of every file, such as the prefix of a snapshot
+	KeyPrefix string
+	// Manifest, if set, records every file that was uploaded or failed to upload
+	Manifest *Manifest
+	// ManifestDigests records the size and SHA-256 digest of each uploaded file in the manifest,
+	// which means reading the file again, so it is only worth it when the manifest is saved
+	ManifestDigests bool
+	// DeleteAfterUpload deletes the local copy of each file once it has been uploaded
+	DeleteAfterUpload bool
+}
+
+// Queue uploads files with a bounded pool of workers, so that crawling isn't held up by
+// slow uploads. Enqueue blocks when the queue is full, applying back-pressure to the crawler.
+type Queue struct {
+	uploader Uploader
+	metrics  *metrics.Metrics
+	opts     QueueOptions
+	files    chan File
+	wg       sync.WaitGroup
+	// localSizes holds the size of each local file counted towards the disk usage, so that a
+	// path written again, such as a page crawled twice, replaces its old size instead of adding to it
+	localSizesMu sync.Mutex
+	localSizes   map[string]int64
+}
+
+func NewQueue(uploader Uploader, m *metrics.Metrics, opts QueueOptions) *Queue {
+	opts.Workers = max(opts.Workers, 1)
+	opts.Size = max(opts.Size, 0)
+	opts.MaxRetries = max(opts.MaxRetries, 0)
+
+	return &Queue{
+		uploader:   uploader,
+		metrics:    m,
+		opts:       opts,
+		files:      make(chan File, opts.Size),
+		localSizes: map[string]int64{},
+	}
+}
+
+// Start launches the workers, which upload files until the queue is closed
+func (q *Queue) Start(ctx context.Context) {
+	for range q.opts.Workers {
+		q.wg.Go(func() {
+			for f := range q.files {
+				metrics.UploadQueueDequeued(q.metrics)
+				_ = q.upload(ctx, f)
+			}
+		})
+	}
+}
+
+// Enqueue adds a file to the queue, blocking until there is space for it
+func (q *Queue) Enqueue(f File) {
+	q.trackLocalFile(f)
+	metrics.UploadQueueEnqueued(q.metrics)
+	q.files <- f
+}
+
+// Close stops accepting files and waits for every queued file to be uploaded
+func (q *Queue) Close() {
+	close(q.files)
+	q.wg.Wait()
+}
+
+// UploadNow uploads a file straight away instead of queueing it for the workers,
+// returning once it has been uploaded. It can still be used after the queue is closed.
+func (q *Queue) UploadNow(ctx context.Context, f File) error {
+	q.trackLocalFile(f)
+	return q.upload(ctx, f)
+}
+
+func (q *Queue) upload(ctx context.Context, f File) error {
+	f.Key = q.opts.KeyPrefix + f.Key
+
+	startTime := time.Now()
+	outcome, err := q.uploadWithRetries(ctx, f)
+	metrics.UploadDuration(q.metrics, time.Since(startTime))
+
+	// the file reached some backends, so the crawl carries on, but the local copy is kept
+	// as the file still needs uploading to the others
+	var partialErr *PartialUploadError
+	if errors.As(err, &partialErr) {
+		log.Warn().Err(err).Str("file", f.Path).Msg("File was not uploaded to every backend, continuing")
+		metrics.FileUploaded(q.metrics)
+		q.opts.Manifest.RecordPartiallyFailed(f.Key, partialErr.Backends())
+		metrics.UploadDecision(q.metrics, string(partialErr.Outcome))
+		return nil
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg(fmt.Sprintf("Error uploading %s", f.Path))
+		metrics.FileUploadFailed(q.metrics)
+		q.opts.Manifest.RecordFailed(f.Key)
+		return err
+	}
+
+	metrics.FileUploaded(q.metrics)
+	q.recordUploaded(f)
+	metrics.UploadDecision(q.metrics, string(outcome))
+
+	if q.opts.DeleteAfterUpload {
+		q.deleteLocalFile(f)
+	}
+	return nil
+}
+
+func (q *Queue) recordUploaded(f File) {
+	if q.opts.Manifest == nil {
+		return
+	}
+
+	if !q.opts.ManifestDigests {
+		q.opts.Manifest.RecordUploaded(ManifestEntry{Key: f.Key, ContentType: f.ContentType})
+		return
+	}
+
+	entry, err := NewManifestEntry(f)
+	if err != nil {
+		log.Warn().Err(err).Str("key", f.Key).Msg("Error describing uploaded file for the manifest")
+	}
+	q.opts.Manifest.RecordUploaded(entry)
+}
+
+// trackLocalFile counts the file towards the local disk usage, replacing the size it was
+// counted with before if the path was already tracked
+func (q *Queue) trackLocalFile(f File) {
+	info, err := os.Stat(f.Path)
+	if err != nil {
+		return
+	}
+
+	q.localSizesMu.Lock()
+	previous := q.localSizes[f.Path]
+	q.localSizes[f.Path] = info.Size()
+	q.localSizesMu.Unlock()
+
+	metrics.LocalFileDeleted(q.metrics, previous)
+	metrics.LocalFileStored(q.metrics, info.Size())
+}
+
+func (q *Queue) deleteLocalFile(f File) {
+	if err := os.Remove(f.Path); err != nil {
+		log.Warn().Err(err).Str("file", f.Path).Msg("Error deleting uploaded file")
+		return
+	}
+
+	q.localSizesMu.Lock()
+	size := q.localSizes[f.Path]
+	delete(q.localSizes, f.Path)
+	q.localSizesMu.Unlock()
+
+	metrics.LocalFileDeleted(q.metrics, size)
+}
+
+func (q *Queue) uploadWithRetries(ctx context.Context, f File) (Outcome, error) {
+	backoff := q.opts.RetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		outcome, err := q.uploader.UploadFile(ctx, f)
+		if err == nil || attempt >= q.opts.MaxRetries || !IsRetryable(err) {
+			return outcome, err
+		}
+
+		// full jitter, so that throttled workers don't retry in lockstep
+		delay := time.Duration(rand.Int64N(int64(backoff) + 1))
+		log.Warn().Err(err).Str("file", f.Path).Int("attempt", attempt+1).Dur("delay", delay).Msg("Retrying upload")
+
+		select {
+		case <-ctx.Done():
+			return "", errors.Join(err, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		backoff *= 2
+	}
+}
+
+// IsRetryable reports whether an upload failed because the remote file storage
+// is throttling requests or temporarily unavailable
+func IsRetryable(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && slices.Contains(retryableErrorCodes, apiErr.ErrorCode()) {
+		return true
+	}
+
+	var gcsErr *GCSAPIError
+	if errors.As(err, &gcsErr) {
+		return gcsErr.StatusCode == http.StatusTooManyRequests || gcsErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	return false
+}
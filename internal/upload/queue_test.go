@@ -0,0 +1,325 @@
+package upload_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mirrorer/internal/metrics"
+	"mirrorer/internal/upload"
+	"mirrorer/internal/upload/uploadfakes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var slowDownErr = &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."}
+
+func TestQueue(t *testing.T) {
+	t.Run("uploads every queued file before Close returns", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileReturns(upload.OutcomeUploadedNew, nil)
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{Workers: 3, Size: 2})
+		queue.Start(t.Context())
+		for i := range 10 {
+			queue.Enqueue(upload.File{Path: fmt.Sprintf("path/%d", i), Key: fmt.Sprintf("key/%d", i), ContentType: "text/html"})
+		}
+		queue.Close()
+
+		assert.Equal(t, 10, uploader.UploadFileCallCount())
+		assert.Equal(t, float64(10), testutil.ToFloat64(m.FileUploadCounter()))
+		assert.Equal(t, float64(10), testutil.ToFloat64(m.UploadDecisionCounter().WithLabelValues("uploaded_new")))
+		assert.Equal(t, float64(0), testutil.ToFloat64(m.UploadQueueDepth()))
+		assert.Equal(t, 1, testutil.CollectAndCount(m.UploadDuration()))
+	})
+
+	t.Run("retries uploads that are throttled", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			m := metrics.NewMetrics(prometheus.NewRegistry())
+			uploader := &uploadfakes.FakeUploader{}
+			uploader.UploadFileReturnsOnCall(0, "", slowDownErr)
+			uploader.UploadFileReturnsOnCall(1, "", slowDownErr)
+			uploader.UploadFileReturnsOnCall(2, upload.OutcomeUploadedChanged, nil)
+
+			queue := upload.NewQueue(uploader, m, upload.QueueOptions{MaxRetries: 3, RetryBackoff: time.Second})
+			queue.Start(t.Context())
+			queue.Enqueue(upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+			queue.Close()
+
+			assert.Equal(t, 3, uploader.UploadFileCallCount())
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.FileUploadCounter()))
+			assert.Equal(t, float64(0), testutil.ToFloat64(m.FileUploadFailuresCounter()))
+		})
+	})
+
+	t.Run("gives up after the maximum number of retries", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			m := metrics.NewMetrics(prometheus.NewRegistry())
+			uploader := &uploadfakes.FakeUploader{}
+			uploader.UploadFileReturns("", slowDownErr)
+
+			queue := upload.NewQueue(uploader, m, upload.QueueOptions{MaxRetries: 2, RetryBackoff: time.Second})
+			queue.Start(t.Context())
+			queue.Enqueue(upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+			queue.Close()
+
+			assert.Equal(t, 3, uploader.UploadFileCallCount())
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.FileUploadFailuresCounter()))
+		})
+	})
+
+	t.Run("does not retry errors that are not retryable", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileReturns("", &types.InvalidRequest{})
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{MaxRetries: 5})
+		queue.Start(t.Context())
+		queue.Enqueue(upload.File{Path: "path", Key: "key", ContentType: "text/html"})
+		queue.Close()
+
+		assert.Equal(t, 1, uploader.UploadFileCallCount())
+		assert.Equal(t, float64(1), testutil.ToFloat64(m.FileUploadFailuresCounter()))
+	})
+
+	t.Run("prefixes keys and records them in the manifest", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileStub = func(ctx context.Context, f upload.File) (upload.Outcome, error) {
+			if f.Path == "broken" {
+				return "", errors.New("file not found")
+			}
+			return upload.OutcomeUploadedNew, nil
+		}
+		manifest := upload.NewManifest()
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{KeyPrefix: "snapshots/run-1/", Manifest: manifest})
+		queue.Start(t.Context())
+		queue.Enqueue(upload.File{Path: "path", Key: "key"})
+		queue.Enqueue(upload.File{Path: "broken", Key: "broken-key"})
+		queue.Close()
+
+		_, f := uploader.UploadFileArgsForCall(0)
+		assert.Equal(t, "snapshots/run-1/key", f.Key)
+		assert.Equal(t, []string{"snapshots/run-1/key"}, manifest.Uploaded())
+		assert.Equal(t, []string{"snapshots/run-1/broken-key"}, manifest.Failed())
+	})
+
+	t.Run("only reads uploaded files for the manifest when asked for digests", func(t *testing.T) {
+		tests := []struct {
+			name            string
+			manifestDigests bool
+			expected        upload.ManifestEntry
+		}{
+			{
+				name:     "without digests",
+				expected: upload.ManifestEntry{Key: "key", ContentType: "text/html"},
+			},
+			{
+				name:            "with digests",
+				manifestDigests: true,
+				expected:        upload.ManifestEntry{Key: "key", ContentType: "text/html", Size: 7, SHA256: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tmpDir := t.TempDir()
+				filePath := filepath.Join(tmpDir, "index.html")
+				assert.NoError(t, os.WriteFile(filePath, []byte("content"), 0644))
+
+				uploader := &uploadfakes.FakeUploader{}
+				uploader.UploadFileReturns(upload.OutcomeUploadedNew, nil)
+				manifest := upload.NewManifest()
+
+				queue := upload.NewQueue(uploader, metrics.NewMetrics(prometheus.NewRegistry()), upload.QueueOptions{
+					Manifest:        manifest,
+					ManifestDigests: tt.manifestDigests,
+				})
+				assert.NoError(t, queue.UploadNow(t.Context(), upload.File{Path: filePath, Key: "key", ContentType: "text/html"}))
+
+				manifestPath := filepath.Join(tmpDir, "manifest.json")
+				assert.NoError(t, manifest.WriteFile(manifestPath, "run-1", ""))
+				manifestFile, err := upload.ReadManifestFile(manifestPath)
+				assert.NoError(t, err)
+				assert.Equal(t, []upload.ManifestEntry{tt.expected}, manifestFile.Files)
+			})
+		}
+	})
+
+	t.Run("UploadNow uploads straight away, even after Close", func(t *testing.T) {
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileReturnsOnCall(0, upload.OutcomeUploadedNew, nil)
+		uploader.UploadFileReturnsOnCall(1, "", errors.New("file not found"))
+		manifest := upload.NewManifest()
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{KeyPrefix: "snapshots/run-1/", Manifest: manifest})
+		queue.Start(t.Context())
+		queue.Close()
+
+		err := queue.UploadNow(t.Context(), upload.File{Path: "path", Key: "key"})
+		assert.NoError(t, err)
+		err = queue.UploadNow(t.Context(), upload.File{Path: "broken", Key: "broken-key"})
+		assert.ErrorContains(t, err, "file not found")
+
+		assert.Equal(t, 2, uploader.UploadFileCallCount())
+		assert.Equal(t, []string{"snapshots/run-1/key"}, manifest.Uploaded())
+		assert.Equal(t, []string{"snapshots/run-1/broken-key"}, manifest.Failed())
+	})
+
+	t.Run("deletes local files once they are uploaded, keeping those that failed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		uploadedPath, failedPath := filepath.Join(tmpDir, "uploaded.html"), filepath.Join(tmpDir, "failed.html")
+		assert.NoError(t, os.WriteFile(uploadedPath, []byte("uploaded"), 0644))
+		assert.NoError(t, os.WriteFile(failedPath, []byte("failed"), 0644))
+
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileStub = func(ctx context.Context, f upload.File) (upload.Outcome, error) {
+			if f.Path == failedPath {
+				return "", errors.New("access denied")
+			}
+			return upload.OutcomeUploadedNew, nil
+		}
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{DeleteAfterUpload: true})
+		queue.Start(t.Context())
+		queue.Enqueue(upload.File{Path: uploadedPath, Key: "uploaded.html"})
+		queue.Enqueue(upload.File{Path: failedPath, Key: "failed.html"})
+		queue.Close()
+
+		assert.NoFileExists(t, uploadedPath)
+		assert.FileExists(t, failedPath)
+		assert.Equal(t, float64(len("failed")), testutil.ToFloat64(m.LocalDiskUsage()))
+	})
+
+	t.Run("keeps local files that were only uploaded to some backends, recording them as partially failed", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		partialPath := filepath.Join(tmpDir, "partial.html")
+		assert.NoError(t, os.WriteFile(partialPath, []byte("partial"), 0644))
+
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileReturns(upload.OutcomeUploadedNew, &upload.PartialUploadError{
+			Outcome:  upload.OutcomeUploadedNew,
+			Failures: []*upload.BackendUploadError{{Backend: "mirrorS3Replica", Err: errors.New("access denied")}},
+		})
+		manifest := upload.NewManifest()
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{Manifest: manifest, DeleteAfterUpload: true})
+		err := queue.UploadNow(t.Context(), upload.File{Path: partialPath, Key: "partial.html"})
+		assert.NoError(t, err)
+
+		assert.FileExists(t, partialPath)
+		assert.Empty(t, manifest.Uploaded())
+		assert.Empty(t, manifest.Failed())
+		assert.Equal(t, []string{"partial.html"}, manifest.PartiallyFailed())
+	})
+
+	t.Run("keeps local files by default", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		uploadedPath := filepath.Join(tmpDir, "uploaded.html")
+		assert.NoError(t, os.WriteFile(uploadedPath, []byte("uploaded"), 0644))
+
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileReturns(upload.OutcomeUploadedNew, nil)
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{})
+		queue.Start(t.Context())
+		queue.Enqueue(upload.File{Path: uploadedPath, Key: "uploaded.html"})
+		queue.Close()
+
+		assert.FileExists(t, uploadedPath)
+		assert.Equal(t, float64(len("uploaded")), testutil.ToFloat64(m.LocalDiskUsage()))
+	})
+
+	t.Run("counts a path written again at its latest size", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		pagePath := filepath.Join(tmpDir, "page.html")
+		assert.NoError(t, os.WriteFile(pagePath, []byte("first version"), 0644))
+
+		m := metrics.NewMetrics(prometheus.NewRegistry())
+		uploader := &uploadfakes.FakeUploader{}
+		uploader.UploadFileReturns(upload.OutcomeUploadedNew, nil)
+
+		queue := upload.NewQueue(uploader, m, upload.QueueOptions{})
+		assert.NoError(t, queue.UploadNow(t.Context(), upload.File{Path: pagePath, Key: "page.html"}))
+
+		assert.NoError(t, os.WriteFile(pagePath, []byte("second"), 0644))
+		assert.NoError(t, queue.UploadNow(t.Context(), upload.File{Path: pagePath, Key: "page.html"}))
+
+		assert.Equal(t, float64(len("second")), testutil.ToFloat64(m.LocalDiskUsage()))
+	})
+
+	t.Run("Enqueue blocks while the queue is full", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			m := metrics.NewMetrics(prometheus.NewRegistry())
+			release := make(chan struct{})
+			uploader := &uploadfakes.FakeUploader{}
+			uploader.UploadFileStub = func(ctx context.Context, f upload.File) (upload.Outcome, error) {
+				<-release
+				return upload.OutcomeUploadedNew, nil
+			}
+
+			queue := upload.NewQueue(uploader, m, upload.QueueOptions{Workers: 1, Size: 1})
+			queue.Start(t.Context())
+
+			// the first file is picked up by the worker and the second fills the queue
+			queue.Enqueue(upload.File{Path: "first"})
+			synctest.Wait()
+			queue.Enqueue(upload.File{Path: "second"})
+
+			enqueued := false
+			go func() {
+				queue.Enqueue(upload.File{Path: "third"})
+				enqueued = true
+			}()
+
+			synctest.Wait()
+			assert.False(t, enqueued, "Enqueue should block while the queue is full")
+			assert.Equal(t, float64(2), testutil.ToFloat64(m.UploadQueueDepth()))
+
+			close(release)
+			synctest.Wait()
+			assert.True(t, enqueued)
+
+			queue.Close()
+			assert.Equal(t, 3, uploader.UploadFileCallCount())
+		})
+	})
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"S3 slow down", slowDownErr, true},
+		{"wrapped S3 slow down", fmt.Errorf("failed to write object: %w", slowDownErr), true},
+		{"S3 invalid request", &types.InvalidRequest{}, false},
+		{"GCS too many requests", &upload.GCSAPIError{StatusCode: http.StatusTooManyRequests}, true},
+		{"GCS service unavailable", &upload.GCSAPIError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"GCS forbidden", &upload.GCSAPIError{StatusCode: http.StatusForbidden}, false},
+		{"backend error", &upload.BackendUploadError{Backend: "mirrorS3", Err: slowDownErr}, true},
+		{"other error", errors.New("file not found"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.retryable, upload.IsRetryable(tt.err))
+		})
+	}
+}
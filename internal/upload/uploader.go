@@ -2,11 +2,15 @@ package upload
 
 import (
 	"context"
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"mirrorer/internal/aws_client_interfaces"
 	"os"
 
@@ -20,43 +24,96 @@ import (
 //
 //counterfeiter:generate . Uploader
 type Uploader interface {
-	// UploadFile uploads the file at filePath to the destinationKey in the remote file storage
-	UploadFile(ctx context.Context, filePath string, destinationKey string, contentType string) error
+	// UploadFile uploads the file at f.Path to f.Key in the remote file storage,
+	// unless the remote file storage already holds identical content
+	UploadFile(ctx context.Context, f File) (Outcome, error)
 }
 
+// File is a downloaded file to be uploaded to the remote file storage
+type File struct {
+	// Path is the location of the file on disk
+	Path string
+	// Key is the destination key of the object in the remote file storage
+	Key string
+	// ContentType is the media type the file was served with
+	ContentType string
+	// SourceURL is the URL the file was crawled from
+	SourceURL string
+}
+
+// Outcome describes what an Uploader decided to do with a file
+type Outcome string
+
+const (
+	// OutcomeUploadedNew means the object was not present in the remote file storage
+	OutcomeUploadedNew Outcome = "uploaded_new"
+	// OutcomeUploadedChanged means the object was present but its content or content type had changed
+	OutcomeUploadedChanged Outcome = "uploaded_changed"
+	// OutcomeSkippedIdentical means the object was present with identical content
+	OutcomeSkippedIdentical Outcome = "skipped_identical"
+)
+
+// ContentHashMetadataKey is the object metadata key holding the hex encoded
+// SHA-256 digest of the uploaded content
+const ContentHashMetadataKey = "content-sha256"
+
 type S3Uploader struct {
 	s3         aws_client_interfaces.S3ObjectUploadingAPI
 	bucketName string
+	inventory  *Inventory
+
+	multipart        *MultipartOptions
+	multipartUploads *multipartUploads
+
+	objectPolicy *ObjectPolicy
+	runID        string
+	compression  Compression
+}
+
+// Option configures optional behaviour of an S3Uploader
+type Option func(*S3Uploader)
+
+// WithInventory makes the uploader consult a prefetched bucket inventory
+// instead of looking up each object with HeadObject
+func WithInventory(inventory *Inventory) Option {
+	return func(u *S3Uploader) {
+		u.inventory = inventory
+	}
+}
+
+// WithObjectPolicy makes the uploader set the caching headers and metadata decided by the policy,
+// replacing the run ID placeholder in metadata with runID
+func WithObjectPolicy(policy *ObjectPolicy, runID string) Option {
+	return func(u *S3Uploader) {
+		u.objectPolicy = policy
+		u.runID = runID
+	}
 }
 
-func NewUploader(s3 aws_client_interfaces.S3ObjectUploadingAPI, bucketName string) Uploader {
-	return S3Uploader{
+func NewUploader(s3 aws_client_interfaces.S3ObjectUploadingAPI, bucketName string, opts ...Option) Uploader {
+	u := S3Uploader{
 		s3:         s3,
 		bucketName: bucketName,
 	}
-}
 
-func (u S3Uploader) UploadFile(ctx context.Context, filePath string, destinationKey string, contentType string) error {
-	fileInfo, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return err
+	for _, opt := range opts {
+		opt(&u)
 	}
 
-	s3ObjectMeta, err := u.s3.HeadObject(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(u.bucketName),
-		Key:    aws.String(destinationKey),
-	})
+	return u
+}
 
-	if err != nil {
-		var notFoundErr *types.NotFound
-		if !errors.As(err, &notFoundErr) {
-			return fmt.Errorf("failed to get object metadata: %w", err)
-		}
+func (u S3Uploader) UploadFile(ctx context.Context, f File) (Outcome, error) {
+	filePath, destinationKey, contentType := f.Path, f.Key, f.ContentType
+
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return "", err
 	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file %s: %w", filePath, err)
+		return "", fmt.Errorf("failed to open file %s: %w", filePath, err)
 	}
 	defer (func() {
 		err := file.Close()
@@ -65,38 +122,198 @@ func (u S3Uploader) UploadFile(ctx context.Context, filePath string, destination
 		}
 	})()
 
-	// the object wasn't present in the remote
-	// or the sizes were different
-	if s3ObjectMeta == nil || *s3ObjectMeta.ContentLength != fileInfo.Size() || (s3ObjectMeta.ContentType != nil && *s3ObjectMeta.ContentType != contentType) {
-		if s3ObjectMeta != nil && s3ObjectMeta.ContentType != nil && *s3ObjectMeta.ContentType != contentType {
-			log.Info().Msgf("File %s has a different content type on S3 than live, uploading", filePath)
-		}
+	headers := u.objectPolicy.Resolve(f, u.runID)
 
-		hasher := sha1.New()
+	// body is the content that is uploaded, which is a compressed copy of the file
+	// for text-based files if compression is enabled
+	body, size := file, fileInfo.Size()
+	sha256Hasher := sha256.New()
 
-		if _, err := io.Copy(hasher, file); err != nil {
-			return fmt.Errorf("failed to copy file bytes into hashing buffer %s: %w", filePath, err)
+	if u.shouldCompress(contentType) {
+		compressed, err := compressToTempFile(io.TeeReader(file, sha256Hasher), u.compression)
+		if err != nil {
+			return "", fmt.Errorf("failed to compress file %s: %w", filePath, err)
 		}
-		_, err = file.Seek(0, io.SeekStart)
+		defer removeTempFile(compressed)
+
+		compressedInfo, err := compressed.Stat()
 		if err != nil {
-			return fmt.Errorf("failed to rewind file %s: %w", filePath, err)
+			return "", fmt.Errorf("failed to stat compressed file %s: %w", filePath, err)
 		}
 
-		checksum := base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+		body, size = compressed, compressedInfo.Size()
+		headers.ContentEncoding = string(u.compression)
+	}
 
-		_, err = u.s3.PutObject(ctx, &s3.PutObjectInput{
-			Bucket:            aws.String(u.bucketName),
-			Key:               aws.String(destinationKey),
-			Body:              io.Reader(file),
-			ChecksumAlgorithm: types.ChecksumAlgorithmSha1,
-			ChecksumSHA1:      aws.String(checksum),
-			ContentType:       aws.String(contentType),
-		})
+	sha1Hasher := sha1.New()
+	md5Hasher := md5.New()
+	hashers := []io.Writer{sha1Hasher, md5Hasher}
+	if headers.ContentEncoding == "" {
+		hashers = append(hashers, sha256Hasher)
+	}
 
+	if _, err := io.Copy(io.MultiWriter(hashers...), body); err != nil {
+		return "", fmt.Errorf("failed to copy file bytes into hashing buffer %s: %w", filePath, err)
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("failed to rewind file %s: %w", filePath, err)
+	}
+
+	// the digest of the uncompressed content, so that changing compression
+	// doesn't make every file look like it has changed
+	contentHash := hex.EncodeToString(sha256Hasher.Sum(nil))
+
+	var outcome Outcome
+	if u.inventory != nil {
+		outcome, err = u.compareWithInventory(ctx, filePath, size, hex.EncodeToString(md5Hasher.Sum(nil)), contentHash, destinationKey, contentType, headers)
+	} else {
+		outcome, err = u.compareWithHeadObject(ctx, filePath, contentHash, destinationKey, contentType, headers)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if outcome == OutcomeSkippedIdentical {
+		return outcome, nil
+	}
+
+	if u.shouldUploadInParts(size) {
+		etag, err := u.uploadInParts(ctx, body, size, destinationKey, contentType, contentHash, headers)
 		if err != nil {
-			return fmt.Errorf("failed to write object: %w", err)
+			return "", fmt.Errorf("failed to write object in parts: %w", err)
+		}
+
+		if u.inventory != nil {
+			u.inventory.Put(destinationKey, ObjectInfo{Size: size, ETag: etag, Attributes: newObjectAttributes(contentType, headers)})
 		}
+
+		return outcome, nil
 	}
 
-	return nil
+	checksum := base64.StdEncoding.EncodeToString(sha1Hasher.Sum(nil))
+
+	output, err := u.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(u.bucketName),
+		Key:                aws.String(destinationKey),
+		Body:               io.Reader(body),
+		ChecksumAlgorithm:  types.ChecksumAlgorithmSha1,
+		ChecksumSHA1:       aws.String(checksum),
+		ContentType:        aws.String(contentType),
+		CacheControl:       optionalString(headers.CacheControl),
+		ContentDisposition: optionalString(headers.ContentDisposition),
+		ContentLanguage:    optionalString(headers.ContentLanguage),
+		ContentEncoding:    optionalString(headers.ContentEncoding),
+		Metadata:           objectMetadata(headers, contentHash),
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("failed to write object: %w", err)
+	}
+
+	if u.inventory != nil && output != nil {
+		u.inventory.Put(destinationKey, ObjectInfo{
+			Size:       size,
+			ETag:       aws.ToString(output.ETag),
+			Attributes: newObjectAttributes(contentType, headers),
+		})
+	}
+
+	return outcome, nil
+}
+
+// compareWithHeadObject compares the local file with the SHA-256 digest and content type
+// of the remote object. Objects uploaded before digests were recorded are treated as changed
+// so that they are uploaded again with one.
+func (u S3Uploader) compareWithHeadObject(ctx context.Context, filePath string, contentHash string, destinationKey string, contentType string, headers ObjectHeaders) (Outcome, error) {
+	s3ObjectMeta, err := u.s3.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(u.bucketName),
+		Key:    aws.String(destinationKey),
+	})
+
+	if err != nil {
+		var notFoundErr *types.NotFound
+		if !errors.As(err, &notFoundErr) {
+			return "", fmt.Errorf("failed to get object metadata: %w", err)
+		}
+	}
+
+	if s3ObjectMeta == nil {
+		return OutcomeUploadedNew, nil
+	}
+
+	if s3ObjectMeta.ContentType != nil && *s3ObjectMeta.ContentType != contentType {
+		log.Info().Msgf("File %s has a different content type on S3 than live, uploading", filePath)
+		return OutcomeUploadedChanged, nil
+	}
+
+	if s3ObjectMeta.Metadata[ContentHashMetadataKey] != contentHash {
+		return OutcomeUploadedChanged, nil
+	}
+
+	if aws.ToString(s3ObjectMeta.ContentEncoding) != headers.ContentEncoding {
+		log.Info().Msgf("File %s has a different content encoding on S3 than configured, uploading", filePath)
+		return OutcomeUploadedChanged, nil
+	}
+
+	if u.objectPolicy != nil && !headers.matchesS3Object(s3ObjectMeta) {
+		log.Info().Msgf("File %s has different caching headers on S3 than the object policy, uploading", filePath)
+		return OutcomeUploadedChanged, nil
+	}
+
+	return OutcomeSkippedIdentical, nil
+}
+
+// compareWithInventory compares the local file with the size and MD5 digest of the object
+// in the inventory. Objects uploaded in multiple parts, whose ETag isn't an MD5 digest, fall
+// back to HeadObject, as do objects with the same content whose content type and headers the
+// inventory doesn't know, since those may still differ.
+func (u S3Uploader) compareWithInventory(ctx context.Context, filePath string, size int64, md5Digest string, contentHash string, destinationKey string, contentType string, headers ObjectHeaders) (Outcome, error) {
+	info, ok := u.inventory.Get(destinationKey)
+	if !ok {
+		return OutcomeUploadedNew, nil
+	}
+
+	remoteDigest, ok := info.md5Hex()
+	if !ok {
+		return u.compareWithHeadObject(ctx, filePath, contentHash, destinationKey, contentType, headers)
+	}
+
+	if info.Size != size || remoteDigest != md5Digest {
+		return OutcomeUploadedChanged, nil
+	}
+
+	if info.Attributes == nil {
+		return u.compareWithHeadObject(ctx, filePath, contentHash, destinationKey, contentType, headers)
+	}
+
+	if *info.Attributes != *newObjectAttributes(contentType, headers) {
+		log.Info().Msgf("File %s has a different content type or headers than when it was uploaded, uploading", filePath)
+		return OutcomeUploadedChanged, nil
+	}
+
+	return OutcomeSkippedIdentical, nil
+}
+
+// objectMetadata returns the metadata decided by the object policy along with the content digest
+func objectMetadata(headers ObjectHeaders, contentHash string) map[string]string {
+	metadata := map[string]string{}
+	maps.Copy(metadata, headers.Metadata)
+	metadata[ContentHashMetadataKey] = contentHash
+	return metadata
+}
+
+// matchesS3Object reports whether the object already has the headers. Metadata isn't compared
+// because it may contain values, such as the crawl run ID, that change on every run.
+func (h ObjectHeaders) matchesS3Object(object *s3.HeadObjectOutput) bool {
+	return aws.ToString(object.CacheControl) == h.CacheControl &&
+		aws.ToString(object.ContentDisposition) == h.ContentDisposition &&
+		aws.ToString(object.ContentLanguage) == h.ContentLanguage
+}
+
+func optionalString(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
 }
@@ -1,8 +1,11 @@
 package upload
 
 import (
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"mirrorer/internal/aws_client_mocks"
 	"os"
@@ -51,6 +54,11 @@ func assertFileWasUploaded(
 	// the reader is closed at the end of the method
 }
 
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
 func TestS3Uploader(t *testing.T) {
 	var s3Client *aws_client_mocks.FakeS3ObjectUploadingAPI
 
@@ -61,7 +69,7 @@ func TestS3Uploader(t *testing.T) {
 		s3Client = &aws_client_mocks.FakeS3ObjectUploadingAPI{}
 		uploader := NewUploader(s3Client, "test-bucket")
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "unknown_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "unknown_file"), Key: "key", ContentType: "text/html"})
 		assert.Error(t, err, fmt.Errorf("file not found"))
 	})
 
@@ -76,7 +84,7 @@ func TestS3Uploader(t *testing.T) {
 
 		var irrelevantAWSError error = &types.TooManyParts{}
 		s3Client.HeadObjectReturns(nil, irrelevantAWSError)
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 
 		assert.ErrorIs(t, err, irrelevantAWSError)
 	})
@@ -96,13 +104,13 @@ func TestS3Uploader(t *testing.T) {
 			Size: aws.Int64(int64(len(files["a_file"]))),
 		}, nil)
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 		assert.NoError(t, err)
 
 		assertFileWasUploaded(t, s3Client, "key", "text/html")
 	})
 
-	t.Run("if the object exists in s3, and the size is the same, does not upload the file", func(t *testing.T) {
+	t.Run("if the object exists in s3 with the same content hash, does not upload the file", func(t *testing.T) {
 		files := map[string]string{
 			"a_file": "some content",
 		}
@@ -115,14 +123,61 @@ func TestS3Uploader(t *testing.T) {
 		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
 			ContentLength: aws.Int64(int64(len(files["a_file"]))),
 			ContentType:   aws.String("text/html"),
+			Metadata:      map[string]string{ContentHashMetadataKey: sha256Hex(files["a_file"])},
 		}, nil)
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 		assert.NoError(t, err)
+		assert.Equal(t, OutcomeSkippedIdentical, outcome)
 
 		assert.Equal(t, 0, s3Client.PutObjectCallCount())
 	})
 
+	t.Run("if the object exists in s3 with the same size but a different content hash, uploads the file", func(t *testing.T) {
+		files := map[string]string{
+			"a_file": "some content",
+		}
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client = &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		uploader := NewUploader(s3Client, "test-bucket")
+
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(files["a_file"]))),
+			ContentType:   aws.String("text/html"),
+			Metadata:      map[string]string{ContentHashMetadataKey: sha256Hex("SOME CONTENT")},
+		}, nil)
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedChanged, outcome)
+
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+	})
+
+	t.Run("if the object exists in s3 without a content hash, uploads the file", func(t *testing.T) {
+		files := map[string]string{
+			"a_file": "some content",
+		}
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client = &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		uploader := NewUploader(s3Client, "test-bucket")
+
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(files["a_file"]))),
+			ContentType:   aws.String("text/html"),
+		}, nil)
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedChanged, outcome)
+
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+	})
+
 	t.Run("if the object exists in s3, and the size is different, uploads the file", func(t *testing.T) {
 		files := map[string]string{
 			"a_file": "some content",
@@ -141,7 +196,7 @@ func TestS3Uploader(t *testing.T) {
 			Size: aws.Int64(int64(len(files["a_file"]))),
 		}, nil)
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 		assert.NoError(t, err)
 
 		assertFileWasUploaded(t, s3Client, "key", "text/html")
@@ -165,7 +220,7 @@ func TestS3Uploader(t *testing.T) {
 			Size: aws.Int64(int64(len(files["a_file"]))),
 		}, nil)
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 		assert.NoError(t, err)
 
 		assertFileWasUploaded(t, s3Client, "key", "text/html")
@@ -183,7 +238,7 @@ func TestS3Uploader(t *testing.T) {
 		expectedError := &types.InvalidRequest{}
 		s3Client.HeadObjectReturns(nil, &types.NotFound{})
 		s3Client.PutObjectReturns(nil, expectedError)
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 
 		assert.ErrorIs(t, err, expectedError)
 	})
@@ -208,7 +263,7 @@ func TestS3Uploader(t *testing.T) {
 			ChecksumSHA1: aws.String(checksum),
 		}, nil)
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/html")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
 		assert.NoError(t, err)
 
 		assert.Equal(t, 1, s3Client.PutObjectCallCount())
@@ -219,6 +274,27 @@ func TestS3Uploader(t *testing.T) {
 		assert.Equal(t, aws.String(checksum), args.ChecksumSHA1)
 	})
 
+	t.Run("when uploading a file, the SHA-256 content hash is stored as metadata", func(t *testing.T) {
+		files := map[string]string{
+			"a_file": "some content",
+		}
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client = &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		uploader := NewUploader(s3Client, "test-bucket")
+
+		s3Client.HeadObjectReturns(nil, &types.NotFound{})
+		s3Client.PutObjectReturns(&s3.PutObjectOutput{}, nil)
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+		assert.Equal(t, OutcomeUploadedNew, outcome)
+
+		_, args, _ := s3Client.PutObjectArgsForCall(0)
+		assert.Equal(t, map[string]string{ContentHashMetadataKey: sha256Hex(files["a_file"])}, args.Metadata)
+	})
+
 	t.Run("when uploading a file, the Content Type is provided", func(t *testing.T) {
 		files := map[string]string{
 			"a_file": "some content",
@@ -234,9 +310,240 @@ func TestS3Uploader(t *testing.T) {
 			Size: aws.Int64(int64(len(files["a_file"]))),
 		}, nil)
 
-		err := uploader.UploadFile(t.Context(), path.Join(tmpDir, "a_file"), "key", "text/css")
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/css"})
 		assert.NoError(t, err)
 
 		assertFileWasUploaded(t, s3Client, "key", "text/css")
 	})
 }
+
+func TestS3UploaderWithInventory(t *testing.T) {
+	files := map[string]string{
+		"a_file": "some content",
+	}
+	md5Sum := md5.Sum([]byte(files["a_file"]))
+	etag := `"` + hex.EncodeToString(md5Sum[:]) + `"`
+
+	t.Run("if the object is not in the inventory, uploads the file without looking it up", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.PutObjectReturns(&s3.PutObjectOutput{ETag: aws.String(etag)}, nil)
+		inventory := NewInventory()
+		uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 0, s3Client.HeadObjectCallCount())
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+
+		info, ok := inventory.Get("key")
+		assert.True(t, ok, "the inventory should be updated after uploading")
+		assert.Equal(t, ObjectInfo{
+			Size:       int64(len(files["a_file"])),
+			ETag:       etag,
+			Attributes: &ObjectAttributes{ContentType: "text/html"},
+		}, info)
+	})
+
+	t.Run("if the object is in the inventory with the same content and headers, does not upload the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		inventory := NewInventory()
+		inventory.Put("key", ObjectInfo{
+			Size:       int64(len(files["a_file"])),
+			ETag:       etag,
+			Attributes: &ObjectAttributes{ContentType: "text/html"},
+		})
+		uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, OutcomeSkippedIdentical, outcome)
+		assert.Equal(t, 0, s3Client.HeadObjectCallCount())
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+	})
+
+	t.Run("if the object is in the inventory with the same content but a different content type, uploads the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.PutObjectReturns(&s3.PutObjectOutput{ETag: aws.String(etag)}, nil)
+		inventory := NewInventory()
+		inventory.Put("key", ObjectInfo{
+			Size:       int64(len(files["a_file"])),
+			ETag:       etag,
+			Attributes: &ObjectAttributes{ContentType: "text/plain"},
+		})
+		uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, OutcomeUploadedChanged, outcome)
+		assert.Equal(t, 0, s3Client.HeadObjectCallCount())
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+	})
+
+	t.Run("if the listed object has the same content, checks its content type with HeadObject", func(t *testing.T) {
+		tests := []struct {
+			name            string
+			remoteType      string
+			expectedOutcome Outcome
+			expectedPuts    int
+		}{
+			{name: "same content type", remoteType: "text/html", expectedOutcome: OutcomeSkippedIdentical, expectedPuts: 0},
+			{name: "different content type", remoteType: "text/plain", expectedOutcome: OutcomeUploadedChanged, expectedPuts: 1},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				tmpDir := setupFixtures(t, files)
+				defer teardownFixtures(t, tmpDir)
+
+				s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+				s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+					ContentLength: aws.Int64(int64(len(files["a_file"]))),
+					ContentType:   aws.String(tt.remoteType),
+					Metadata:      map[string]string{ContentHashMetadataKey: sha256Hex(files["a_file"])},
+				}, nil)
+				s3Client.PutObjectReturns(&s3.PutObjectOutput{ETag: aws.String(etag)}, nil)
+				inventory := NewInventory()
+				inventory.Put("key", ObjectInfo{Size: int64(len(files["a_file"])), ETag: etag})
+				uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory))
+
+				outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+				assert.NoError(t, err)
+
+				assert.Equal(t, tt.expectedOutcome, outcome)
+				assert.Equal(t, 1, s3Client.HeadObjectCallCount())
+				assert.Equal(t, tt.expectedPuts, s3Client.PutObjectCallCount())
+			})
+		}
+	})
+
+	t.Run("if the object is in the inventory with the same size but different content, uploads the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.PutObjectReturns(&s3.PutObjectOutput{ETag: aws.String(etag)}, nil)
+		inventory := NewInventory()
+		inventory.Put("key", ObjectInfo{Size: int64(len(files["a_file"])), ETag: `"00000000000000000000000000000000"`})
+		uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 0, s3Client.HeadObjectCallCount())
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+	})
+
+	t.Run("if the object in the inventory was uploaded in parts, falls back to HeadObject", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentLength: aws.Int64(int64(len(files["a_file"]))),
+			ContentType:   aws.String("text/html"),
+			Metadata:      map[string]string{ContentHashMetadataKey: sha256Hex(files["a_file"])},
+		}, nil)
+		inventory := NewInventory()
+		inventory.Put("key", ObjectInfo{Size: int64(len(files["a_file"])), ETag: `"d41d8cd98f00b204e9800998ecf8427e-2"`})
+		uploader := NewUploader(s3Client, "test-bucket", WithInventory(inventory))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, 1, s3Client.HeadObjectCallCount())
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+	})
+}
+
+func TestS3UploaderWithObjectPolicy(t *testing.T) {
+	files := map[string]string{
+		"a_file": "some content",
+	}
+	policy, err := NewObjectPolicy([]PolicyRule{
+		{
+			MediaTypes:         []string{"text/html"},
+			CacheControl:       "public, max-age=300",
+			ContentDisposition: "inline",
+			ContentLanguage:    "en",
+			Metadata:           map[string]string{"source-url": SourceURLPlaceholder, "crawl-run-id": RunIDPlaceholder},
+		},
+	})
+	assert.NoError(t, err)
+
+	t.Run("uploads the file with the headers and metadata decided by the policy", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(nil, &types.NotFound{})
+		uploader := NewUploader(s3Client, "test-bucket", WithObjectPolicy(policy, "run-1"))
+
+		_, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html", SourceURL: "https://www.gov.uk/a_file"})
+		assert.NoError(t, err)
+
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+		_, putCallArgs, _ := s3Client.PutObjectArgsForCall(0)
+		assert.Equal(t, aws.String("public, max-age=300"), putCallArgs.CacheControl)
+		assert.Equal(t, aws.String("inline"), putCallArgs.ContentDisposition)
+		assert.Equal(t, aws.String("en"), putCallArgs.ContentLanguage)
+		assert.Equal(t, map[string]string{
+			ContentHashMetadataKey: sha256Hex(files["a_file"]),
+			"source-url":           "https://www.gov.uk/a_file",
+			"crawl-run-id":         "run-1",
+		}, putCallArgs.Metadata)
+	})
+
+	t.Run("if only the caching headers differ from the object, uploads the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentType:        aws.String("text/html"),
+			CacheControl:       aws.String("public, max-age=3600"),
+			ContentDisposition: aws.String("inline"),
+			ContentLanguage:    aws.String("en"),
+			Metadata:           map[string]string{ContentHashMetadataKey: sha256Hex(files["a_file"])},
+		}, nil)
+		uploader := NewUploader(s3Client, "test-bucket", WithObjectPolicy(policy, "run-1"))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, OutcomeUploadedChanged, outcome)
+		assertFileWasUploaded(t, s3Client, "key", "text/html")
+	})
+
+	t.Run("if the headers match and only the run ID differs, does not upload the file", func(t *testing.T) {
+		tmpDir := setupFixtures(t, files)
+		defer teardownFixtures(t, tmpDir)
+
+		s3Client := &aws_client_mocks.FakeS3ObjectUploadingAPI{}
+		s3Client.HeadObjectReturns(&s3.HeadObjectOutput{
+			ContentType:        aws.String("text/html"),
+			CacheControl:       aws.String("public, max-age=300"),
+			ContentDisposition: aws.String("inline"),
+			ContentLanguage:    aws.String("en"),
+			Metadata:           map[string]string{ContentHashMetadataKey: sha256Hex(files["a_file"]), "crawl-run-id": "run-0"},
+		}, nil)
+		uploader := NewUploader(s3Client, "test-bucket", WithObjectPolicy(policy, "run-1"))
+
+		outcome, err := uploader.UploadFile(t.Context(), File{Path: path.Join(tmpDir, "a_file"), Key: "key", ContentType: "text/html"})
+		assert.NoError(t, err)
+
+		assert.Equal(t, OutcomeSkippedIdentical, outcome)
+		assert.Equal(t, 0, s3Client.PutObjectCallCount())
+	})
+}
@@ -0,0 +1,159 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mirrorer/internal/aws_client_interfaces"
+	"mirrorer/internal/upload"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// Report is the result of checking a bucket against a crawl manifest
+type Report struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+	RunID  string `json:"run_id"`
+	// Checked is the number of objects in the manifest that were looked up
+	Checked int `json:"checked"`
+	// Missing are the keys in the manifest that are not in the bucket
+	Missing []string `json:"missing"`
+	// Mismatched are the objects in the bucket that differ from the manifest
+	Mismatched []Mismatch `json:"mismatched"`
+	// FailedUploads are the keys that the crawl failed to upload
+	FailedUploads []string `json:"failed_uploads"`
+	// PartiallyFailed are the files the crawl uploaded to some backends but not others, with
+	// the backends each failed to upload to
+	PartiallyFailed []upload.PartialFailure `json:"partially_failed"`
+	// Unexpected are the keys under the prefix that are not in the manifest
+	Unexpected []string `json:"unexpected"`
+}
+
+// Mismatch describes how an object differs from its manifest entry
+type Mismatch struct {
+	Key         string   `json:"key"`
+	Differences []string `json:"differences"`
+}
+
+// OK reports whether every file in the manifest was uploaded and is present and intact.
+// Unexpected objects are only counted if strict is set.
+func (r *Report) OK(strict bool) bool {
+	if strict && len(r.Unexpected) > 0 {
+		return false
+	}
+	return len(r.Missing) == 0 && len(r.Mismatched) == 0 && len(r.FailedUploads) == 0 && len(r.PartiallyFailed) == 0
+}
+
+// Verifier checks that the objects in a bucket match a crawl manifest
+type Verifier struct {
+	s3          aws_client_interfaces.S3VerifyAPI
+	bucketName  string
+	concurrency int
+}
+
+func NewVerifier(s3 aws_client_interfaces.S3VerifyAPI, bucketName string, concurrency int) *Verifier {
+	return &Verifier{
+		s3:          s3,
+		bucketName:  bucketName,
+		concurrency: max(concurrency, 1),
+	}
+}
+
+// Verify looks up every object in the manifest, comparing its size, content type and checksum,
+// and lists the objects under prefix that are not in the manifest
+func (v *Verifier) Verify(ctx context.Context, manifest *upload.ManifestFile, prefix string) (*Report, error) {
+	report := &Report{
+		Bucket:          v.bucketName,
+		Prefix:          prefix,
+		RunID:           manifest.RunID,
+		Checked:         len(manifest.Files),
+		Missing:         []string{},
+		Mismatched:      []Mismatch{},
+		FailedUploads:   manifest.Failed,
+		PartiallyFailed: manifest.PartiallyFailed,
+		Unexpected:      []string{},
+	}
+	if report.FailedUploads == nil {
+		report.FailedUploads = []string{}
+	}
+	if report.PartiallyFailed == nil {
+		report.PartiallyFailed = []upload.PartialFailure{}
+	}
+
+	var mu sync.Mutex
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(v.concurrency)
+
+	for _, entry := range manifest.Files {
+		group.Go(func() error {
+			object, err := v.s3.HeadObject(groupCtx, &s3.HeadObjectInput{
+				Bucket: aws.String(v.bucketName),
+				Key:    aws.String(entry.Key),
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				var notFoundErr *types.NotFound
+				if errors.As(err, &notFoundErr) {
+					report.Missing = append(report.Missing, entry.Key)
+					return nil
+				}
+				return fmt.Errorf("failed to get metadata of object %s: %w", entry.Key, err)
+			}
+
+			if differences := entry.Differences(object); len(differences) > 0 {
+				report.Mismatched = append(report.Mismatched, Mismatch{Key: entry.Key, Differences: differences})
+			}
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+
+	expected := map[string]struct{}{}
+	for _, entry := range manifest.Files {
+		expected[entry.Key] = struct{}{}
+	}
+	for _, key := range manifest.Failed {
+		expected[key] = struct{}{}
+	}
+	for _, partialFailure := range manifest.PartiallyFailed {
+		expected[partialFailure.Key] = struct{}{}
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(v.s3, &s3.ListObjectsV2Input{
+		Bucket: aws.String(v.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects under %q in bucket %s: %w", prefix, v.bucketName, err)
+		}
+
+		for _, object := range page.Contents {
+			if _, ok := expected[aws.ToString(object.Key)]; !ok {
+				report.Unexpected = append(report.Unexpected, aws.ToString(object.Key))
+			}
+		}
+	}
+
+	slices.Sort(report.Missing)
+	slices.SortFunc(report.Mismatched, func(a, b Mismatch) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	slices.Sort(report.Unexpected)
+
+	return report, nil
+}
@@ -0,0 +1,184 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"mirrorer/internal/aws_client_mocks"
+	"mirrorer/internal/upload"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBucket makes the fake S3 client behave like a bucket holding the given objects
+func fakeBucket(objects map[string]*s3.HeadObjectOutput) *aws_client_mocks.FakeS3VerifyAPI {
+	s3Client := &aws_client_mocks.FakeS3VerifyAPI{}
+
+	s3Client.HeadObjectStub = func(ctx context.Context, input *s3.HeadObjectInput, f ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+		object, ok := objects[aws.ToString(input.Key)]
+		if !ok {
+			return nil, &types.NotFound{}
+		}
+		return object, nil
+	}
+
+	s3Client.ListObjectsV2Stub = func(ctx context.Context, input *s3.ListObjectsV2Input, f ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+		output := &s3.ListObjectsV2Output{}
+		for key := range objects {
+			output.Contents = append(output.Contents, types.Object{Key: aws.String(key)})
+		}
+		return output, nil
+	}
+
+	return s3Client
+}
+
+func htmlObject(size int64, digest string) *s3.HeadObjectOutput {
+	return &s3.HeadObjectOutput{
+		ContentType:   aws.String("text/html"),
+		ContentLength: aws.Int64(size),
+		Metadata:      map[string]string{upload.ContentHashMetadataKey: digest},
+	}
+}
+
+var manifest = &upload.ManifestFile{
+	RunID: "run-1",
+	Files: []upload.ManifestEntry{
+		{Key: "www.gov.uk/a.html", Size: 10, ContentType: "text/html", SHA256: "aaa"},
+		{Key: "www.gov.uk/b.html", Size: 20, ContentType: "text/html", SHA256: "bbb"},
+		{Key: "www.gov.uk/c.html", Size: 30, ContentType: "text/html", SHA256: "ccc"},
+	},
+}
+
+func TestVerifier(t *testing.T) {
+	t.Run("reports nothing when the bucket matches the manifest", func(t *testing.T) {
+		s3Client := fakeBucket(map[string]*s3.HeadObjectOutput{
+			"www.gov.uk/a.html": htmlObject(10, "aaa"),
+			"www.gov.uk/b.html": htmlObject(20, "bbb"),
+			"www.gov.uk/c.html": htmlObject(30, "ccc"),
+		})
+
+		report, err := NewVerifier(s3Client, "test-bucket", 2).Verify(t.Context(), manifest, "")
+		assert.NoError(t, err)
+
+		assert.True(t, report.OK(true))
+		assert.Equal(t, &Report{
+			Bucket:          "test-bucket",
+			RunID:           "run-1",
+			Checked:         3,
+			Missing:         []string{},
+			Mismatched:      []Mismatch{},
+			FailedUploads:   []string{},
+			PartiallyFailed: []upload.PartialFailure{},
+			Unexpected:      []string{},
+		}, report)
+	})
+
+	t.Run("reports missing, mismatched and unexpected objects", func(t *testing.T) {
+		s3Client := fakeBucket(map[string]*s3.HeadObjectOutput{
+			"www.gov.uk/a.html":   htmlObject(10, "aaa"),
+			"www.gov.uk/b.html":   htmlObject(21, "bbc"),
+			"www.gov.uk/old.html": htmlObject(40, "ddd"),
+		})
+
+		report, err := NewVerifier(s3Client, "test-bucket", 2).Verify(t.Context(), manifest, "www.gov.uk/")
+		assert.NoError(t, err)
+
+		assert.False(t, report.OK(false))
+		assert.Equal(t, []string{"www.gov.uk/c.html"}, report.Missing)
+		assert.Equal(t, []Mismatch{{
+			Key:         "www.gov.uk/b.html",
+			Differences: []string{"size is 21, expected 20", `checksum is "bbc", expected "bbb"`},
+		}}, report.Mismatched)
+		assert.Equal(t, []string{"www.gov.uk/old.html"}, report.Unexpected)
+
+		_, listInput, _ := s3Client.ListObjectsV2ArgsForCall(0)
+		assert.Equal(t, aws.String("www.gov.uk/"), listInput.Prefix)
+	})
+
+	t.Run("unexpected objects only fail a strict verification", func(t *testing.T) {
+		s3Client := fakeBucket(map[string]*s3.HeadObjectOutput{
+			"www.gov.uk/a.html":   htmlObject(10, "aaa"),
+			"www.gov.uk/b.html":   htmlObject(20, "bbb"),
+			"www.gov.uk/c.html":   htmlObject(30, "ccc"),
+			"www.gov.uk/old.html": htmlObject(40, "ddd"),
+		})
+
+		report, err := NewVerifier(s3Client, "test-bucket", 2).Verify(t.Context(), manifest, "")
+		assert.NoError(t, err)
+
+		assert.True(t, report.OK(false))
+		assert.False(t, report.OK(true))
+	})
+
+	t.Run("files that failed to upload fail the verification and are not unexpected", func(t *testing.T) {
+		s3Client := fakeBucket(map[string]*s3.HeadObjectOutput{
+			"www.gov.uk/failed.html": htmlObject(10, "old"),
+		})
+
+		report, err := NewVerifier(s3Client, "test-bucket", 2).Verify(t.Context(), &upload.ManifestFile{
+			Failed: []string{"www.gov.uk/failed.html"},
+		}, "")
+		assert.NoError(t, err)
+
+		assert.False(t, report.OK(false))
+		assert.Equal(t, []string{"www.gov.uk/failed.html"}, report.FailedUploads)
+		assert.Empty(t, report.Unexpected)
+	})
+
+	t.Run("files that only reached some backends fail the verification and are not unexpected", func(t *testing.T) {
+		partialManifest := &upload.ManifestFile{
+			Files: manifest.Files,
+			PartiallyFailed: []upload.PartialFailure{
+				{Key: "www.gov.uk/partial.html", Backends: []string{"mirrorS3Replica"}},
+			},
+		}
+
+		tests := []struct {
+			name    string
+			objects map[string]*s3.HeadObjectOutput
+		}{
+			{
+				name: "a bucket that got the file",
+				objects: map[string]*s3.HeadObjectOutput{
+					"www.gov.uk/a.html":       htmlObject(10, "aaa"),
+					"www.gov.uk/b.html":       htmlObject(20, "bbb"),
+					"www.gov.uk/c.html":       htmlObject(30, "ccc"),
+					"www.gov.uk/partial.html": htmlObject(40, "ddd"),
+				},
+			},
+			{
+				name: "a bucket that didn't get the file",
+				objects: map[string]*s3.HeadObjectOutput{
+					"www.gov.uk/a.html": htmlObject(10, "aaa"),
+					"www.gov.uk/b.html": htmlObject(20, "bbb"),
+					"www.gov.uk/c.html": htmlObject(30, "ccc"),
+				},
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				report, err := NewVerifier(fakeBucket(tt.objects), "test-bucket", 2).Verify(t.Context(), partialManifest, "")
+				assert.NoError(t, err)
+
+				assert.False(t, report.OK(false))
+				assert.Equal(t, partialManifest.PartiallyFailed, report.PartiallyFailed)
+				assert.Empty(t, report.Missing)
+				assert.Empty(t, report.Unexpected)
+			})
+		}
+	})
+
+	t.Run("returns an error if an object can't be looked up", func(t *testing.T) {
+		s3Client := fakeBucket(nil)
+		s3Client.HeadObjectStub = nil
+		s3Client.HeadObjectReturns(nil, errors.New("access denied"))
+
+		_, err := NewVerifier(s3Client, "test-bucket", 2).Verify(t.Context(), manifest, "")
+		assert.ErrorContains(t, err, "access denied")
+	})
+}
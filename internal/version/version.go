@@ -0,0 +1,44 @@
+package version
+
+import (
+	"runtime/debug"
+)
+
+// Version is set when building a release with
+// -ldflags "-X mirrorer/internal/version.Version=<version>"
+var Version = ""
+
+// Get returns the version the binary was built from: Version if it was set at build time,
+// otherwise the VCS revision recorded by the Go toolchain, or "unknown"
+func Get() string {
+	if Version != "" {
+		return Version
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	return revision(info.Settings)
+}
+
+func revision(settings []debug.BuildSetting) string {
+	revision, modified := "", false
+	for _, setting := range settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+
+	if revision == "" {
+		return "unknown"
+	}
+	if modified {
+		return revision + "-dirty"
+	}
+	return revision
+}
@@ -0,0 +1,35 @@
+package version
+
+import (
+	"runtime/debug"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	t.Run("returns the version set at build time", func(t *testing.T) {
+		Version = "v1.2.3"
+		defer func() { Version = "" }()
+
+		assert.Equal(t, "v1.2.3", Get())
+	})
+
+	t.Run("falls back to the VCS revision", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			settings []debug.BuildSetting
+			expected string
+		}{
+			{"clean", []debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}, {Key: "vcs.modified", Value: "false"}}, "abc123"},
+			{"modified", []debug.BuildSetting{{Key: "vcs.revision", Value: "abc123"}, {Key: "vcs.modified", Value: "true"}}, "abc123-dirty"},
+			{"no revision", []debug.BuildSetting{}, "unknown"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				assert.Equal(t, tt.expected, revision(tt.settings))
+			})
+		}
+	})
+}
@@ -47,7 +47,7 @@ echo "Starting in 3 seconds..."
 sleep 3
 
 # Build and run the Go scraper
-go run ../cmd/main.go
+go run ../cmd
 
 echo "Scraping complete. Checking results..."
 
@@ -68,11 +68,6 @@ else
     echo "No assets domain files found"
 fi
 
-# Create freshness marker
-mkdir -p "${WWW_DOMAIN}"
-date -Iseconds > "${WWW_DOMAIN}/last-updated.txt"
-echo "Created freshness marker: ${WWW_DOMAIN}/last-updated.txt"
-
 echo "Local mirror test complete!"
 echo "You can now inspect the downloaded files in: ${DATA_DIR}"
 echo ""